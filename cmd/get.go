@@ -0,0 +1,106 @@
+package main
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/mod"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func getCmd(args []string) int {
+	fs := newFlagSet("get")
+	name := fs.String("name", "", "vendor the package as `name` instead of the name it declares")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if *name != "" && len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "doma get: -name needs exactly one source")
+		return 2
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var project *mod.Project
+	if root, ok := mod.Find(cwd); ok {
+		project, err = mod.Open(root)
+	} else if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "doma: creating %s\n", mod.ManifestFile)
+		project = mod.Init(cwd, filepath.Base(cwd))
+	} else {
+		err = fmt.Errorf("no %s found in %s or any parent directory", mod.ManifestFile, cwd)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doma get: %s\n", err)
+		return 1
+	}
+
+	if len(args) == 0 {
+		err = project.Sync()
+	}
+	for _, arg := range args {
+		source, version := splitVersion(arg)
+		var req *mod.Requirement
+		if req, err = project.Get(source, version, *name); err != nil {
+			break
+		}
+		if rev := project.Sum[req.Name].Version; rev != "-" {
+			fmt.Fprintf(os.Stderr, "doma: vendored %s at %s\n", req.Name, rev)
+		} else {
+			fmt.Fprintf(os.Stderr, "doma: vendored %s\n", req.Name)
+		}
+	}
+	if err == nil {
+		err = project.Save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doma get: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// splitVersion splits a source of the form path@version.
+func splitVersion(arg string) (string, string) {
+	i := strings.LastIndex(arg, "@")
+	if i <= 0 || strings.ContainsAny(arg[i+1:], "/:") {
+		return arg, ""
+	}
+	return arg[:i], arg[i+1:]
+}
+
+func verifyCmd(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: doma verify")
+		return 2
+	}
+	root, ok := mod.Find(".")
+	if !ok {
+		fmt.Fprintf(os.Stderr, "doma verify: no %s found\n", mod.ManifestFile)
+		return 1
+	}
+	project, err := mod.Open(root)
+	if err == nil {
+		err = project.Verify()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("all packages verified")
+	return 0
+}
+
+// vendorOptions makes the module loader search the vendor directory of the
+// project dir belongs to, if any.
+func vendorOptions(dir string) []eval.Option {
+	root, ok := mod.Find(dir)
+	if !ok {
+		return nil
+	}
+	return []eval.Option{eval.WithVendorDir(filepath.Join(root, mod.VendorDir))}
+}
@@ -1,92 +1,598 @@
 package main
 
 import (
-	"bufio"
+	"doma/pkg/check"
 	"doma/pkg/eval"
+	"doma/pkg/format"
+	"doma/pkg/gogen"
 	"doma/pkg/lexer"
+	"doma/pkg/lsp"
+	"doma/pkg/optimize"
 	"doma/pkg/parser"
+	"doma/pkg/unittest"
+	"doma/pkg/vm"
+	"errors"
+	"flag"
 	"fmt"
+	"go/token"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 )
 
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "run [--vm] [--no-opt] [file | -] [-- args...]", "run a doma script or .domac file, reading stdin for -; --vm compiles it to bytecode first", runCmd},
+		{"eval", "eval expr", "evaluate an expression and print the result", evalCmd},
+		{"repl", "repl [--image session]", "start an interactive session", replCmd},
+		{"build", "build [--no-opt] file.doma [-o file.domac]", "compile a script to bytecode that doma run loads without parsing", buildCmd},
+		{"gogen", "gogen [-o file.go] [-pkg name] file.doma", "translate a script to a Go package", gogenCmd},
+		{"fmt", "fmt [-w] [--check] files...", "format doma source files", fmtCmd},
+		{"check", "check files...", "report problems in doma source files without running them", checkCmd},
+		{"test", "test [-v] [-run regexp] [-format f] [paths...]", "run the deftest tests in *_test.doma files; -format is text, tap or junit", testCmd},
+		{"get", "get [-name name] [source[@version] ...]", "vendor packages and add them to doma.mod, or vendor everything doma.mod requires", getCmd},
+		{"verify", "verify", "check the vendored packages against doma.sum", verifyCmd},
+		{"lsp", "lsp", "start a language server on stdin and stdout", lspCmd},
+		{"help", "help", "show this help", helpCmd},
+	}
+}
+
 func main() {
-	switch len(os.Args) {
-	case 1:
-		startRepl(os.Stdin, os.Stdout)
-	case 2:
-		if os.Args[1] == "help" {
-			showUsage()
-			return
+	os.Exit(dispatch(os.Args[1:]))
+}
+
+func dispatch(args []string) int {
+	if len(args) == 0 {
+		return replCmd(nil)
+	}
+	if args[0] == "--image" {
+		return replCmd(args)
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
 		}
-		evalFile(os.Args[1])
-	default:
-		showUsage()
 	}
+	if args[0] == "-" || !strings.HasPrefix(args[0], "-") {
+		// `doma script.doma` is kept so scripts can be run directly
+		return runCmd(args)
+	}
+	fmt.Fprintf(os.Stderr, "doma: unknown command %s\n", args[0])
+	showUsage(os.Stderr)
+	return 2
 }
 
-func showUsage() {
-	fmt.Println("Usage: ./doma [filename]")
+func showUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: doma <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-46s %s\n", c.usage, c.help)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Running doma without a command starts the REPL, and doma file.doma runs a script.")
 }
 
-func startRepl(in io.Reader, out io.Writer) {
-	fmt.Println("Welcome to Doma!")
-	scanner := bufio.NewScanner(in)
-	env := eval.NewEnv()
-	for {
-		fmt.Fprint(out, "> ")
-		scanned := scanner.Scan()
-		if !scanned {
-			return
+func helpCmd(args []string) int {
+	showUsage(os.Stdout)
+	return 0
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("doma "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func replCmd(args []string) int {
+	fs := newFlagSet("repl")
+	image := fs.String("image", "", "restore a saved session before starting")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	return startRepl(os.Stdin, os.Stdout, *image)
+}
+
+func runCmd(args []string) int {
+	var opts runOptions
+	for len(args) > 0 && (args[0] == "--vm" || args[0] == "--no-opt") {
+		if args[0] == "--vm" {
+			opts.vm = true
+		} else {
+			opts.noOpt = true
 		}
-		line := scanner.Text()
-		evalPrint(line, env)
+		args = args[1:]
 	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: doma run [--vm] [--no-opt] [file | -] [-- args...]")
+		return 2
+	}
+	filename, scriptArgs := args[0], args[1:]
+	if len(scriptArgs) > 0 && scriptArgs[0] == "--" {
+		scriptArgs = scriptArgs[1:]
+	}
+	if filepath.Ext(filename) == ".domac" {
+		return runCompiled(filename, scriptArgs)
+	}
+	contents, err := readSource(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return runSource(filename, contents, scriptArgs, opts)
 }
 
-func evalFile(filename string) {
-	file, err := os.Open(filename)
+func buildCmd(args []string) int {
+	fs := newFlagSet("build")
+	out := fs.String("o", "", "write the compiled file to `path` instead of next to the source")
+	noOpt := fs.Bool("no-opt", false, "don't optimize the program before compiling it")
+	args, err := parseInterspersed(fs, args)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return 2
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: doma build [--no-opt] file.doma [-o file.domac]")
+		return 2
+	}
+	filename := args[0]
+	if *out == "" {
+		*out = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".domac"
+	}
+	contents, program, ok := parseFile(filename)
+	if !ok {
+		return 1
+	}
+	if !*noOpt {
+		optimize.Program(program)
 	}
-	defer file.Close()
-	contents, err := io.ReadAll(file)
+	fn, err := vm.Compile(program)
 	if err != nil {
-		fmt.Println(err)
-		return
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		return 1
 	}
-	env := eval.NewEnv()
-	evalPrint(string(contents), env)
+	source, err := sourcePath(*out, filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data, err := vm.NewModule(fn, source, contents).MarshalBinary()
+	if err == nil {
+		err = os.WriteFile(*out, data, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
 }
 
-func evalPrint(contents string, env *eval.Env) {
-	l := lexer.New(contents)
-	p := parser.New(l)
+// parseInterspersed parses the flags of fs, which may also follow the
+// positional arguments, as in doma build file.doma -o file.domac, and returns
+// the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseFile reads and parses a script, reporting errors to stderr.
+func parseFile(filename string) ([]byte, *parser.Program, bool) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, false
+	}
+	p := parser.New(lexer.New(string(contents)))
 	program := p.ParseProgram()
 	if len(p.Errors()) > 0 {
 		for _, err := range p.Errors() {
-			fmt.Println(err)
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
 		}
-		return
+		return nil, nil, false
 	}
-	if len(program.Args) > 0 {
-		obj := eval.Eval(program, env)
-		if obj != nil && obj.Type() != eval.NIL_OBJ {
-			fmt.Println(obj.Inspect())
+	return contents, program, true
+}
+
+func gogenCmd(args []string) int {
+	fs := newFlagSet("gogen")
+	out := fs.String("o", "", "write the Go source to `file` instead of stdout")
+	pkg := fs.String("pkg", "", "name the Go package `name` instead of after the script")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: doma gogen [-o file.go] [-pkg name] file.doma")
+		return 2
+	}
+	filename := args[0]
+	_, program, ok := parseFile(filename)
+	if !ok {
+		return 1
+	}
+	if *pkg == "" {
+		*pkg = packageName(filename)
+	}
+	src, err := gogen.Generate(program, gogen.Options{Package: *pkg, Source: filepath.Base(filename)})
+	if err == nil {
+		if *out == "" {
+			_, err = os.Stdout.Write(src)
+		} else {
+			err = os.WriteFile(*out, src, 0o644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// packageName derives a Go package name from the name of a script. Names
+// that are Go keywords or main, which can't be imported, get a doma suffix.
+func packageName(filename string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' && b.Len() > 0 {
+			b.WriteRune(r)
 		}
 	}
+	name := b.String()
+	if token.IsKeyword(name) || name == "main" {
+		return name + "doma"
+	}
+	if name == "" {
+		return "doma"
+	}
+	return name
 }
 
-func getFileContent(filename string) (string, error) {
-	file, err := os.Open(filename)
+// sourcePath returns the path of source relative to the directory of the
+// compiled file, which is how the compiled file records it.
+func sourcePath(compiled, source string) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(compiled))
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(source)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
-	content, err := io.ReadAll(file)
+	rel, err := filepath.Rel(dir, abs)
 	if err != nil {
 		return "", err
 	}
-	return string(content), nil
+	return filepath.ToSlash(rel), nil
+}
+
+// runCompiled runs a file written by doma build. When the source it was
+// compiled from is still around but has changed since, the source is run
+// instead so that a stale build never runs outdated code.
+func runCompiled(filename string, args []string) int {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	module := &vm.Module{}
+	if err := module.UnmarshalBinary(data); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s; rebuild it with doma build\n", filename, err)
+		return 1
+	}
+	source := filepath.Join(filepath.Dir(filename), filepath.FromSlash(module.Source))
+	if contents, err := os.ReadFile(source); err == nil && module.Stale(contents) {
+		fmt.Fprintf(os.Stderr, "doma: %s is out of date, running %s\n", filename, source)
+		return runSource(source, string(contents), args, runOptions{vm: true})
+	}
+	env := eval.NewInterpreter(interpreterOptions(source, args)...).Env()
+	return report(filename, vm.New(env).Run(module.Main))
+}
+
+// interpreterOptions returns the options a script named name runs with: its
+// arguments and, unless it doesn't come from a file, its path and the vendor
+// directory of the project it is in.
+func interpreterOptions(name string, args []string) []eval.Option {
+	opts := []eval.Option{eval.WithArgs(args)}
+	if name == "-" || name == "<eval>" {
+		return append(opts, vendorOptions(".")...)
+	}
+	opts = append(opts, eval.WithScriptPath(name))
+	return append(opts, vendorOptions(filepath.Dir(name))...)
+}
+
+func evalCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: doma eval expr")
+		return 2
+	}
+	return runSource("<eval>", strings.Join(args, " "), nil, runOptions{})
+}
+
+// readSource reads a script from filename, or from stdin when it is "-".
+func readSource(filename string) (string, error) {
+	if filename == "-" {
+		contents, err := io.ReadAll(os.Stdin)
+		return string(contents), err
+	}
+	contents, err := os.ReadFile(filename)
+	return string(contents), err
+}
+
+// runOptions selects how runSource runs a script.
+type runOptions struct {
+	// vm compiles the script to bytecode instead of interpreting it.
+	vm bool
+	// noOpt skips the optimizer.
+	noOpt bool
+}
+
+// runSource evaluates a whole script and prints its final value, optimizing
+// it and compiling it to bytecode first as opts say. Parse and runtime
+// errors go to stderr and produce a non-zero exit code.
+func runSource(name string, contents string, args []string, opts runOptions) int {
+	p := parser.New(lexer.New(contents))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		}
+		return 1
+	}
+	env := eval.NewInterpreter(interpreterOptions(name, args)...).Env()
+	if len(program.Args) == 0 {
+		return 0
+	}
+	if !opts.noOpt {
+		optimize.Program(program)
+	}
+	var obj eval.Object
+	if opts.vm {
+		fn, err := vm.Compile(program)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			return 1
+		}
+		obj = vm.New(env).Run(fn)
+	} else {
+		eval.Resolve(program)
+		obj = eval.Eval(program, env)
+	}
+	return report(name, obj)
+}
+
+// report prints the final value of a script, or the error that stopped it,
+// and returns the exit code.
+func report(name string, obj eval.Object) int {
+	if errObj, ok := obj.(*eval.Error); ok {
+		if code, ok := exitCode(errObj); ok {
+			return code
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, errObj.Message)
+		return 1
+	}
+	if obj != nil && obj.Type() != eval.NIL_OBJ {
+		fmt.Println(obj.Inspect())
+	}
+	return 0
+}
+
+func fmtCmd(args []string) int {
+	fs := newFlagSet("fmt")
+	write := fs.Bool("w", false, "write the result back to the source file")
+	check := fs.Bool("check", false, "list files whose formatting differs and exit non-zero")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	status := 0
+	for _, filename := range files {
+		contents, err := readSource(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		formatted, err := format.Source([]byte(contents))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			status = 1
+			continue
+		}
+		switch {
+		case *check:
+			if string(formatted) != contents {
+				fmt.Println(filename)
+				status = 1
+			}
+		case *write && filename != "-":
+			if string(formatted) != contents {
+				if err := os.WriteFile(filename, formatted, 0o644); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					status = 1
+				}
+			}
+		default:
+			os.Stdout.Write(formatted)
+		}
+	}
+	return status
+}
+
+func checkCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: doma check files...")
+		return 2
+	}
+	status := 0
+	for _, filename := range args {
+		contents, err := readSource(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		p := parser.New(lexer.New(contents))
+		program := p.ParseProgram()
+		for _, err := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			status = 1
+		}
+		if len(p.Errors()) > 0 {
+			continue
+		}
+		for _, d := range check.Check(program, eval.NewInterpreter().Env()) {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", filename, d)
+			if d.Severity == check.Error {
+				status = 1
+			}
+		}
+	}
+	return status
+}
+
+func lspCmd(args []string) int {
+	server := lsp.NewServer(os.Stdin, os.Stdout, eval.NewInterpreter().Env())
+	if err := server.Serve(); err != nil {
+		fmt.Fprintln(os.Stderr, "doma lsp:", err)
+		return 1
+	}
+	return 0
+}
+
+// testCmd runs every *_test.doma file below the given directories and fails
+// if any of them reports an error.
+func testCmd(args []string) int {
+	fs := newFlagSet("test")
+	verbose := fs.Bool("v", false, "list every test as it finishes")
+	run := fs.String("run", "", "only run the tests whose name matches `regexp`")
+	format := fs.String("format", "text", "report results as text, tap or junit")
+	timeout := fs.Duration("timeout", time.Minute, "fail a test that runs longer than `d`; 0 disables the limit")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if *format != "text" && *format != "tap" && *format != "junit" {
+		fmt.Fprintf(os.Stderr, "doma test: unknown format %q\n", *format)
+		return 2
+	}
+	opts := unittest.Options{
+		Timeout: *timeout,
+		Interpreter: func(file string) []eval.Option {
+			return vendorOptions(filepath.Dir(file))
+		},
+	}
+	if *run != "" {
+		if opts.Run, err = regexp.Compile(*run); err != nil {
+			fmt.Fprintf(os.Stderr, "doma test: -run: %s\n", err)
+			return 2
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	files, err := unittest.Find(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	all := make([]unittest.Result, 0)
+	for _, filename := range files {
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		results := unittest.RunFile(filename, contents, opts)
+		if *format == "text" {
+			unittest.WriteText(os.Stdout, filename, results, *verbose)
+		}
+		all = append(all, results...)
+	}
+	switch *format {
+	case "tap":
+		unittest.WriteTAP(os.Stdout, all)
+	case "junit":
+		if err := unittest.WriteJUnit(os.Stdout, all); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if _, failed, errored := unittest.Summary(all); failed+errored > 0 {
+		return 1
+	}
+	return 0
+}
+
+// evalPrintEach evaluates every top-level form in contents and prints each
+// result, stopping at the first error. It returns the forms that evaluated
+// successfully and, if one of them called exit, the error asking to exit.
+func evalPrintEach(out io.Writer, contents string, env *eval.Env) ([]parser.Expression, *eval.ExitError) {
+	program, ok := parse(out, contents)
+	if !ok {
+		return nil, nil
+	}
+	done := make([]parser.Expression, 0, len(program.Args))
+	for _, expr := range program.Args {
+		obj := eval.Eval(expr, env)
+		var exit *eval.ExitError
+		if errObj, ok := obj.(*eval.Error); ok && errors.As(errObj.Err, &exit) {
+			return done, exit
+		}
+		if obj != nil && obj.Type() != eval.NIL_OBJ {
+			fmt.Fprintln(out, obj.Inspect())
+		}
+		if obj != nil && obj.Type() == eval.ERROR_OBJ {
+			return done, nil
+		}
+		done = append(done, expr)
+	}
+	return done, nil
+}
+
+// exitCode reports the status requested by a call to exit.
+func exitCode(err *eval.Error) (int, bool) {
+	var exit *eval.ExitError
+	if errors.As(err.Err, &exit) {
+		return exit.Code, true
+	}
+	return 0, false
+}
+
+func parse(out io.Writer, contents string) (*parser.Program, bool) {
+	l := lexer.New(contents)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			fmt.Fprintln(out, err)
+		}
+		return nil, false
+	}
+	return program, true
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPackageName(t *testing.T) {
+	tests := map[string]string{
+		"geometry.doma":     "geometry",
+		"dir/My-Lib_2.doma": "mylib2",
+		"2fast.doma":        "fast",
+		"+++.doma":          "doma",
+		"main.doma":         "maindoma",
+		"type.doma":         "typedoma",
+		"Func.doma":         "funcdoma",
+		"functions.doma":    "functions",
+		"examples/map.doma": "mapdoma",
+	}
+	for filename, want := range tests {
+		if got := packageName(filename); got != want {
+			t.Errorf("packageName(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
+
+func TestScriptExit(t *testing.T) {
+	// restored once the test ends, after the scripts set it
+	t.Setenv("DOMA_TEST_EXIT", "")
+	tests := []struct {
+		src  string
+		args []string
+		want int
+	}{
+		{"(exit 3)", nil, 3},
+		{"(exit)", nil, 0},
+		{"(exit (length (command-line-arguments)))", []string{"a", "b"}, 2},
+		{`(exit (if (= (first (command-line-arguments)) "-v") 5 6))`, []string{"-v"}, 5},
+		{"#!/usr/bin/env doma\n(exit 4)", nil, 4},
+		{`(setenv "DOMA_TEST_EXIT" "7") (exit (if (= (getenv "DOMA_TEST_EXIT") "7") 7 1))`, nil, 7},
+		{"(getenv 1)", nil, 1},
+	}
+	for _, tt := range tests {
+		for _, opts := range []runOptions{{}, {vm: true}} {
+			if got := runSource("<eval>", tt.src, tt.args, opts); got != tt.want {
+				t.Errorf("%q with %+v: exit code %d, want %d", tt.src, opts, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestReplExit(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	var out strings.Builder
+	code := startRepl(strings.NewReader("(display 1)\n(exit 3)\n(display 2)\n"), &out, "")
+	if code != 3 || strings.Contains(out.String(), "2") {
+		t.Errorf("exit code %d, output %q", code, out.String())
+	}
+	if code := startRepl(strings.NewReader("(display 1)\n"), &out, ""); code != 0 {
+		t.Errorf("exit code %d at the end of input", code)
+	}
+}
+
+// withStdin points os.Stdin at a file holding input until the test ends.
+func withStdin(t *testing.T, input string) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(name, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = f
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		f.Close()
+	})
+}
+
+// quiet discards what is written to os.Stdout and os.Stderr until the test
+// ends.
+func quiet(t *testing.T) {
+	t.Helper()
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = null, null
+	t.Cleanup(func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		null.Close()
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"ok.doma":       "(define x 1)\n(+ x 1)\n",
+		"fails.doma":    "(first 1)\n",
+		"syntax.doma":   "(+ 1\n",
+		"unused.doma":   "(define f (lambda '(x) 1))\n",
+		"a_test.doma":   "(deftest a (assert-equal 1 1))\n",
+		"b_test.doma":   "(deftest b (assert-equal 1 2))\n",
+		"ugly.doma":     "(+  1 2)\n",
+		"pretty.doma":   "(+ 1 2)\n",
+		"exits.doma":    "(exit 9)\n",
+		"compiled.doma": "(display 1)\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := func(name string) string { return filepath.Join(dir, name) }
+	tests := []struct {
+		args  []string
+		stdin string
+		want  int
+	}{
+		{[]string{"help"}, "", 0},
+		{[]string{"--bogus"}, "", 2},
+		{[]string{"run"}, "", 2},
+		{[]string{"run", file("ok.doma")}, "", 0},
+		{[]string{file("ok.doma")}, "", 0},
+		{[]string{"run", "--vm", file("ok.doma")}, "", 0},
+		{[]string{"run", file("fails.doma")}, "", 1},
+		{[]string{"run", file("syntax.doma")}, "", 1},
+		{[]string{"run", file("missing.doma")}, "", 1},
+		{[]string{"run", file("exits.doma")}, "", 9},
+		{[]string{"run", "-"}, "(+ 1 2)", 0},
+		{[]string{"-"}, "(exit 4)", 4},
+		{[]string{"run", "-", "--", "a", "b"}, "(exit (length (command-line-arguments)))", 2},
+		{[]string{"run", "-"}, "(first 1)", 1},
+		{[]string{"eval"}, "", 2},
+		{[]string{"eval", "(+", "1", "2)"}, "", 0},
+		{[]string{"eval", "(first 1)"}, "", 1},
+		{[]string{"check"}, "", 2},
+		{[]string{"check", file("ok.doma")}, "", 0},
+		{[]string{"check", file("unused.doma")}, "", 0},
+		{[]string{"check", file("syntax.doma")}, "", 1},
+		{[]string{"check", "-"}, "(display y)", 1},
+		{[]string{"fmt", "--check", file("pretty.doma")}, "", 0},
+		{[]string{"fmt", "--check", file("ugly.doma")}, "", 1},
+		{[]string{"test", file("a_test.doma")}, "", 0},
+		{[]string{"test", dir}, "", 1},
+		{[]string{"test", "-format", "xml"}, "", 2},
+		{[]string{"build", file("compiled.doma"), "-o", file("compiled.domac")}, "", 0},
+		{[]string{"run", file("compiled.domac")}, "", 0},
+		{[]string{"repl"}, "(exit 5)\n", 5},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			withStdin(t, tt.stdin)
+			quiet(t)
+			if got := dispatch(tt.args); got != tt.want {
+				t.Errorf("doma %s: exit code %d, want %d", strings.Join(tt.args, " "), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"doma/pkg/readline"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type repl struct {
+	env     *eval.Env
+	out     io.Writer
+	rl      *readline.Editor
+	session *session
+	// exit is set once evaluated code calls exit, which ends the REPL
+	exit *eval.ExitError
+}
+
+// startRepl runs the REPL until its input ends or the code it evaluates
+// calls exit, and returns the exit status.
+func startRepl(in io.Reader, out io.Writer, image string) int {
+	fmt.Fprintln(out, "Welcome to Doma!")
+	r := &repl{out: out, rl: readline.New(in, out)}
+	r.reset()
+	if image != "" {
+		r.restore(image)
+		if r.exit != nil {
+			return r.exit.Code
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		r.rl.LoadHistory(filepath.Join(home, ".doma_history"))
+	}
+	r.rl.Completer = func(prefix string) []string {
+		return append(r.env.Names(), lexer.Keywords()...)
+	}
+	var input strings.Builder
+	prompt := "> "
+	for {
+		line, err := r.rl.ReadLine(prompt)
+		if err == readline.ErrInterrupt {
+			input.Reset()
+			prompt = "> "
+			continue
+		}
+		if err != nil {
+			return 0
+		}
+		if input.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			r.rl.AddHistory(strings.TrimSpace(line))
+			if !r.command(strings.TrimSpace(line)) {
+				return 0
+			}
+			if r.exit != nil {
+				return r.exit.Code
+			}
+			continue
+		}
+		input.WriteString(line)
+		input.WriteString("\n")
+		if !lexer.IsComplete(input.String()) {
+			prompt = "... "
+			continue
+		}
+		r.rl.AddHistory(historyEntry(input.String()))
+		r.evalPrint(r.out, input.String())
+		if r.exit != nil {
+			return r.exit.Code
+		}
+		input.Reset()
+		prompt = "> "
+	}
+}
+
+// evalPrint evaluates contents like evalPrintEach and records the forms that
+// succeeded in the session.
+func (r *repl) evalPrint(out io.Writer, contents string) []parser.Expression {
+	forms, exit := evalPrintEach(out, contents, r.env)
+	r.session.record(forms)
+	r.exit = exit
+	return forms
+}
+
+// historyEntry puts input on one line for the history, collapsing the
+// whitespace and dropping the comments between tokens. Strings keep their
+// contents.
+func historyEntry(input string) string {
+	var b strings.Builder
+	space := false
+	l := lexer.NewWithMode(input, lexer.ScanTrivia)
+	tok := l.NextToken()
+	for tok.Type != lexer.EOF {
+		next := l.NextToken()
+		if tok.Type == lexer.WHITESPACE || tok.Type == lexer.COMMENT {
+			space = b.Len() > 0
+		} else {
+			if space {
+				b.WriteString(" ")
+				space = false
+			}
+			b.WriteString(input[tok.Offset:next.Offset])
+		}
+		tok = next
+	}
+	return b.String()
+}
+
+func (r *repl) reset() {
+	r.env = eval.NewInterpreter(vendorOptions(".")...).Env()
+	r.env.SetOutput(r.out)
+	r.session = &session{}
+}
+
+var replCommands = []struct {
+	name, args, help string
+}{
+	{":load", "file", "evaluate a file into the current environment"},
+	{":env", "", "list the bindings in the current environment"},
+	{":reset", "", "start over with a fresh environment"},
+	{":time", "expr", "evaluate expr and report wall time and allocations"},
+	{":type", "expr", "show the type of the value of expr"},
+	{":doc", "name", "show the documentation of a procedure"},
+	{":ast", "expr", "dump the syntax tree of expr"},
+	{":save", "file", "save the definitions and imports made in this session"},
+	{":restore", "file", "replay a saved session into the current environment"},
+	{":help", "", "list the REPL commands"},
+	{":quit", "", "exit the REPL"},
+}
+
+// command runs a colon-prefixed REPL command and reports whether the REPL
+// should keep going.
+func (r *repl) command(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case ":quit", ":q":
+		return false
+	case ":help":
+		for _, c := range replCommands {
+			fmt.Fprintf(r.out, "  %-14s %s\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+		}
+	case ":load":
+		if arg == "" {
+			fmt.Fprintln(r.out, "usage: :load file")
+			break
+		}
+		contents, err := os.ReadFile(arg)
+		if err != nil {
+			fmt.Fprintln(r.out, err)
+			break
+		}
+		r.evalPrint(r.out, string(contents))
+	case ":save":
+		if arg == "" {
+			fmt.Fprintln(r.out, "usage: :save file")
+			break
+		}
+		if err := r.session.save(arg); err != nil {
+			fmt.Fprintln(r.out, err)
+			break
+		}
+		fmt.Fprintf(r.out, "saved %d definitions to %s\n", len(r.session.forms), arg)
+	case ":restore":
+		if arg == "" {
+			fmt.Fprintln(r.out, "usage: :restore file")
+			break
+		}
+		r.restore(arg)
+	case ":env":
+		r.printEnv()
+	case ":reset":
+		r.reset()
+		fmt.Fprintln(r.out, "environment reset")
+	case ":time":
+		r.time(arg)
+	case ":type":
+		if obj, ok := r.evalArg(arg); ok {
+			fmt.Fprintln(r.out, obj.Type())
+		}
+	case ":doc":
+		r.doc(arg)
+	case ":ast":
+		program, ok := parse(r.out, arg)
+		if !ok {
+			break
+		}
+		for _, expr := range program.Args {
+			dumpAST(r.out, expr, 0)
+		}
+	default:
+		fmt.Fprintf(r.out, "unknown command %s, try :help\n", name)
+	}
+	return true
+}
+
+func (r *repl) evalArg(arg string) (eval.Object, bool) {
+	program, ok := parse(r.out, arg)
+	if !ok {
+		return nil, false
+	}
+	if len(program.Args) == 0 {
+		fmt.Fprintln(r.out, "expected an expression")
+		return nil, false
+	}
+	obj := eval.Eval(program, r.env)
+	if obj == nil {
+		obj = &eval.Nil{}
+	}
+	if obj.Type() == eval.ERROR_OBJ {
+		fmt.Fprintln(r.out, obj.Inspect())
+		return nil, false
+	}
+	return obj, true
+}
+
+func (r *repl) printEnv() {
+	for _, name := range r.env.Names() {
+		obj, _ := r.env.Get(name)
+		fmt.Fprintf(r.out, "%s = %s\n", name, obj.Inspect())
+	}
+}
+
+func (r *repl) time(arg string) {
+	program, ok := parse(r.out, arg)
+	if !ok {
+		return
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	obj := eval.Eval(program, r.env)
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	if obj != nil && obj.Type() != eval.NIL_OBJ {
+		fmt.Fprintln(r.out, obj.Inspect())
+	}
+	fmt.Fprintf(r.out, "time: %s, allocated: %d bytes in %d objects\n",
+		elapsed, after.TotalAlloc-before.TotalAlloc, after.Mallocs-before.Mallocs)
+}
+
+func (r *repl) doc(arg string) {
+	obj, ok := r.evalArg(arg)
+	if !ok {
+		return
+	}
+	doc := eval.Doc(obj)
+	if doc == "" {
+		fmt.Fprintf(r.out, "no documentation for %s\n", arg)
+		return
+	}
+	fmt.Fprintln(r.out, doc)
+}
+
+func dumpAST(out io.Writer, expr parser.Expression, depth int) {
+	indent := strings.Repeat("  ", depth)
+	if expr == nil {
+		fmt.Fprintf(out, "%s<nil>\n", indent)
+		return
+	}
+	kind := reflect.TypeOf(expr).Elem().Name()
+	switch expr := expr.(type) {
+	case *parser.Form:
+		fmt.Fprintf(out, "%s%s\n", indent, kind)
+		dumpAST(out, expr.First, depth+1)
+		for _, arg := range expr.Rest {
+			dumpAST(out, arg, depth+1)
+		}
+	case *parser.List:
+		fmt.Fprintf(out, "%s%s\n", indent, kind)
+		for _, arg := range expr.Args {
+			dumpAST(out, arg, depth+1)
+		}
+	default:
+		fmt.Fprintf(out, "%s%s %s\n", indent, kind, expr.String())
+	}
+}
+
+// restore replays a saved session with output discarded, so only the
+// definitions it makes are visible.
+func (r *repl) restore(filename string) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(r.out, err)
+		return
+	}
+	r.env.SetOutput(io.Discard)
+	forms := r.evalPrint(io.Discard, string(contents))
+	r.env.SetOutput(r.out)
+	if r.exit != nil {
+		return
+	}
+	program, ok := parse(r.out, string(contents))
+	if ok && len(forms) < len(program.Args) {
+		fmt.Fprintf(r.out, "%s: stopped after %d of %d definitions\n", filename, len(forms), len(program.Args))
+		return
+	}
+	fmt.Fprintf(r.out, "restored %d definitions from %s\n", len(forms), filename)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistoryEntry(t *testing.T) {
+	tests := map[string]string{
+		"(display \"a  b\")\n":                 "(display \"a  b\")",
+		"(define f\n  (lambda '(x)\n    x))\n": "(define f (lambda '(x) x))",
+		"(+ 1 ; one\n   2)\n":                  "(+ 1 2)",
+		"  ; only a comment\n(f)\n":            "(f)",
+		"(printf \"\\t\")\n":                   "(printf \"\\t\")",
+	}
+	for input, want := range tests {
+		if got := historyEntry(input); got != want {
+			t.Errorf("historyEntry(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestSaveRestore(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.doma")
+	if err := os.WriteFile(lib, []byte("(module lib (export twice))\n(define twice (lambda '(x) (* 2 x)))\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	r := &repl{out: &out}
+	r.reset()
+	r.evalPrint(r.out, fmt.Sprintf("(import %q as lib)\n(define y (lib/twice 2))\n(display y)\n", lib))
+	image := filepath.Join(dir, "session.doma")
+	r.command(":save " + image)
+	r.command(":reset")
+	r.command(":restore " + image)
+	out.Reset()
+	evalPrintEach(r.out, "(lib/twice y)", r.env)
+	if got := out.String(); got != "8\n" {
+		t.Errorf("after restoring got %q, want %q", got, "8\n")
+	}
+	if len(r.session.forms) != 2 {
+		t.Errorf("restored session has %d forms, want 2", len(r.session.forms))
+	}
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.doma")
+	if err := os.WriteFile(script, []byte("(define y 2)\ny\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		setup string
+		line  string
+		want  string
+	}{
+		{"", ":type 1", "NUMBER\n"},
+		{"", `:type (+ 1 "a")`, "ERROR: type mismatch - expected number, got STRING\n"},
+		{"", ":type", "expected an expression\n"},
+		{"", ":doc first", "(first lst) returns the first element of lst\n"},
+		{"(define x 1)", ":doc x", "no documentation for x\n"},
+		{"", ":doc nothing", "ERROR: identifier not found: nothing\n"},
+		{"", ":ast (f 1 '(a))", "Form\n  Identifier f\n  Number 1\n  List\n    Identifier a\n"},
+		{"", ":load " + script, "2\n2\n"},
+		{"", ":load", "usage: :load file\n"},
+		{"(define x 1)", ":reset", "environment reset\n"},
+		{"", ":save", "usage: :save file\n"},
+		{"", ":restore", "usage: :restore file\n"},
+		{"", ":bogus", "unknown command :bogus, try :help\n"},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		r := &repl{out: &out}
+		r.reset()
+		r.evalPrint(r.out, tt.setup)
+		out.Reset()
+		if !r.command(tt.line) {
+			t.Errorf("%s ended the REPL", tt.line)
+		}
+		if got := out.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestCommandState(t *testing.T) {
+	var out strings.Builder
+	r := &repl{out: &out}
+	r.reset()
+	r.evalPrint(r.out, "(define x 41)")
+	r.command(":env")
+	if !strings.Contains(out.String(), "x = 41\n") {
+		t.Errorf(":env printed %q", out.String())
+	}
+	out.Reset()
+	r.command(":time (+ x 1)")
+	if got := out.String(); !strings.HasPrefix(got, "42\ntime: ") || !strings.Contains(got, " objects\n") {
+		t.Errorf(":time printed %q", got)
+	}
+	out.Reset()
+	r.command(":help")
+	if got := out.String(); strings.Count(got, "\n") != len(replCommands) || !strings.Contains(got, "  :load file     evaluate a file") {
+		t.Errorf(":help printed %q", got)
+	}
+	r.command(":reset")
+	out.Reset()
+	r.command(":type x")
+	if got := out.String(); got != "ERROR: identifier not found: x\n" {
+		t.Errorf("x after :reset: %q", got)
+	}
+	if r.command(":quit") || r.command(":q") {
+		t.Errorf(":quit didn't end the REPL")
+	}
+}
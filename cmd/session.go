@@ -0,0 +1,51 @@
+package main
+
+import (
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// session keeps a transcript of the top-level definitions and imports made in
+// the REPL. They are the only forms that change the environment, so
+// replaying them in order rebuilds it, closures included.
+type session struct {
+	forms []parser.Expression
+}
+
+func (s *session) record(forms []parser.Expression) {
+	for _, form := range forms {
+		if isDefinition(form) {
+			s.forms = append(s.forms, form)
+		}
+	}
+}
+
+func isDefinition(expr parser.Expression) bool {
+	form, ok := expr.(*parser.Form)
+	if !ok {
+		return false
+	}
+	first, ok := form.First.(*parser.BuiltinIdentifier)
+	if !ok {
+		return false
+	}
+	switch first.Token.Type {
+	case lexer.DEFINE, lexer.IMPORT, lexer.REQUIRE:
+		return true
+	}
+	return false
+}
+
+func (s *session) save(filename string) error {
+	var out strings.Builder
+	fmt.Fprintf(&out, "; doma session saved %s\n", time.Now().Format(time.RFC3339))
+	for _, form := range s.forms {
+		out.WriteString(form.String())
+		out.WriteString("\n")
+	}
+	return os.WriteFile(filename, []byte(out.String()), 0o644)
+}
@@ -0,0 +1,492 @@
+// Package check finds mistakes in doma programs without running them.
+//
+// It resolves every identifier against the lexical scopes introduced by
+// define and lambda and reports undefined names, globals used at the top
+// level before they are defined, unused parameters and local definitions,
+// definitions that shadow predefined procedures, calls with the wrong number
+// of arguments and malformed special forms. Names imported from
+// modules are only known by what the import forms list, so qualified names
+// such as lib/fn are assumed to exist once a program imports anything.
+package check
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+func (s Severity) String() string {
+	if s == Warning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a problem found at a position in the source.
+type Diagnostic struct {
+	Line     int
+	Col      int
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s", d.Line, d.Col, d.Severity, d.Message)
+}
+
+// Binding is a name introduced by define or by a lambda parameter.
+type Binding struct {
+	Name string
+	// Token is where the name is bound. It is the zero token for names
+	// that were predefined in the environment.
+	Token lexer.Token
+	// Arity is the number of parameters when the name is bound to a
+	// lambda and eval.VARIADIC when it is unknown.
+	Arity int
+	// Value is the expression given to define, nil for parameters.
+	Value parser.Expression
+	Refs  []*parser.Identifier
+
+	param  bool
+	global bool
+	// defined is set once a global's define has run at the top level
+	defined bool
+}
+
+// Check analyses program and returns its diagnostics sorted by position.
+// Names bound in env, such as the natives of an eval.Interpreter, are
+// treated as predefined; env may be nil.
+func Check(program *parser.Program, env *eval.Env) []Diagnostic {
+	return Analyze(program, env).Diagnostics
+}
+
+// Result holds everything Analyze learned about a program.
+type Result struct {
+	Diagnostics []Diagnostic
+	// Bindings lists the names bound by the program in source order.
+	Bindings []*Binding
+	// Uses maps each identifier that refers to a binding to it.
+	Uses map[*parser.Identifier]*Binding
+}
+
+// Analyze is like Check but also returns the bindings of the program and
+// what every identifier refers to.
+func Analyze(program *parser.Program, env *eval.Env) *Result {
+	c := &checker{
+		result: &Result{
+			Diagnostics: make([]Diagnostic, 0),
+			Bindings:    make([]*Binding, 0),
+			Uses:        make(map[*parser.Identifier]*Binding),
+		},
+	}
+	predefined := newScope(nil)
+	if env != nil {
+		for _, name := range env.Names() {
+			obj, _ := env.Get(name)
+			predefined.names[name] = &Binding{Name: name, Arity: arityOf(obj), global: true, defined: true}
+		}
+	}
+	c.predefined = predefined
+	global := newScope(predefined)
+	c.body(program.Args, global, true)
+	sort.SliceStable(c.result.Diagnostics, func(i, j int) bool {
+		a, b := c.result.Diagnostics[i], c.result.Diagnostics[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return c.result
+}
+
+func arityOf(obj eval.Object) int {
+	switch obj := obj.(type) {
+	case *eval.Native:
+		return obj.Arity
+	case *eval.Procedure:
+		return len(obj.Value.Params)
+	case *eval.Lambda:
+		return len(obj.Params)
+	}
+	return eval.VARIADIC
+}
+
+type scope struct {
+	names map[string]*Binding
+	outer *scope
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{names: make(map[string]*Binding), outer: outer}
+}
+
+func (s *scope) lookup(name string) *Binding {
+	for ; s != nil; s = s.outer {
+		if b, ok := s.names[name]; ok {
+			return b
+		}
+	}
+	return nil
+}
+
+type checker struct {
+	result     *Result
+	predefined *scope
+	// imports is set when the program imports a module.
+	imports bool
+	// deferred counts the lambda and test bodies being checked, which
+	// only run once the top level has defined everything.
+	deferred int
+}
+
+func (c *checker) report(tok lexer.Token, severity Severity, format string, a ...any) {
+	c.result.Diagnostics = append(c.result.Diagnostics, Diagnostic{
+		Line:     tok.Line,
+		Col:      tok.Col,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// body checks a sequence of expressions that share sc. Definitions are bound
+// before anything is checked so that procedures can refer to ones defined
+// after them.
+func (c *checker) body(exprs []parser.Expression, sc *scope, global bool) {
+	for _, expr := range exprs {
+		c.hoist(expr, sc, global)
+	}
+	for _, expr := range exprs {
+		c.expr(expr, sc)
+	}
+	if global {
+		return
+	}
+	for _, b := range sc.names {
+		if len(b.Refs) == 0 && !strings.HasPrefix(b.Name, "_") {
+			kind := "local definition"
+			if b.param {
+				kind = "parameter"
+			}
+			c.report(b.Token, Warning, "%s %s is never used", kind, b.Name)
+		}
+	}
+}
+
+// hoist binds the names defined by expr in sc, looking through begin and if
+// since their definitions end up in the same environment.
+func (c *checker) hoist(expr parser.Expression, sc *scope, global bool) {
+	form, ok := expr.(*parser.Form)
+	if !ok {
+		return
+	}
+	switch builtin(form.First) {
+	case lexer.DEFINE:
+		if len(form.Rest) == 0 {
+			return
+		}
+		name, ok := form.Rest[0].(*parser.Identifier)
+		if !ok {
+			return
+		}
+		var value parser.Expression
+		arity := eval.VARIADIC
+		if len(form.Rest) > 1 {
+			value = form.Rest[1]
+			arity = lambdaArity(value)
+		}
+		if b, ok := sc.names[name.Value]; ok {
+			// redefined, so calls can't be checked against one arity
+			b.Arity = eval.VARIADIC
+			return
+		}
+		if c.predefined.names[name.Value] != nil {
+			c.report(name.Token, Warning, "%s shadows a predefined procedure", name.Value)
+		}
+		c.bind(sc, &Binding{Name: name.Value, Token: name.Token, Arity: arity, Value: value, global: global})
+	case lexer.BEGIN, lexer.IF:
+		for _, arg := range form.Rest {
+			c.hoist(arg, sc, global)
+		}
+	case lexer.IMPORT, lexer.REQUIRE:
+		c.imports = true
+		if len(form.Rest) == 0 {
+			return
+		}
+		names, ok := form.Rest[len(form.Rest)-1].(*parser.List)
+		if !ok {
+			return
+		}
+		for _, arg := range names.Args {
+			// (name new-name) binds the new name
+			if rename, ok := arg.(*parser.Form); ok && len(rename.Rest) == 1 {
+				arg = rename.Rest[0]
+			}
+			name, ok := arg.(*parser.Identifier)
+			if !ok {
+				continue
+			}
+			if _, ok := sc.names[name.Value]; !ok {
+				c.bind(sc, &Binding{Name: name.Value, Token: name.Token, Arity: eval.VARIADIC, global: global, defined: true})
+			}
+		}
+	}
+}
+
+func (c *checker) bind(sc *scope, b *Binding) {
+	sc.names[b.Name] = b
+	c.result.Bindings = append(c.result.Bindings, b)
+}
+
+func lambdaArity(expr parser.Expression) int {
+	form, ok := expr.(*parser.Form)
+	if !ok || builtin(form.First) != lexer.LAMBDA || len(form.Rest) == 0 {
+		return eval.VARIADIC
+	}
+	params, ok := form.Rest[0].(*parser.List)
+	if !ok {
+		return eval.VARIADIC
+	}
+	return len(params.Args)
+}
+
+func builtin(expr parser.Expression) lexer.TokenType {
+	if b, ok := expr.(*parser.BuiltinIdentifier); ok {
+		return b.Token.Type
+	}
+	return ""
+}
+
+func (c *checker) expr(expr parser.Expression, sc *scope) {
+	switch expr := expr.(type) {
+	case *parser.Identifier:
+		c.use(expr, sc)
+	case *parser.List:
+		// identifiers in a list are quoted, everything else is evaluated
+		for _, arg := range expr.Args {
+			switch arg.(type) {
+			case *parser.Identifier, *parser.BuiltinIdentifier:
+			default:
+				c.expr(arg, sc)
+			}
+		}
+	case *parser.Form:
+		c.form(expr, sc)
+	}
+}
+
+func (c *checker) use(ident *parser.Identifier, sc *scope) *Binding {
+	b := sc.lookup(ident.Value)
+	if b == nil {
+		if c.imports && strings.Contains(ident.Value, "/") {
+			return nil
+		}
+		c.report(ident.Token, Error, "undefined: %s", ident.Value)
+		return nil
+	}
+	if b.global && !b.defined && c.deferred == 0 {
+		c.report(ident.Token, Error, "%s is used before it is defined", ident.Value)
+	}
+	b.Refs = append(b.Refs, ident)
+	c.result.Uses[ident] = b
+	return b
+}
+
+func (c *checker) form(form *parser.Form, sc *scope) {
+	switch head := form.First.(type) {
+	case *parser.BuiltinIdentifier:
+		c.builtinForm(head, form, sc)
+		return
+	case *parser.Identifier:
+		b := c.use(head, sc)
+		if arity, ok := nativeArities[head.Value]; ok && b != nil && b.Token.Line == 0 {
+			c.arity(form, head.Value, arity)
+		}
+		if b != nil && b.Arity != eval.VARIADIC && len(form.Rest) != b.Arity {
+			// natives reject the call, but a lambda binds missing
+			// parameters to nil and ignores extra arguments
+			severity := Warning
+			if b.Token.Line == 0 {
+				severity = Error
+			}
+			c.report(form.Token, severity, "%s expects %s, got %d", head.Value, plural(b.Arity, "argument"), len(form.Rest))
+		}
+	case *parser.Form:
+		c.form(head, sc)
+	case nil:
+		return
+	default:
+		c.report(form.Token, Error, "cannot call %s", head.String())
+	}
+	for _, arg := range form.Rest {
+		c.expr(arg, sc)
+	}
+}
+
+// arities holds the number of arguments each builtin accepts, as a minimum
+// and a maximum where -1 means no limit.
+var arities = map[lexer.TokenType][2]int{
+	lexer.PLUS:     {1, -1},
+	lexer.MINUS:    {1, -1},
+	lexer.ASTERISK: {1, -1},
+	lexer.SLASH:    {1, -1},
+	lexer.EQ:       {2, 2},
+	lexer.LT:       {2, 2},
+	lexer.LTE:      {2, 2},
+	lexer.GT:       {2, 2},
+	lexer.GTE:      {2, 2},
+	lexer.FIRST:    {1, 1},
+	lexer.REST:     {1, 1},
+	lexer.LENGTH:   {1, 1},
+	lexer.CONS:     {2, 2},
+	lexer.LIST_REF: {2, 2},
+	lexer.DEFINE:   {2, 2},
+	lexer.IF:       {2, 3},
+	lexer.LAMBDA:   {2, -1},
+	lexer.MODULE:   {1, -1},
+	lexer.IMPORT:   {1, 4},
+	lexer.REQUIRE:  {1, 4},
+
+	lexer.DEFTEST: {1, -1},
+}
+
+// nativeArities holds the number of arguments of the predefined natives
+// that take optional ones, which their VARIADIC arity doesn't tell.
+var nativeArities = map[string][2]int{
+	"assert-equal": {2, 3},
+	"assert-true":  {1, 2},
+	"assert-error": {1, 2},
+}
+
+func (c *checker) arity(form *parser.Form, name string, arity [2]int) {
+	n := len(form.Rest)
+	switch {
+	case arity[0] == arity[1] && n != arity[0]:
+		c.report(form.Token, Error, "%s expects %s, got %d", name, plural(arity[0], "argument"), n)
+	case n < arity[0]:
+		c.report(form.Token, Error, "%s expects at least %s, got %d", name, plural(arity[0], "argument"), n)
+	case arity[1] != -1 && n > arity[1]:
+		c.report(form.Token, Error, "%s expects at most %s, got %d", name, plural(arity[1], "argument"), n)
+	}
+}
+
+func (c *checker) builtinForm(head *parser.BuiltinIdentifier, form *parser.Form, sc *scope) {
+	if arity, ok := arities[head.Token.Type]; ok {
+		c.arity(form, head.Value, arity)
+	}
+	switch head.Token.Type {
+	case lexer.DEFINE:
+		c.define(form, sc)
+	case lexer.LAMBDA:
+		c.lambda(form, sc)
+	case lexer.MODULE:
+		for _, arg := range form.Rest[min(1, len(form.Rest)):] {
+			c.expr(arg, sc)
+		}
+	case lexer.EXPORT:
+		// exports are looked up once the module has been evaluated
+		c.deferred++
+		for _, arg := range form.Rest {
+			if ident, ok := arg.(*parser.Identifier); ok {
+				c.use(ident, sc)
+			}
+		}
+		c.deferred--
+	case lexer.IMPORT, lexer.REQUIRE:
+	case lexer.DEFTEST:
+		if len(form.Rest) > 0 {
+			c.deferred++
+			c.body(form.Rest[1:], newScope(sc), false)
+			c.deferred--
+		}
+	default:
+		for _, arg := range form.Rest {
+			c.expr(arg, sc)
+		}
+	}
+}
+
+func (c *checker) define(form *parser.Form, sc *scope) {
+	if len(form.Rest) == 0 {
+		return
+	}
+	if _, ok := form.Rest[0].(*parser.Identifier); !ok {
+		c.report(startOf(form.Rest[0], form.Token), Error, "define expects a name, got %s", form.Rest[0].String())
+	}
+	for _, arg := range form.Rest[1:] {
+		c.expr(arg, sc)
+	}
+	if name, ok := form.Rest[0].(*parser.Identifier); ok {
+		if b := sc.lookup(name.Value); b != nil && b.global {
+			b.defined = true
+		}
+	}
+}
+
+func (c *checker) lambda(form *parser.Form, sc *scope) {
+	if len(form.Rest) == 0 {
+		return
+	}
+	inner := newScope(sc)
+	params, ok := form.Rest[0].(*parser.List)
+	if !ok {
+		c.report(startOf(form.Rest[0], form.Token), Error, "lambda expects a parameter list, got %s", form.Rest[0].String())
+	} else {
+		for _, param := range params.Args {
+			ident, ok := param.(*parser.Identifier)
+			if !ok {
+				c.report(startOf(param, params.Token), Error, "lambda parameter must be an identifier, got %s", param.String())
+				continue
+			}
+			if _, ok := inner.names[ident.Value]; ok {
+				c.report(ident.Token, Error, "duplicate parameter %s", ident.Value)
+				continue
+			}
+			if c.predefined.names[ident.Value] != nil {
+				c.report(ident.Token, Warning, "parameter %s shadows a predefined procedure", ident.Value)
+			}
+			c.bind(inner, &Binding{Name: ident.Value, Token: ident.Token, Arity: eval.VARIADIC, param: true})
+		}
+	}
+	c.deferred++
+	c.body(form.Rest[1:], inner, false)
+	c.deferred--
+}
+
+func startOf(expr parser.Expression, fallback lexer.Token) lexer.Token {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		return expr.Token
+	case *parser.List:
+		return expr.Token
+	case *parser.Identifier:
+		return expr.Token
+	case *parser.BuiltinIdentifier:
+		return expr.Token
+	case *parser.Number:
+		return expr.Token
+	case *parser.String:
+		return expr.Token
+	case *parser.Boolean:
+		return expr.Token
+	case *parser.Symbol:
+		return expr.Token
+	}
+	return fallback
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
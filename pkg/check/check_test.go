@@ -0,0 +1,106 @@
+package check
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"strings"
+	"testing"
+)
+
+func parse(t testing.TB, src string) *parser.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("%q: parse errors: %v", src, p.Errors())
+	}
+	return program
+}
+
+func diagnostics(t testing.TB, src string, env *eval.Env) string {
+	t.Helper()
+	lines := make([]string, 0)
+	for _, d := range Check(parse(t, src), env) {
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"(define x 1) (display x)", ""},
+		{"(display y)", "1:10: error: undefined: y"},
+		{"(define f (lambda '(x) (g x)))\n(define g (lambda '(x) x))", ""},
+		{"(define f (lambda '(x y) x))", "1:23: warning: parameter y is never used"},
+		{"(define f (lambda '(_x) 1))", ""},
+		{"(define f (lambda '() (define a 1) 2))", "1:31: warning: local definition a is never used"},
+		{"(define f (lambda '(x x) x))", "1:23: error: duplicate parameter x"},
+		{"(define f (lambda '(x 1) x))", "1:23: error: lambda parameter must be an identifier, got 1"},
+		{"(lambda x x)", "1:9: error: lambda expects a parameter list, got x\n1:11: error: undefined: x"},
+		{"(define 1 2)", "1:9: error: define expects a name, got 1"},
+		{"(define f (lambda '(a b) (+ a b))) (f 1)", "1:36: warning: f expects 2 arguments, got 1"},
+		{"(display x)\n(define x 1)", "1:10: error: x is used before it is defined"},
+		{"(define x x)", "1:11: error: x is used before it is defined"},
+		{"(define f (lambda '() x)) (define x 1) (f)", ""},
+		{"(deftest t x) (define x 1)", ""},
+		{"(if #t (define x 1)) x", ""},
+		{"(define f (lambda '(a) a)) (define f 2) (f 1 2)", ""},
+		{"(first)", "1:1: error: first expects 1 argument, got 0"},
+		{"(if #t)", "1:1: error: if expects at least 2 arguments, got 1"},
+		{"(if #t 1 2 3)", "1:1: error: if expects at most 3 arguments, got 4"},
+		{"(1 2)", "1:1: error: cannot call 1"},
+		{"'(a (b c))", "1:6: error: undefined: b\n1:8: error: undefined: c"},
+		{"(begin (define x 1)) x", ""},
+		{"(import \"lib.doma\") (lib/f)", ""},
+		{"(import \"lib.doma\" '(f (g h))) (f) (h) (g)", "1:41: error: undefined: g"},
+		{"(lib/f)", "1:2: error: undefined: lib/f"},
+		{"(deftest t (define a 1))", "1:20: warning: local definition a is never used"},
+		{"(module m (export x y)) (define x 1)", "1:21: error: undefined: y"},
+		{"(display a)\n  (first b)", "1:10: error: undefined: a\n2:10: error: undefined: b"},
+	}
+	for _, tt := range tests {
+		if got := diagnostics(t, tt.input, nil); got != tt.want {
+			t.Errorf("%s:\ngot:  %q\nwant: %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestCheckEnv(t *testing.T) {
+	env := eval.NewInterpreter().Env()
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"(read-file \"a\")", ""},
+		{"(read-file)", "1:1: error: read-file expects 1 argument, got 0"},
+		{"(define read-file 1)", "1:9: warning: read-file shadows a predefined procedure"},
+		{"(define f (lambda '(getenv) getenv))", "1:21: warning: parameter getenv shadows a predefined procedure"},
+		{"(deftest t (assert-true #t))", ""},
+		{"(assert-true 1 2 3)", "1:1: error: assert-true expects at most 2 arguments, got 3"},
+		{"(define import 1)\n(display import)", ""},
+	}
+	for _, tt := range tests {
+		if got := diagnostics(t, tt.input, env); got != tt.want {
+			t.Errorf("%s:\ngot:  %q\nwant: %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	program := parse(t, "(define f (lambda '(x) x))\n(f 1)\n(f 2)")
+	result := Analyze(program, nil)
+	if len(result.Bindings) != 2 {
+		t.Fatalf("got %d bindings", len(result.Bindings))
+	}
+	f, x := result.Bindings[0], result.Bindings[1]
+	if f.Name != "f" || f.Arity != 1 || len(f.Refs) != 2 || f.Refs[1].Token.Line != 3 {
+		t.Errorf("f is %+v", f)
+	}
+	if x.Name != "x" || x.Token.Col != 21 || len(x.Refs) != 1 || result.Uses[x.Refs[0]] != x {
+		t.Errorf("x is %+v", x)
+	}
+}
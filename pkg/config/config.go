@@ -0,0 +1,188 @@
+// Package config uses doma as a configuration language. A config file is an
+// ordinary doma program whose final value, an association list of
+// '(key value) pairs, is decoded into a Go value.
+package config
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Unmarshal evaluates data as a doma program and decodes its result into the
+// value pointed to by v. Struct fields are matched using their `doma` tag,
+// falling back to a case-insensitive match on the field name.
+func Unmarshal(data []byte, v any) error {
+	return UnmarshalEnv(data, eval.NewEnv(), v)
+}
+
+// UnmarshalEnv is like Unmarshal but evaluates data in env, which lets
+// callers expose natives or shared definitions to the config file.
+func UnmarshalEnv(data []byte, env *eval.Env, v any) error {
+	p := parser.New(lexer.New(string(data)))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return errors.New(strings.Join(p.Errors(), "\n"))
+	}
+	if len(program.Args) == 0 {
+		return errors.New("config is empty")
+	}
+	obj := eval.Eval(program, env)
+	if errObj, ok := obj.(*eval.Error); ok {
+		return errors.New(errObj.Message)
+	}
+	return Decode(obj, v)
+}
+
+// Load reads and unmarshals the config file at filename.
+func Load(filename string, v any) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// Decode stores the Go equivalent of an already evaluated object in v.
+func Decode(obj eval.Object, v any) error {
+	return eval.FromObject(obj, v)
+}
+
+// Marshal renders v as doma source that Unmarshal decodes back into an
+// equal value. Structs and maps become association lists.
+func Marshal(v any) ([]byte, error) {
+	expr, err := toExpression(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	if expr == nil {
+		return nil, errors.New("cannot marshal nil")
+	}
+	return []byte(expr.String() + "\n"), nil
+}
+
+func toExpression(v reflect.Value) (parser.Expression, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		lit := "#f"
+		tokType := lexer.TokenType(lexer.FALSE)
+		if v.Bool() {
+			lit, tokType = "#t", lexer.TRUE
+		}
+		return &parser.Boolean{Token: lexer.Token{Type: tokType, Literal: lit}, Value: v.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return number(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows NUMBER", v.Uint())
+		}
+		return number(int64(v.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if f != math.Trunc(f) || f >= math.MaxInt64 || f < math.MinInt64 {
+			return nil, fmt.Errorf("%v cannot be represented as NUMBER", f)
+		}
+		return number(int64(f)), nil
+	case reflect.String:
+		return str(v.String())
+	case reflect.Slice, reflect.Array:
+		args := make([]parser.Expression, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			expr, err := toExpression(v.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+			if expr == nil {
+				return nil, fmt.Errorf("index %d: cannot marshal nil", i)
+			}
+			args = append(args, expr)
+		}
+		return list(args), nil
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		pairs := make([]parser.Expression, 0, len(keys))
+		for _, key := range keys {
+			k, err := toExpression(key)
+			if err != nil {
+				return nil, fmt.Errorf("map key: %w", err)
+			}
+			val, err := toExpression(v.MapIndex(key))
+			if err != nil {
+				return nil, fmt.Errorf("map value %s: %w", k, err)
+			}
+			if val != nil {
+				pairs = append(pairs, list([]parser.Expression{k, val}))
+			}
+		}
+		return list(pairs), nil
+	case reflect.Struct:
+		pairs := make([]parser.Expression, 0, v.NumField())
+		for _, f := range eval.StructFields(v.Type()) {
+			field, ok := f.Value(v)
+			if !ok || f.OmitEmpty && field.IsZero() {
+				continue
+			}
+			val, err := toExpression(field)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", f.Name, err)
+			}
+			if val != nil {
+				pairs = append(pairs, list([]parser.Expression{symbol(f.Name), val}))
+			}
+		}
+		return list(pairs), nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return toExpression(v.Elem())
+	}
+	return nil, fmt.Errorf("cannot marshal %s", v.Type())
+}
+
+func number(n int64) parser.Expression {
+	lit := strconv.FormatInt(n, 10)
+	return &parser.Number{Token: lexer.Token{Type: lexer.NUMBER, Literal: lit}, Value: n}
+}
+
+func str(s string) (parser.Expression, error) {
+	if strings.ContainsRune(s, '"') {
+		return nil, fmt.Errorf("cannot marshal string containing a double quote: %q", s)
+	}
+	return &parser.String{Token: lexer.Token{Type: lexer.STRING, Literal: s}, Value: s}, nil
+}
+
+func symbol(name string) parser.Expression {
+	for i := 0; i < len(name); i++ {
+		if !isIdentChar(name[i]) {
+			expr, _ := str(name)
+			return expr
+		}
+	}
+	return &parser.Symbol{Token: lexer.Token{Type: lexer.SYMBOL, Literal: name}, Value: name}
+}
+
+func list(args []parser.Expression) parser.Expression {
+	return &parser.List{Token: lexer.Token{Type: lexer.LPAREN, Literal: "("}, Args: args}
+}
+
+func isIdentChar(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' || ch == '-'
+}
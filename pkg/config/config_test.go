@@ -0,0 +1,178 @@
+package config
+
+import (
+	"doma/pkg/eval"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type server struct {
+	Host    string
+	Port    int
+	Debug   bool     `doma:"debug,omitempty"`
+	Tags    []string `doma:"tags,omitempty"`
+	Matrix  [][]int  `doma:"matrix"`
+	Limits  map[string]int
+	Backup  *server `doma:"backup,omitempty"`
+	Ignored string  `doma:"-"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	values := []server{
+		{Host: "localhost", Port: 80, Matrix: [][]int{}, Limits: map[string]int{}},
+		{
+			Host:   "example.com",
+			Port:   8080,
+			Debug:  true,
+			Tags:   []string{"a", "b c"},
+			Matrix: [][]int{{1, 2}, {}, {-3}},
+			Limits: map[string]int{"conns": 10, "rate-limit": 5},
+			Backup: &server{Host: "backup", Port: 81, Matrix: [][]int{{0}}, Limits: map[string]int{}},
+		},
+	}
+	for _, want := range values {
+		data, err := Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got server
+		if err := Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s decodes to %+v, want %+v", data, got, want)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{server{Host: "h", Port: 1}, `'('('Host "h") '('Port 1) '('matrix '()) '('Limits '()))`},
+		{server{Debug: true, Tags: []string{"x"}}, `'('('Host "") '('Port 0) '('debug #t) '('tags '("x")) '('matrix '()) '('Limits '()))`},
+		{map[string][]int{"b": {1}, "a": nil}, `'('("a" '()) '("b" '(1)))`},
+		{[][]bool{{true}, {false, true}}, `'('(#t) '(#f #t))`},
+		{3.0, "3"},
+	}
+	for _, tt := range tests {
+		got, err := Marshal(tt.in)
+		if err != nil {
+			t.Errorf("Marshal(%v): %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want+"\n" {
+			t.Errorf("Marshal(%v) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{nil, "cannot marshal nil"},
+		{`say "hi"`, "cannot marshal string containing a double quote"},
+		{uint64(1 << 63), "9223372036854775808 overflows NUMBER"},
+		{1.5, "1.5 cannot be represented as NUMBER"},
+		{float64(1 << 63), "cannot be represented as NUMBER"},
+		{[]*int{nil}, "index 0: cannot marshal nil"},
+		{struct{ C chan int }{}, "field C: cannot marshal chan int"},
+	}
+	for _, tt := range tests {
+		_, err := Marshal(tt.in)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Marshal(%v) = %v, want an error containing %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	src := `(define port (* 80 101))
+'('(host "example.com")
+  '(PORT (begin port))
+  '(unknown "ignored")
+  '("tags" '("a"))
+  '(matrix '('(1) '(2 3))))`
+	var got server
+	if err := Unmarshal([]byte(src), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := server{Host: "example.com", Port: 8080, Tags: []string{"a"}, Matrix: [][]int{{1}, {2, 3}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUnmarshalEnv(t *testing.T) {
+	env := eval.NewEnv()
+	env.Set("default-port", &eval.Number{Value: 443})
+	var got server
+	if err := UnmarshalEnv([]byte("'('(port (begin default-port)))"), env, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Port != 443 {
+		t.Errorf("got port %d, want 443", got.Port)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"", "config is empty"},
+		{"'(", "unexpected end of input"},
+		{"(+ 1 \"a\")", "type mismatch"},
+		{"1", "expected an association list, got NUMBER"},
+		{"'('(port))", "association list entries must be (key value) pairs"},
+		{"'('(1 2))", "field name must be a SYMBOL or STRING, got NUMBER"},
+		{"'('(port \"80\"))", "field port: cannot convert STRING to int"},
+		{"'('(debug 1))", "field debug: cannot convert NUMBER to bool"},
+		{"'('(tags '(1)))", "field tags: index 0: cannot convert NUMBER to string"},
+		{"'('(matrix '(1)))", "field matrix: index 0: cannot convert NUMBER to []int"},
+	}
+	for _, tt := range tests {
+		var got server
+		err := Unmarshal([]byte(tt.src), &got)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.src, err, tt.want)
+		}
+	}
+	if err := Unmarshal([]byte("'()"), server{}); err == nil {
+		t.Error("decoding into a non-pointer succeeded")
+	}
+}
+
+type Common struct {
+	Name string
+}
+
+type service struct {
+	*Common
+	Port int
+}
+
+func TestEmbedded(t *testing.T) {
+	tests := []struct {
+		in   service
+		want string
+	}{
+		{service{Port: 1}, `'('('Port 1))`},
+		{service{Common: &Common{Name: "web"}, Port: 1}, `'('('Name "web") '('Port 1))`},
+	}
+	for _, tt := range tests {
+		got, err := Marshal(tt.in)
+		if err != nil || string(got) != tt.want+"\n" {
+			t.Errorf("Marshal(%+v) = %s, %v, want %s", tt.in, got, err, tt.want)
+			continue
+		}
+		var back service
+		if err := Unmarshal(got, &back); err != nil || !reflect.DeepEqual(back, tt.in) {
+			t.Errorf("%s decodes to %+v, %v", got, back, err)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+var (
+	objectType = reflect.TypeOf((*Object)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ToObject converts a Go value into its doma equivalent. Slices and arrays
+// become lists, maps and structs become association lists of (key value)
+// pairs and funcs are wrapped with Wrap.
+func ToObject(v any) (Object, error) {
+	if v == nil {
+		return &Nil{}, nil
+	}
+	if obj, ok := v.(Object); ok {
+		return obj, nil
+	}
+	return toObject(reflect.ValueOf(v))
+}
+
+func toObject(v reflect.Value) (Object, error) {
+	if !v.IsValid() {
+		return &Nil{}, nil
+	}
+	if v.Type().Implements(objectType) && !(v.Kind() == reflect.Pointer && v.IsNil()) {
+		return v.Interface().(Object), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return &Boolean{Value: v.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Number{Value: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows NUMBER", v.Uint())
+		}
+		return &Number{Value: int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		// float64(math.MaxInt64) rounds up to 1<<63, which doesn't fit
+		if f != math.Trunc(f) || f >= math.MaxInt64 || f < math.MinInt64 {
+			return nil, fmt.Errorf("%v cannot be represented as NUMBER", f)
+		}
+		return &Number{Value: int64(f)}, nil
+	case reflect.String:
+		return &String{Value: v.String()}, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return &List{Args: make([]Object, 0)}, nil
+		}
+		args := make([]Object, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			obj, err := toObject(v.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+			args = append(args, obj)
+		}
+		return &List{Args: args}, nil
+	case reflect.Map:
+		pairs := make([]Object, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := toObject(iter.Key())
+			if err != nil {
+				return nil, fmt.Errorf("map key: %w", err)
+			}
+			val, err := toObject(iter.Value())
+			if err != nil {
+				return nil, fmt.Errorf("map value %s: %w", key.Inspect(), err)
+			}
+			pairs = append(pairs, &List{Args: []Object{key, val}})
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			return pairs[i].(*List).Args[0].Inspect() < pairs[j].(*List).Args[0].Inspect()
+		})
+		return &List{Args: pairs}, nil
+	case reflect.Struct:
+		pairs := make([]Object, 0, v.NumField())
+		for _, f := range StructFields(v.Type()) {
+			field, ok := f.Value(v)
+			if !ok || f.OmitEmpty && field.IsZero() {
+				continue
+			}
+			val, err := toObject(field)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", f.Name, err)
+			}
+			pairs = append(pairs, &List{Args: []Object{&Symbol{Value: f.Name}, val}})
+		}
+		return &List{Args: pairs}, nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &Nil{}, nil
+		}
+		return toObject(v.Elem())
+	case reflect.Func:
+		if v.IsNil() {
+			return &Nil{}, nil
+		}
+		return wrapFunc(funcName(v), v)
+	}
+	return nil, fmt.Errorf("cannot convert %s to a doma object", v.Type())
+}
+
+// FromObject stores the Go equivalent of obj in the value pointed to by
+// target, converting lists into slices, association lists into maps or
+// structs and numbers into any integer or float type.
+func FromObject(obj Object, target any) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("FromObject target must be a non-nil pointer")
+	}
+	return fromObject(obj, rv.Elem())
+}
+
+func fromObject(obj Object, v reflect.Value) error {
+	if obj == nil {
+		obj = &Nil{}
+	}
+	if v.Type() == objectType {
+		v.Set(reflect.ValueOf(obj))
+		return nil
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		if native := nativeValue(obj); native != nil {
+			v.Set(reflect.ValueOf(native))
+		} else {
+			v.SetZero()
+		}
+		return nil
+	}
+	if reflect.TypeOf(obj).AssignableTo(v.Type()) {
+		v.Set(reflect.ValueOf(obj))
+		return nil
+	}
+	if obj.Type() == NIL_OBJ {
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func:
+			v.SetZero()
+			return nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if b, ok := obj.(*Boolean); ok {
+			v.SetBool(b.Value)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := obj.(*Number); ok {
+			if v.OverflowInt(n.Value) {
+				return fmt.Errorf("%d overflows %s", n.Value, v.Type())
+			}
+			v.SetInt(n.Value)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, ok := obj.(*Number); ok {
+			if n.Value < 0 || v.OverflowUint(uint64(n.Value)) {
+				return fmt.Errorf("%d overflows %s", n.Value, v.Type())
+			}
+			v.SetUint(uint64(n.Value))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, ok := obj.(*Number); ok {
+			v.SetFloat(float64(n.Value))
+			return nil
+		}
+	case reflect.String:
+		switch s := obj.(type) {
+		case *String:
+			v.SetString(s.Value)
+			return nil
+		case *Symbol:
+			v.SetString(s.Value)
+			return nil
+		}
+	case reflect.Slice:
+		if lst, ok := obj.(*List); ok {
+			slice := reflect.MakeSlice(v.Type(), len(lst.Args), len(lst.Args))
+			for i, arg := range lst.Args {
+				if err := fromObject(arg, slice.Index(i)); err != nil {
+					return fmt.Errorf("index %d: %w", i, err)
+				}
+			}
+			v.Set(slice)
+			return nil
+		}
+	case reflect.Array:
+		if lst, ok := obj.(*List); ok {
+			if len(lst.Args) != v.Len() {
+				return fmt.Errorf("expected %d elements for %s, got %d", v.Len(), v.Type(), len(lst.Args))
+			}
+			for i, arg := range lst.Args {
+				if err := fromObject(arg, v.Index(i)); err != nil {
+					return fmt.Errorf("index %d: %w", i, err)
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		pairs, err := assocPairs(obj)
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(pairs))
+		for _, pair := range pairs {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := fromObject(pair[0], key); err != nil {
+				return fmt.Errorf("map key %s: %w", pair[0].Inspect(), err)
+			}
+			val := reflect.New(v.Type().Elem()).Elem()
+			if err := fromObject(pair[1], val); err != nil {
+				return fmt.Errorf("map value %s: %w", pair[0].Inspect(), err)
+			}
+			m.SetMapIndex(key, val)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Struct:
+		pairs, err := assocPairs(obj)
+		if err != nil {
+			return err
+		}
+		fields := StructFields(v.Type())
+		for _, pair := range pairs {
+			name, ok := keyName(pair[0])
+			if !ok {
+				return fmt.Errorf("field name must be a SYMBOL or STRING, got %s", pair[0].Type())
+			}
+			if f, ok := findField(fields, name); ok {
+				field, err := f.Alloc(v)
+				if err == nil {
+					err = fromObject(pair[1], field)
+				}
+				if err != nil {
+					return fmt.Errorf("field %s: %w", name, err)
+				}
+			}
+		}
+		return nil
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		if err := fromObject(obj, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	}
+	return fmt.Errorf("cannot convert %s to %s", obj.Type(), v.Type())
+}
+
+func nativeValue(obj Object) any {
+	switch obj := obj.(type) {
+	case *Nil:
+		return nil
+	case *Number:
+		return obj.Value
+	case *String:
+		return obj.Value
+	case *Boolean:
+		return obj.Value
+	case *Symbol:
+		return obj.Value
+	case *List:
+		vals := make([]any, 0, len(obj.Args))
+		for _, arg := range obj.Args {
+			vals = append(vals, nativeValue(arg))
+		}
+		return vals
+	}
+	return obj
+}
+
+func assocPairs(obj Object) ([][2]Object, error) {
+	lst, ok := obj.(*List)
+	if !ok {
+		return nil, fmt.Errorf("expected an association list, got %s", obj.Type())
+	}
+	pairs := make([][2]Object, 0, len(lst.Args))
+	for _, arg := range lst.Args {
+		pair, ok := arg.(*List)
+		if !ok || len(pair.Args) != 2 {
+			return nil, fmt.Errorf("association list entries must be (key value) pairs, got %s", arg.Inspect())
+		}
+		pairs = append(pairs, [2]Object{pair.Args[0], pair.Args[1]})
+	}
+	return pairs, nil
+}
+
+func keyName(obj Object) (string, bool) {
+	switch obj := obj.(type) {
+	case *Symbol:
+		return obj.Value, true
+	case *String:
+		return obj.Value, true
+	}
+	return "", false
+}
+
+type StructField struct {
+	Name      string
+	Index     []int
+	OmitEmpty bool
+}
+
+// Value returns the field of the struct v. It reports false when the field
+// is promoted through an embedded pointer that is nil.
+func (f StructField) Value(v reflect.Value) (reflect.Value, bool) {
+	field, err := v.FieldByIndexErr(f.Index)
+	return field, err == nil
+}
+
+// Alloc returns the field of the struct v for setting, first allocating the
+// nil embedded pointers it is promoted through.
+func (f StructField) Alloc(v reflect.Value) (reflect.Value, error) {
+	for i, x := range f.Index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot set embedded pointer to unexported struct %s", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// StructFields lists the exported fields of t under their doma names, which
+// can be overridden with a `doma:"name,omitempty"` tag or skipped with
+// `doma:"-"`.
+func StructFields(t reflect.Type) []StructField {
+	fields := make([]StructField, 0, t.NumField())
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		field := StructField{Name: f.Name, Index: f.Index}
+		if tag, ok := f.Tag.Lookup("doma"); ok {
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name != "" {
+				field.Name = name
+			}
+			field.OmitEmpty = opts == "omitempty"
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func findField(fields []StructField, name string) (StructField, bool) {
+	for _, f := range fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+	return StructField{}, false
+}
+
+// Wrap turns any Go func into a native procedure. Arguments are converted
+// with FromObject and results with ToObject; a trailing error result is
+// reported as a doma error.
+func Wrap(fn any) (*Native, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, fmt.Errorf("Wrap expects a func, got %T", fn)
+	}
+	return wrapFunc(funcName(v), v)
+}
+
+// DefineGo wraps fn and binds it to name.
+func (e *Env) DefineGo(name string, fn any) error {
+	native, err := Wrap(fn)
+	if err != nil {
+		return err
+	}
+	native.Name = name
+	e.Set(name, native)
+	return nil
+}
+
+func wrapFunc(name string, fn reflect.Value) (*Native, error) {
+	t := fn.Type()
+	numOut := t.NumOut()
+	returnsErr := numOut > 0 && t.Out(numOut-1) == errorType
+	if numOut > 2 || (numOut == 2 && !returnsErr) {
+		return nil, fmt.Errorf("cannot wrap %s: expected at most one result and an optional error", t)
+	}
+	arity := t.NumIn()
+	if t.IsVariadic() {
+		arity = VARIADIC
+	}
+	native := &Native{Name: name, Arity: arity}
+	native.Fn = func(args []Object) (result Object, err error) {
+		in, err := funcArgs(t, args)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				result, err = nil, fmt.Errorf("panic: %v", r)
+			}
+		}()
+		out := fn.Call(in)
+		if returnsErr {
+			if errVal := out[len(out)-1]; !errVal.IsNil() {
+				return nil, errVal.Interface().(error)
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return &Nil{}, nil
+		}
+		return toObject(out[0])
+	}
+	return native, nil
+}
+
+func funcArgs(t reflect.Type, args []Object) ([]reflect.Value, error) {
+	fixed := t.NumIn()
+	if t.IsVariadic() {
+		fixed--
+		if len(args) < fixed {
+			return nil, fmt.Errorf("expects at least %d arguments, got %d", fixed, len(args))
+		}
+	}
+	in := make([]reflect.Value, 0, len(args))
+	for i, arg := range args {
+		var pt reflect.Type
+		if i < fixed {
+			pt = t.In(i)
+		} else {
+			pt = t.In(fixed).Elem()
+		}
+		val := reflect.New(pt).Elem()
+		if err := fromObject(arg, val); err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		in = append(in, val)
+	}
+	return in, nil
+}
+
+func funcName(fn reflect.Value) string {
+	f := runtime.FuncForPC(fn.Pointer())
+	if f == nil {
+		return "native"
+	}
+	name := f.Name()
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return name
+}
@@ -0,0 +1,86 @@
+package eval
+
+import (
+	"math"
+	"testing"
+)
+
+func TestToObjectNumbers(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{42, "42"},
+		{uint64(math.MaxInt64), "9223372036854775807"},
+		{-3.0, "-3"},
+		{float64(-1 << 63), "-9223372036854775808"},
+		{float64(1<<62) * 1.5, "6917529027641081856"},
+	}
+	for _, tt := range tests {
+		obj, err := ToObject(tt.in)
+		if err != nil || obj.Inspect() != tt.want {
+			t.Errorf("ToObject(%v) = %v, %v, want %s", tt.in, obj, err, tt.want)
+		}
+	}
+	for _, in := range []any{uint64(1 << 63), float64(1 << 63), math.Inf(1), math.NaN(), 1.5, float32(-1 << 64)} {
+		if obj, err := ToObject(in); err == nil {
+			t.Errorf("ToObject(%v) = %s, want an error", in, obj.Inspect())
+		}
+	}
+}
+
+type inner struct {
+	X int
+}
+
+type Inner struct {
+	X int
+}
+
+type outer struct {
+	*Inner
+	Y int
+}
+
+type hidden struct {
+	*inner
+	Y int
+}
+
+func TestEmbeddedPointers(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{outer{Y: 1}, "'('('Y 1))"},
+		{outer{Inner: &Inner{X: 3}, Y: 1}, "'('('X 3) '('Y 1))"},
+		{hidden{Y: 1}, "'('('Y 1))"},
+		{hidden{inner: &inner{X: 3}, Y: 1}, "'('('X 3) '('Y 1))"},
+	}
+	for _, tt := range tests {
+		obj, err := ToObject(tt.in)
+		if err != nil || obj.Inspect() != tt.want {
+			t.Errorf("ToObject(%+v) = %v, %v, want %s", tt.in, obj, err, tt.want)
+		}
+	}
+
+	pairs := func(x, y int64) Object {
+		return &List{Args: []Object{
+			&List{Args: []Object{&Symbol{Value: "X"}, &Number{Value: x}}},
+			&List{Args: []Object{&Symbol{Value: "Y"}, &Number{Value: y}}},
+		}}
+	}
+	var got outer
+	if err := FromObject(pairs(3, 1), &got); err != nil || got.Inner == nil || got.X != 3 || got.Y != 1 {
+		t.Errorf("FromObject into a nil embedded pointer gives %+v, %v", got, err)
+	}
+	existing := &Inner{X: 1}
+	got = outer{Inner: existing}
+	if err := FromObject(pairs(4, 2), &got); err != nil || got.Inner != existing || existing.X != 4 {
+		t.Errorf("FromObject into a set embedded pointer gives %+v, %v", got, err)
+	}
+	var h hidden
+	if err := FromObject(pairs(3, 1), &h); err == nil {
+		t.Errorf("FromObject set a field through an unexported embedded pointer: %+v", h)
+	}
+}
@@ -0,0 +1,55 @@
+package eval
+
+import (
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+)
+
+var builtinDocs = map[lexer.TokenType]string{
+	lexer.PLUS:     "(+ n ...) adds the numbers together",
+	lexer.MINUS:    "(- n ...) subtracts the rest of the numbers from the first",
+	lexer.ASTERISK: "(* n ...) multiplies the numbers together",
+	lexer.SLASH:    "(/ n ...) divides the first number by the rest",
+	lexer.EQ:       "(= a b) reports whether two numbers, strings or booleans are equal",
+	lexer.LT:       "(< a b) reports whether a is less than b",
+	lexer.LTE:      "(<= a b) reports whether a is less than or equal to b",
+	lexer.GT:       "(> a b) reports whether a is greater than b",
+	lexer.GTE:      "(>= a b) reports whether a is greater than or equal to b",
+	lexer.LAMBDA:   "(lambda '(params ...) body ...) creates a procedure",
+	lexer.IF:       "(if cond then [else]) evaluates then when cond is truthy, otherwise else",
+	lexer.DEFINE:   "(define name value) binds value to name in the current environment",
+	lexer.DISPLAY:  "(display v ...) prints the values separated by spaces followed by a newline",
+	lexer.PRINTF:   "(printf v ...) prints the values, interpreting escapes such as \\n",
+	lexer.FIRST:    "(first lst) returns the first element of lst",
+	lexer.REST:     "(rest lst) returns every element of lst but the first",
+	lexer.LENGTH:   "(length lst) returns the number of elements in lst",
+	lexer.CONS:     "(cons v lst) returns lst with v prepended",
+	lexer.LIST_REF: "(list-ref lst n) returns the nth element of lst",
+	lexer.BEGIN:    "(begin expr ...) evaluates each expression and returns the last",
+	lexer.MODULE:   "(module name (export name ...)) names the module a file defines and what it exports",
+	lexer.EXPORT:   "(export name ...) adds names to the exports of the module",
+	lexer.IMPORT:   "(import \"path\" [as prefix] ['(name (name new-name) ...)]) binds the exports of a module as prefix/name",
+	lexer.REQUIRE:  "(require lib/name [as prefix] ['(name ...)]) imports lib/name.doma, searching $DOMA_PATH",
+	lexer.DEFTEST:  "(deftest name body ...) defines a test that doma test runs",
+}
+
+// Doc returns the documentation attached to a procedure. Lambdas are
+// documented by a string at the start of a body with more than one
+// expression.
+func Doc(obj Object) string {
+	switch obj := obj.(type) {
+	case *Builtin:
+		return builtinDocs[obj.Value]
+	case *Native:
+		return obj.Doc
+	case *Procedure:
+		return Doc(obj.Value)
+	case *Lambda:
+		if len(obj.Body) > 1 {
+			if str, ok := obj.Body[0].(*parser.String); ok {
+				return str.Value
+			}
+		}
+	}
+	return ""
+}
@@ -1,30 +1,120 @@
 package eval
 
+import (
+	"doma/pkg/parser"
+	"io"
+	"sort"
+)
+
 type Env struct {
 	store map[string]Object
+	// slots holds the variables of a lambda call, which frame names. A slot
+	// is nil until its variable is bound.
+	slots []Object
+	frame []string
 	outer *Env
+	state *state
+	// module is set on the top level environment of a module.
+	module *module
 }
 
 func NewEnclosedEnv(outer *Env) *Env {
-	env := NewEnv()
-	env.outer = outer
-	return env
+	return &Env{outer: outer, state: outer.state}
+}
+
+// newFrameEnv returns the environment of a call to a lambda resolved to
+// frame, with every slot unbound.
+func newFrameEnv(outer *Env, frame []string) *Env {
+	return &Env{slots: make([]Object, len(frame)), frame: frame, outer: outer, state: outer.state}
 }
 
 func NewEnv() *Env {
 	store := make(map[string]Object)
-	return &Env{store: store, outer: nil}
+	env := &Env{store: store, outer: nil, state: newState(), module: &module{}}
+	env.module.env = env
+	env.state.root = env
+	defineAssertions(env)
+	return env
 }
 
 func (e *Env) Get(name string) (Object, bool) {
-	obj, ok := e.store[name]
-	if !ok && e.outer != nil {
-		obj, ok = e.outer.Get(name)
+	for env := e; env != nil; env = env.outer {
+		if obj, ok := env.store[name]; ok {
+			return obj, true
+		}
+		// a repeated parameter is bound to the last argument given for it
+		for i := len(env.frame) - 1; i >= 0; i-- {
+			if env.frame[i] == name && env.slots[i] != nil {
+				return env.slots[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// lookup returns the variable a resolver annotated identifier refers to. If
+// the slot hasn't been bound yet the name still refers to an outer variable,
+// so lookup falls back to searching by name from the frame that owns it.
+func (e *Env) lookup(ident *parser.Identifier) (Object, bool) {
+	env := e
+	for i := 0; i < ident.Depth && env != nil; i++ {
+		env = env.outer
+	}
+	if env == nil || ident.Index >= len(env.slots) || env.frame[ident.Index] != ident.Value {
+		return e.Get(ident.Value)
+	}
+	if obj := env.slots[ident.Index]; obj != nil {
+		return obj, true
 	}
-	return obj, ok
+	return env.Get(ident.Value)
 }
 
 func (e *Env) Set(name string, val Object) Object {
+	if e.store == nil {
+		e.store = make(map[string]Object)
+	}
 	e.store[name] = val
 	return val
 }
+
+// DefineNative binds a Go function to name so doma code can call it like any
+// other procedure. Arguments are evaluated before fn is called and their count
+// is checked against arity unless it is VARIADIC.
+func (e *Env) DefineNative(name string, arity int, fn NativeFunc) *Native {
+	native := &Native{Name: name, Arity: arity, Fn: fn}
+	e.Set(name, native)
+	return native
+}
+
+// SetLimits bounds every evaluation run in this environment and the
+// environments enclosed by it.
+func (e *Env) SetLimits(limits Limits) {
+	e.state.limits = limits
+}
+
+// SetOutput redirects display and printf, which write to os.Stdout by default.
+func (e *Env) SetOutput(w io.Writer) {
+	e.state.out = w
+}
+
+// Names lists every name bound in this environment or the ones enclosing it.
+func (e *Env) Names() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for env := e; env != nil; env = env.outer {
+		for name := range env.store {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		for i, name := range env.frame {
+			if !seen[name] && env.slots[i] != nil {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -8,7 +8,19 @@ import (
 	"strings"
 )
 
+// Eval evaluates expr in env. The Limits of env apply to each outermost
+// call, which resets the counts of steps, allocations and output.
 func Eval(expr parser.Expression, env *Env) Object {
+	if env.state.running {
+		return evalExpr(expr, env)
+	}
+	return env.Run(nil, func() Object { return evalExpr(expr, env) })
+}
+
+func evalExpr(expr parser.Expression, env *Env) Object {
+	if err := env.state.step(); err != nil {
+		return err
+	}
 	switch expr := expr.(type) {
 	case *parser.Number:
 		return &Number{Value: expr.Value}
@@ -32,12 +44,19 @@ func Eval(expr parser.Expression, env *Env) Object {
 		}
 		return last
 	case *parser.Identifier:
-		if ident, ok := env.Get(expr.Value); ok {
-			return ident
+		if expr.Local {
+			if obj, ok := env.lookup(expr); ok {
+				return obj
+			}
+		} else if obj, ok := env.Get(expr.Value); ok {
+			return obj
 		}
 		return newError("identifier not found: %s", expr.Value)
 	case *parser.Form:
 		obj := Eval(expr.First, env)
+		if isError(obj) {
+			return obj
+		}
 		switch obj := obj.(type) {
 		case *Builtin:
 			return applyBuiltin(obj, expr, env)
@@ -45,6 +64,8 @@ func Eval(expr parser.Expression, env *Env) Object {
 			return applyLambda(obj.Value, expr, env)
 		case *Lambda:
 			return applyLambda(obj, expr, env)
+		case *Native:
+			return applyNative(obj, expr, env)
 		default:
 			return newError("unknown procedure: %s", expr.First)
 		}
@@ -61,13 +82,23 @@ func evalList(expr *parser.List, env *Env) Object {
 		case *parser.BuiltinIdentifier:
 			args = append(args, &Symbol{Value: a.Value})
 		default:
-			args = append(args, Eval(a, env))
+			obj := Eval(a, env)
+			if isError(obj) {
+				return obj
+			}
+			args = append(args, obj)
 		}
 	}
+	if err := env.state.allocList(len(args)); err != nil {
+		return err
+	}
 	return &List{Args: args}
 }
 
 func applyBuiltin(ident *Builtin, expr *parser.Form, env *Env) Object {
+	if err := env.state.checkBuiltin(ident.Value); err != nil {
+		return err
+	}
 	switch ident.Value {
 	case lexer.PLUS,
 		lexer.MINUS,
@@ -103,6 +134,14 @@ func applyBuiltin(ident *Builtin, expr *parser.Form, env *Env) Object {
 		return evalListRef(expr, env)
 	case lexer.BEGIN:
 		return evalBegin(expr, env)
+	case lexer.MODULE:
+		return evalModule(expr, env)
+	case lexer.EXPORT:
+		return evalExport(expr, env)
+	case lexer.IMPORT, lexer.REQUIRE:
+		return evalImport(expr, env)
+	case lexer.DEFTEST:
+		return evalDeftest(expr, env)
 	default:
 		return newError("unknown identifier: %s", ident.Value)
 	}
@@ -112,6 +151,9 @@ func evalBegin(expr *parser.Form, env *Env) Object {
 	var last Object
 	for _, b := range expr.Rest {
 		last = Eval(b, env)
+		if isError(last) {
+			return last
+		}
 	}
 	return last
 }
@@ -126,7 +168,7 @@ func evalListRef(expr *parser.Form, env *Env) Object {
 	}
 	lst, ok := lstObj.(*List)
 	if !ok {
-		return newError("list-ref expects LIST as first arg, got %s", lstObj.Type())
+		return newError("list-ref expects LIST as first arg, got %s", typeOf(lstObj))
 	}
 	idxObj := Eval(expr.Rest[1], env)
 	if isError(idxObj) {
@@ -134,7 +176,10 @@ func evalListRef(expr *parser.Form, env *Env) Object {
 	}
 	idx, ok := idxObj.(*Number)
 	if !ok {
-		return newError("list-ref expects NUMBER as second arg, got %s", idxObj.Type())
+		return newError("list-ref expects NUMBER as second arg, got %s", typeOf(idxObj))
+	}
+	if idx.Value < 0 || idx.Value >= int64(len(lst.Args)) {
+		return newError("list-ref index %d out of range for list of length %d", idx.Value, len(lst.Args))
 	}
 	return lst.Args[idx.Value]
 }
@@ -153,7 +198,10 @@ func evalCons(expr *parser.Form, env *Env) Object {
 	}
 	lst, ok := lstObj.(*List)
 	if !ok {
-		return newError("cons expects LIST, got %s", lstObj.Type())
+		return newError("cons expects LIST, got %s", typeOf(lstObj))
+	}
+	if err := env.state.allocList(len(lst.Args) + 1); err != nil {
+		return err
 	}
 	lst.Args = append([]Object{obj}, lst.Args...)
 	return lst
@@ -169,7 +217,7 @@ func evalLen(expr *parser.Form, env *Env) Object {
 	}
 	lst, ok := obj.(*List)
 	if !ok {
-		return newError("len expects a list, received %s", obj.Type())
+		return newError("len expects a list, received %s", typeOf(obj))
 	}
 	return &Number{Value: int64(len(lst.Args))}
 }
@@ -184,7 +232,7 @@ func evalFirst(expr *parser.Form, env *Env) Object {
 	}
 	lst, ok := obj.(*List)
 	if !ok {
-		return newError("first expects a list, received %s", obj.Type())
+		return newError("first expects a list, received %s", typeOf(obj))
 	}
 	if len(lst.Args) == 0 {
 		return lst
@@ -202,9 +250,12 @@ func evalRest(expr *parser.Form, env *Env) Object {
 	}
 	lst, ok := obj.(*List)
 	if !ok {
-		return newError("first expects a list, received %s", obj.Type())
+		return newError("first expects a list, received %s", typeOf(obj))
+	}
+	if err := env.state.alloc(1); err != nil {
+		return err
 	}
-	if len(lst.Args) == 1 {
+	if len(lst.Args) <= 1 {
 		return &List{Args: make([]Object, 0)}
 	}
 	return &List{
@@ -221,15 +272,72 @@ func applyLambda(fn *Lambda, expr *parser.Form, env *Env) Object {
 		}
 		objs = append(objs, obj)
 	}
+	if err := env.state.enter(); err != nil {
+		return err
+	}
+	defer env.state.leave()
 	extendedEnv := extendFnEnv(fn, objs)
 	var last Object
 	for _, b := range fn.Body {
 		last = Eval(b, extendedEnv)
+		if isError(last) {
+			return last
+		}
 	}
 	return last
 }
 
+func applyNative(fn *Native, expr *parser.Form, env *Env) Object {
+	if fn.Form != nil {
+		return fn.Form(expr, env)
+	}
+	args := make([]Object, 0)
+	for _, arg := range expr.Rest {
+		obj := Eval(arg, env)
+		if isError(obj) {
+			return obj
+		}
+		if obj == nil {
+			obj = &Nil{}
+		}
+		args = append(args, obj)
+	}
+	return env.CallNative(fn, args)
+}
+
+// CallNative calls fn with arguments that have already been evaluated. A
+// list it returns counts against the Limits like one built by the script.
+func (e *Env) CallNative(fn *Native, args []Object) Object {
+	if fn.Arity != VARIADIC && len(args) != fn.Arity {
+		return newError("%s expects %d arguments, got %d", fn.Name, fn.Arity, len(args))
+	}
+	obj, err := fn.Fn(args)
+	if err != nil {
+		return &Error{Message: fmt.Sprintf("%s: %s", fn.Name, err), Err: err}
+	}
+	if lst, ok := obj.(*List); ok {
+		if err := e.state.allocList(len(lst.Args)); err != nil {
+			return err
+		}
+	}
+	if obj == nil {
+		return &Nil{}
+	}
+	return obj
+}
+
 func extendFnEnv(fn *Lambda, args []Object) *Env {
+	if fn.Frame != nil {
+		env := newFrameEnv(fn.Env, fn.Frame)
+		for idx := range fn.Params {
+			if idx < len(args) {
+				env.slots[idx] = args[idx]
+			} else {
+				env.slots[idx] = &Nil{}
+			}
+		}
+		return env
+	}
 	env := NewEnclosedEnv(fn.Env)
 	for idx, param := range fn.Params {
 		if idx < len(args) {
@@ -257,9 +365,13 @@ func evalLambda(expr *parser.Form, env *Env) Object {
 		}
 		params = append(params, ident)
 	}
+	if expr.Frame == nil {
+		resolveLambda(expr, nil)
+	}
 	return &Lambda{
 		Params: params,
 		Body:   expr.Rest[1:],
+		Frame:  expr.Frame,
 		Env:    env,
 	}
 }
@@ -276,15 +388,15 @@ func evalDefine(expr *parser.Form, env *Env) Object {
 	if isError(obj) {
 		return obj
 	}
-	lambda, ok := obj.(*Lambda)
-	if ok {
-		proc := &Procedure{Name: name.Value, Value: lambda}
-		env.Set(name.Value, proc)
-		return proc
+	if lambda, ok := obj.(*Lambda); ok {
+		obj = &Procedure{Name: name.Value, Value: lambda}
+	}
+	if name.Local && name.Depth == 0 && name.Index < len(env.slots) {
+		env.slots[name.Index] = obj
 	} else {
 		env.Set(name.Value, obj)
-		return obj
 	}
+	return obj
 }
 
 func evalComparison(ident *Builtin, expr *parser.Form, env *Env) Object {
@@ -299,8 +411,8 @@ func evalComparison(ident *Builtin, expr *parser.Form, env *Env) Object {
 	if isError(right) {
 		return right
 	}
-	if left.Type() != right.Type() {
-		return newError("type mismatch - %s and %s", left.Type(), right.Type())
+	if typeOf(left) != typeOf(right) {
+		return newError("type mismatch - %s and %s", typeOf(left), typeOf(right))
 	}
 	switch left.(type) {
 	case *Number:
@@ -308,7 +420,7 @@ func evalComparison(ident *Builtin, expr *parser.Form, env *Env) Object {
 	case *String:
 		return evalStringCmp(ident, left.(*String), right.(*String))
 	}
-	return newError("unsupported type %s", left.Type())
+	return newError("unsupported type %s", typeOf(left))
 }
 
 func evalStringCmp(op *Builtin, left *String, right *String) Object {
@@ -366,10 +478,12 @@ func evalDisplay(expr *parser.Form, env *Env) Object {
 		if isError(obj) {
 			return obj
 		}
-		str = append(str, obj.Inspect())
+		str = append(str, inspect(obj))
 	}
 	if len(str) > 0 {
-		fmt.Println(strings.Join(str, " "))
+		if err := env.state.write(strings.Join(str, " ") + "\n"); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -381,14 +495,16 @@ func evalPrintf(expr *parser.Form, env *Env) Object {
 		if isError(obj) {
 			return obj
 		}
-		str = append(str, obj.Inspect())
+		str = append(str, inspect(obj))
 	}
 	if len(str) > 0 {
 		s, err := strconv.Unquote("\"" + strings.Join(str, " ") + "\"")
 		if err != nil {
 			return newError("error from unquote: %v", err.Error())
 		}
-		fmt.Print(s)
+		if err := env.state.write(s); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -406,8 +522,8 @@ func evalEq(expr *parser.Form, env *Env) Object {
 	if isError(right) {
 		return right
 	}
-	if left.Type() != right.Type() {
-		return newError("type mismatch - %s and %s", left.Type(), right.Type())
+	if typeOf(left) != typeOf(right) {
+		return newError("type mismatch - %s and %s", typeOf(left), typeOf(right))
 	}
 	switch left := left.(type) {
 	case *Number:
@@ -417,7 +533,7 @@ func evalEq(expr *parser.Form, env *Env) Object {
 	case *Boolean:
 		return &Boolean{Value: left.Value == right.(*Boolean).Value}
 	default:
-		return newError("eq on invalid type %s", left.Type())
+		return newError("eq on invalid type %s", typeOf(left))
 	}
 }
 
@@ -428,8 +544,8 @@ func evalMath(op *Builtin, expr *parser.Form, env *Env) Object {
 		if isError(obj) {
 			return obj
 		}
-		if obj.Type() != NUMBER_OBJ {
-			return newError("type mismatch - expected number, got %s", obj.Type())
+		if typeOf(obj) != NUMBER_OBJ {
+			return newError("type mismatch - expected number, got %s", typeOf(obj))
 		}
 		objs = append(objs, obj.(*Number))
 	}
@@ -437,6 +553,9 @@ func evalMath(op *Builtin, expr *parser.Form, env *Env) Object {
 	if len(objs) == 0 {
 		return newError("no arguments")
 	}
+	if err := env.state.alloc(1); err != nil {
+		return err
+	}
 
 	val := objs[0].Value
 	for i := 1; i < len(objs); i++ {
@@ -449,6 +568,9 @@ func evalMath(op *Builtin, expr *parser.Form, env *Env) Object {
 		case lexer.ASTERISK:
 			val = val * obj.Value
 		case lexer.SLASH:
+			if obj.Value == 0 {
+				return newError("division by zero")
+			}
 			val = val / obj.Value
 		default:
 			return newError("unknown operator: %s", op.Value)
@@ -464,6 +586,22 @@ func isError(obj Object) bool {
 	return obj.Type() == ERROR_OBJ
 }
 
+// typeOf returns the type of obj, treating the nil of forms that produce no
+// value, such as display, as NIL.
+func typeOf(obj Object) ObjectType {
+	if obj == nil {
+		return NIL_OBJ
+	}
+	return obj.Type()
+}
+
+func inspect(obj Object) string {
+	if obj == nil {
+		return "nil"
+	}
+	return obj.Inspect()
+}
+
 func isTruthy(obj Object) bool {
 	if obj == nil || obj.Type() == NIL_OBJ {
 		return false
@@ -0,0 +1,310 @@
+package eval
+
+import (
+	"bytes"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parse(t testing.TB, src string) *parser.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("%q: parse errors: %v", src, p.Errors())
+	}
+	return program
+}
+
+func show(obj Object) string {
+	if obj == nil {
+		return "<none>"
+	}
+	return obj.Inspect()
+}
+
+// run evaluates src in a new interpreter and returns its output followed
+// by the final value.
+func run(t testing.TB, src string, opts ...Option) string {
+	t.Helper()
+	program := parse(t, src)
+	var out bytes.Buffer
+	env := NewInterpreter(append([]Option{WithOutput(&out)}, opts...)...).Env()
+	Resolve(program)
+	result := show(Eval(program, env))
+	return out.String() + result
+}
+
+type evalTest struct {
+	input string
+	want  string
+}
+
+// builtinTests has the cases for each special form. TestBuiltinCoverage
+// makes sure every documented one has some.
+var builtinTests = map[lexer.TokenType][]evalTest{
+	lexer.PLUS: {
+		{"(+ 1 2 3)", "6"},
+		{"(+ 5)", "5"},
+		{"(+)", "ERROR: no arguments"},
+		{`(+ 1 "a")`, "ERROR: type mismatch - expected number, got STRING"},
+	},
+	lexer.MINUS: {
+		{"(- 10 1 2)", "7"},
+		{"(- 3 -4)", "7"},
+	},
+	lexer.ASTERISK: {
+		{"(* 2 3 4)", "24"},
+	},
+	lexer.SLASH: {
+		{"(/ 20 2 5)", "2"},
+		{"(/ 7 2)", "3"},
+		{"(/ 1 0)", "ERROR: division by zero"},
+	},
+	lexer.EQ: {
+		{"(= 1 1)", "#t"},
+		{`(= "a" "b")`, "#f"},
+		{"(= #t #t)", "#t"},
+		{`(= 1 "a")`, "ERROR: type mismatch - NUMBER and STRING"},
+		{"(= '(1) '(1))", "ERROR: eq on invalid type LIST"},
+		{"(= 1)", "ERROR: eq expects 2 arguments, got 1"},
+	},
+	lexer.LT: {
+		{"(< 1 2)", "#t"},
+		{`(< "b" "a")`, "#f"},
+	},
+	lexer.LTE: {
+		{"(<= 2 2)", "#t"},
+	},
+	lexer.GT: {
+		{"(> 1 2)", "#f"},
+	},
+	lexer.GTE: {
+		{`(>= "b" "a")`, "#t"},
+	},
+	lexer.LAMBDA: {
+		{"((lambda '(x y) (+ x y)) 1 2)", "3"},
+		{"(define add (lambda '(x) (lambda '(y) (+ x y)))) ((add 1) 2)", "3"},
+		{"((lambda '(x) x))", "nil"},
+	},
+	lexer.IF: {
+		{"(if #t 1 2)", "1"},
+		{"(if #f 1 2)", "2"},
+		{"(if 0 1 2)", "1"},
+		{"(if #f 1)", "nil"},
+	},
+	lexer.DEFINE: {
+		{"(define x 5) x", "5"},
+		{"(define x 5) (define x 6) x", "6"},
+		{"y", "ERROR: identifier not found: y"},
+	},
+	lexer.DISPLAY: {
+		{`(display "a" 1 '(2 'b))`, "a 1 '(2 'b)\n<none>"},
+		{"(display (display) (list (begin)))", "nil '(nil)\n<none>"},
+		{"(+ 1 (display))", "ERROR: type mismatch - expected number, got NIL"},
+	},
+	lexer.PRINTF: {
+		{`(printf "a\tb\n")`, "a\tb\n<none>"},
+	},
+	lexer.FIRST: {
+		{"(first '(1 2))", "1"},
+		{"(first '())", "'()"},
+		{"(first 1)", "ERROR: first expects a list, received NUMBER"},
+	},
+	lexer.REST: {
+		{"(rest '(1 2 3))", "'(2 3)"},
+		{"(rest '(1))", "'()"},
+		{"(rest '())", "'()"},
+	},
+	lexer.LENGTH: {
+		{"(length '(1 2 3))", "3"},
+		{"(length '())", "0"},
+	},
+	lexer.CONS: {
+		{"(cons 1 '(2))", "'(1 2)"},
+		{"(cons 1 2)", "ERROR: cons expects LIST, got NUMBER"},
+	},
+	lexer.LIST_REF: {
+		{"(list-ref '(1 2 3) 1)", "2"},
+		{"(list-ref '(1) \"a\")", "ERROR: list-ref expects NUMBER as second arg, got STRING"},
+		{"(list-ref '(1 2) 2)", "ERROR: list-ref index 2 out of range for list of length 2"},
+		{"(list-ref '(1) -1)", "ERROR: list-ref index -1 out of range for list of length 1"},
+	},
+	lexer.BEGIN: {
+		{"(begin 1 2 3)", "3"},
+		{`(begin (display "a") (+ 1 "b") (display "c"))`, "a\nERROR: type mismatch - expected number, got STRING"},
+	},
+	lexer.MODULE: {
+		{"((lambda '() (module m)))", "ERROR: module is only allowed at the top level of a file"},
+		{"(module m) (module n)", "ERROR: module n is already declared as m"},
+	},
+	lexer.EXPORT: {
+		{"((lambda '() (export x)))", "ERROR: export is only allowed at the top level of a file"},
+	},
+	lexer.DEFTEST: {
+		{"(deftest a (+ 1 2))", "nil"},
+		{"(deftest a) (deftest a)", "ERROR: deftest: test a is already defined"},
+		{"(deftest 1)", "ERROR: deftest expects first argument to be identifier or string, got 1"},
+	},
+}
+
+func TestBuiltins(t *testing.T) {
+	for typ, tests := range builtinTests {
+		for _, tt := range tests {
+			if got := run(t, tt.input); got != tt.want {
+				t.Errorf("%s: %s: got %q, want %q", typ, tt.input, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	tests := []evalTest{
+		{"(assert-equal (list 1 (list 2)) (list 1 (list 2)))", "#t"},
+		{`(assert-equal 1 2 "numbers")`, "ERROR: assert-equal failed at 1:1: expected 1, got 2: numbers"},
+		{"(assert-true (< 1 2))", "#t"},
+		{"(assert-true (> 1 2))", "ERROR: assert-true failed at 1:1: (> 1 2) is #f"},
+		{`(assert-error (+ 1 "a") "mismatch")`, "type mismatch - expected number, got STRING"},
+		{"(assert-error 1)", "ERROR: assert-error failed at 1:1: expected an error from 1, got 1"},
+		{"(assert-error (assert-true #f))", "ERROR: assert-true failed at 1:15: #f is #f"},
+		{`(assert-error (assert-error (+ 1 "a") "other"))`, "ERROR: assert-error failed at 1:15: expected an error containing \"other\", got \"type mismatch - expected number, got STRING\""},
+		{"(define assert-true 1) assert-true", "1"},
+		{"((lambda '(assert-error) (assert-error)) (lambda '() 2))", "2"},
+		{"(assert-equal 1)", "ERROR: assert-equal expects 2 or 3 arguments, got 1"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.input); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+// TestHeadForms checks that the names of forms recognised at the head of a
+// form can still be used as variables.
+func TestHeadForms(t *testing.T) {
+	tests := []evalTest{
+		{"(define import 1) import", "1"},
+		{"(define require 2) (+ require 1)", "3"},
+		{"((lambda '(export deftest) (+ export deftest)) 1 2)", "3"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.input); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestBuiltinCoverage(t *testing.T) {
+	for typ := range builtinDocs {
+		if typ == lexer.IMPORT || typ == lexer.REQUIRE {
+			continue // TestModules
+		}
+		if len(builtinTests[typ]) == 0 {
+			t.Errorf("no tests for %s", typ)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	tests := []evalTest{
+		{"", "<none>"},
+		{"42", "42"},
+		{`"s"`, "s"},
+		{"true #f", "#f"},
+		{"'sym", "'sym"},
+		{"'(1 \"a\" (+ 1 2))", "'(1 a 3)"},
+		{"(list 1 (list 2))", "'(1 '(2))"},
+		{"(lambda '(x) x)", "#<procedure>"},
+		{"+", "#<procedure:PLUS>"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.input); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestNatives(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "pwned"), filepath.Join(dir, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		evalTest
+		opts []Option
+	}{
+		{evalTest{"(read-line)", "hello"}, []Option{WithInput(strings.NewReader("hello\nworld\n"))}},
+		{evalTest{"(command-line-arguments)", "'(a b)"}, []Option{WithArgs([]string{"a", "b"})}},
+		{evalTest{`(write-file "f.txt" "data") (read-file "f.txt")`, "data"}, []Option{WithFSRoot(dir)}},
+		{evalTest{`(file-exists "missing.txt")`, "#f"}, []Option{WithFSRoot(dir)}},
+		{evalTest{`(read-file "out/x")`, "ERROR: read-file: out/x is outside of the sandbox"}, []Option{WithFSRoot(dir)}},
+		{evalTest{`(write-file "evil" "data")`, "ERROR: write-file: evil is a symlink to a missing file"}, []Option{WithFSRoot(dir)}},
+		{evalTest{`(write-file "./evil/../evil" "data")`, "ERROR: write-file: ./evil/../evil is a symlink to a missing file"}, []Option{WithFSRoot(dir)}},
+		{evalTest{`(setenv "DOMA_TEST_VAR" "v") (getenv "DOMA_TEST_VAR")`, "v"}, nil},
+		{evalTest{`(getenv "DOMA_TEST_UNSET")`, "nil"}, nil},
+		{evalTest{"(getenv 1)", "ERROR: getenv: expects STRING name, got NUMBER"}, nil},
+		{evalTest{`(setenv "DOMA_TEST_VAR" 1)`, "ERROR: setenv: expects STRING value, got NUMBER"}, nil},
+		{evalTest{"(command-line-arguments)", "'()"}, nil},
+		{evalTest{"(exit)", "ERROR: exit: exit status 0"}, nil},
+		{evalTest{`(display "a") (exit 3) (display "b")`, "a\nERROR: exit: exit status 3"}, nil},
+		{evalTest{`(exit "1")`, "ERROR: exit: expects NUMBER status, got STRING"}, nil},
+		{evalTest{"(exit 1 2)", "ERROR: exit: expects at most 1 argument, got 2"}, nil},
+		{evalTest{"(assert-error (exit 1))", "ERROR: exit: exit status 1"}, nil},
+		{evalTest{`(read-file "f.txt")`, "ERROR: identifier not found: read-file"}, []Option{WithCapabilities(CapIO)}},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.input, tt.opts...); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+	os.Unsetenv("DOMA_TEST_VAR")
+	if _, err := os.Lstat(filepath.Join(outside, "pwned")); !os.IsNotExist(err) {
+		t.Errorf("write-file escaped the sandbox through a dangling symlink")
+	}
+}
+
+func TestModules(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"lib.doma":            "(module lib (export double))\n(define double (lambda '(x) (* 2 x)))\n(define hidden 1)\n",
+		"plain.doma":          "(define one 1)\n",
+		"a.doma":              "(import \"b.doma\")\n",
+		"b.doma":              "(import \"a.doma\")\n",
+		"libs/util/util.doma": "(define twice (lambda '(f x) (f (f x))))\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	main := filepath.Join(dir, "main.doma")
+	a, b := filepath.Join(dir, "a.doma"), filepath.Join(dir, "b.doma")
+	opts := []Option{WithScriptPath(main), WithModulePath(filepath.Join(dir, "libs"))}
+	tests := []evalTest{
+		{`(import "lib.doma") (lib/double 4)`, "8"},
+		{`(import "lib.doma" as l) (l/double 4)`, "8"},
+		{`(import "lib.doma" '((double dbl))) (dbl 4)`, "8"},
+		{`(import "lib.doma" '(hidden))`, "ERROR: module lib does not export hidden"},
+		{`(import "plain.doma" '(one)) one`, "1"},
+		{`(require util) (util/twice (lambda '(x) (* x 3)) 1)`, "9"},
+		{`(import "a.doma")`, "ERROR: " + a + ": " + b + ": import cycle: " + strings.Join([]string{a, b, a}, " -> ")},
+		{`(import "missing.doma")`, "ERROR: module not found: missing.doma"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.input, opts...); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
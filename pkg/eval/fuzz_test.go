@@ -0,0 +1,46 @@
+package eval
+
+import (
+	"context"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FuzzEval evaluates programs with limits and a timeout, which have to stop
+// them without a panic.
+func FuzzEval(f *testing.F) {
+	examples, _ := filepath.Glob("../../examples/*.doma")
+	for _, file := range examples {
+		if src, err := os.ReadFile(file); err == nil {
+			f.Add(string(src))
+		}
+	}
+	for _, seed := range []string{"(list-ref '(1 2) 1)", "(rest '(1))", "(/ 4 2)", "(define f (lambda '(n) (f n))) (f 1)", "(display (if #f 1))"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		p := parser.New(lexer.New(src))
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			return
+		}
+		env := NewInterpreter(
+			WithCapabilities(CapIO),
+			WithOutput(io.Discard),
+			WithInput(strings.NewReader("")),
+			WithLimits(Limits{MaxSteps: 100000, MaxDepth: 200, MaxAllocs: 10000, MaxListLen: 1000, MaxOutput: 1 << 16}),
+		).Env()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		Resolve(program)
+		if obj := EvalContext(ctx, program, env); obj != nil {
+			obj.Inspect()
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package eval
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the .out files of the examples")
+
+// TestExamples runs every script in examples like doma run does and
+// compares what it prints with the .out file next to it.
+func TestExamples(t *testing.T) {
+	files := make([]string, 0)
+	err := filepath.WalkDir("../../examples", func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Ext(path) == ".doma" {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no examples found")
+	}
+	for _, file := range files {
+		name, _ := filepath.Rel("../../examples", file)
+		t.Run(filepath.ToSlash(name), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			program := parse(t, string(src))
+			var out bytes.Buffer
+			env := NewInterpreter(WithOutput(&out), WithScriptPath(file)).Env()
+			Resolve(program)
+			obj := Eval(program, env)
+			if errObj, ok := obj.(*Error); ok {
+				t.Fatalf("error: %s", errObj.Message)
+			}
+			if obj != nil && obj.Type() != NIL_OBJ {
+				out.WriteString(obj.Inspect() + "\n")
+			}
+
+			golden := strings.TrimSuffix(file, ".doma") + ".out"
+			if *update {
+				if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if got := out.String(); got != string(want) {
+				t.Errorf("output differs from %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
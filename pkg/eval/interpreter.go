@@ -0,0 +1,136 @@
+package eval
+
+import (
+	"context"
+	"doma/pkg/parser"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Interpreter bundles a global environment with the options embedders use
+// to run untrusted or long running scripts. Unless WithCapabilities is given
+// every builtin group is available.
+type Interpreter struct {
+	env  *Env
+	caps []Capability
+}
+
+type Option func(*Interpreter)
+
+func WithLimits(limits Limits) Option {
+	return func(i *Interpreter) {
+		i.env.SetLimits(limits)
+	}
+}
+
+func WithOutput(w io.Writer) Option {
+	return func(i *Interpreter) {
+		i.env.SetOutput(w)
+	}
+}
+
+func WithInput(r io.Reader) Option {
+	return func(i *Interpreter) {
+		i.env.state.in = r
+		i.env.state.reader = nil
+	}
+}
+
+// WithArgs sets the list returned by command-line-arguments.
+func WithArgs(args []string) Option {
+	return func(i *Interpreter) {
+		i.env.state.args = args
+	}
+}
+
+// WithCapabilities restricts scripts to the given builtin groups. Builtins
+// outside of them are either not defined or fail when called.
+func WithCapabilities(caps ...Capability) Option {
+	return func(i *Interpreter) {
+		i.caps = append([]Capability{CapPure}, caps...)
+	}
+}
+
+// WithFSRoot confines the fs builtins to dir. Script paths are resolved
+// relative to it and may not escape it.
+func WithFSRoot(dir string) Option {
+	return func(i *Interpreter) {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		i.env.state.fsRoot = dir
+	}
+}
+
+// WithScriptPath names the file the code run by the interpreter comes from,
+// which paths given to import are relative to. Without it they are relative
+// to the working directory.
+func WithScriptPath(file string) Option {
+	return func(i *Interpreter) {
+		i.env.module.file = file
+	}
+}
+
+// WithModulePath sets the directories searched for modules that aren't found
+// relative to the importing file. It defaults to the list in $DOMA_PATH.
+func WithModulePath(dirs ...string) Option {
+	return func(i *Interpreter) {
+		i.env.state.modulePath = dirs
+	}
+}
+
+// WithVendorDir sets the directory holding the packages vendored by doma get,
+// which is searched for modules before the module path.
+func WithVendorDir(dir string) Option {
+	return func(i *Interpreter) {
+		i.env.state.vendor = dir
+	}
+}
+
+func NewInterpreter(opts ...Option) *Interpreter {
+	i := &Interpreter{env: NewEnv(), caps: AllCapabilities}
+	if list := os.Getenv("DOMA_PATH"); list != "" {
+		i.env.state.modulePath = filepath.SplitList(list)
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	if root := i.env.module; root.file != "" {
+		// importing the script from one of its modules is a cycle
+		if host, err := i.env.state.resolvePath(&String{Value: root.file}); err == nil {
+			if key, err := filepath.Abs(host); err == nil {
+				i.env.state.modules = map[string]*module{key: root}
+				i.env.state.loading = []*module{root}
+			}
+		}
+	}
+	i.env.state.caps = make(map[Capability]bool)
+	for _, c := range i.caps {
+		i.env.state.caps[c] = true
+		if define, ok := stdlib[c]; ok {
+			define(i.env)
+		}
+	}
+	return i
+}
+
+func (i *Interpreter) Env() *Env {
+	return i.env
+}
+
+// Capabilities reports the builtin groups granted to scripts.
+func (i *Interpreter) Capabilities() []Capability {
+	caps := make([]Capability, 0, len(i.caps))
+	for _, c := range AllCapabilities {
+		if i.env.state.caps[c] {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+func (i *Interpreter) Eval(ctx context.Context, expr parser.Expression) Object {
+	Resolve(expr)
+	return EvalContext(ctx, expr, i.env)
+}
@@ -0,0 +1,215 @@
+package eval
+
+import (
+	"bufio"
+	"context"
+	"doma/pkg/parser"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	ErrCanceled    = errors.New("evaluation canceled")
+	ErrStepLimit   = errors.New("step limit exceeded")
+	ErrDepthLimit  = errors.New("recursion depth limit exceeded")
+	ErrAllocLimit  = errors.New("allocation limit exceeded")
+	ErrListLimit   = errors.New("list size limit exceeded")
+	ErrOutputLimit = errors.New("output limit exceeded")
+	ErrReadLimit   = errors.New("read limit exceeded")
+)
+
+// Limits bounds the resources a single evaluation may use. MaxRead counts
+// the bytes natives such as read-file and http-get return. A zero value
+// for any field means no limit, except for MaxDepth, where it means
+// DefaultMaxDepth. A negative MaxDepth removes the cap on recursion, which
+// lets deep recursion overflow the Go stack and crash the process.
+type Limits struct {
+	MaxSteps   int
+	MaxDepth   int
+	MaxAllocs  int
+	MaxListLen int
+	MaxOutput  int
+	MaxRead    int
+}
+
+// how many steps to take between polls of the context
+const ctxCheckInterval = 256
+
+// DefaultMaxDepth caps the depth of procedure calls when Limits doesn't,
+// well below the depth at which the Go stack overflows, which can't be
+// recovered from.
+const DefaultMaxDepth = 10000
+
+type state struct {
+	ctx    context.Context
+	limits Limits
+	out    io.Writer
+	in     io.Reader
+	reader *bufio.Reader
+	caps   map[Capability]bool
+	fsRoot string
+	args   []string
+
+	// root is the environment scripts run in. Modules see its natives.
+	root       *Env
+	prelude    *Env
+	vendor     string
+	modulePath []string
+	// modules caches the modules loaded so far by their absolute path and
+	// loading holds the ones being evaluated, innermost last.
+	modules map[string]*module
+	loading []*module
+	tests   []*Test
+
+	// running is set during an outermost call to Eval
+	running bool
+	steps   int
+	depth   int
+	allocs  int
+	output  int
+	read    int
+}
+
+func newState() *state {
+	return &state{out: os.Stdout, in: os.Stdin}
+}
+
+// EvalContext evaluates expr like Eval, but stops with an error once ctx is
+// done or one of the environment's Limits is exceeded.
+func EvalContext(ctx context.Context, expr parser.Expression, env *Env) Object {
+	return env.Run(ctx, func() Object { return evalExpr(expr, env) })
+}
+
+// Run calls fn as an evaluation in e. Unless an evaluation is already
+// running, the counts behind Limits start from zero, and a non-nil ctx stops
+// it like EvalContext does. Other evaluators, like the bytecode VM, charge
+// their work through Step, Enter, Leave, AllocList and Write from within fn.
+func (e *Env) Run(ctx context.Context, fn func() Object) Object {
+	st := e.state
+	if ctx != nil {
+		prev := st.ctx
+		st.ctx = ctx
+		defer func() { st.ctx = prev }()
+	}
+	if st.running {
+		return fn()
+	}
+	st.running = true
+	// a call left unbalanced by an embedder mustn't count against this one
+	st.steps, st.depth, st.allocs, st.output, st.read = 0, 0, 0, 0, 0
+	defer func() { st.running = false }()
+	return fn()
+}
+
+// Step counts a step of evaluation and reports an error once there were too
+// many or the context of the evaluation is done.
+func (e *Env) Step() *Error {
+	return e.state.step()
+}
+
+// Enter counts a procedure call and reports an error if calls nest too
+// deeply. Each successful Enter must be followed by a Leave.
+func (e *Env) Enter() *Error {
+	return e.state.enter()
+}
+
+// Leave ends a call counted by Enter.
+func (e *Env) Leave() {
+	e.state.leave()
+}
+
+// AllocList counts a new list of n elements.
+func (e *Env) AllocList(n int) *Error {
+	return e.state.allocList(n)
+}
+
+// Write prints str to the output of the environment, counting it against
+// MaxOutput.
+func (e *Env) Write(str string) *Error {
+	return e.state.write(str)
+}
+
+func (s *state) step() *Error {
+	s.steps++
+	if s.limits.MaxSteps > 0 && s.steps > s.limits.MaxSteps {
+		return limitError(ErrStepLimit, "%d steps", s.limits.MaxSteps)
+	}
+	if s.ctx != nil && s.steps%ctxCheckInterval == 0 {
+		if err := s.ctx.Err(); err != nil {
+			return &Error{Message: fmt.Sprintf("%s: %s", ErrCanceled, err), Err: fmt.Errorf("%w: %w", ErrCanceled, err)}
+		}
+	}
+	return nil
+}
+
+func (s *state) enter() *Error {
+	s.depth++
+	max := s.limits.MaxDepth
+	if max == 0 {
+		max = DefaultMaxDepth
+	}
+	if max > 0 && s.depth > max {
+		s.depth--
+		return limitError(ErrDepthLimit, "%d calls", max)
+	}
+	return nil
+}
+
+func (s *state) leave() {
+	s.depth--
+}
+
+func (s *state) alloc(n int) *Error {
+	s.allocs += n
+	if s.limits.MaxAllocs > 0 && s.allocs > s.limits.MaxAllocs {
+		return limitError(ErrAllocLimit, "%d objects", s.limits.MaxAllocs)
+	}
+	return nil
+}
+
+func (s *state) allocList(n int) *Error {
+	if s.limits.MaxListLen > 0 && n > s.limits.MaxListLen {
+		return limitError(ErrListLimit, "%d elements", s.limits.MaxListLen)
+	}
+	return s.alloc(n + 1)
+}
+
+func (s *state) write(str string) *Error {
+	s.output += len(str)
+	if s.limits.MaxOutput > 0 && s.output > s.limits.MaxOutput {
+		return limitError(ErrOutputLimit, "%d bytes", s.limits.MaxOutput)
+	}
+	if _, err := io.WriteString(s.out, str); err != nil {
+		return newError("write error: %s", err)
+	}
+	return nil
+}
+
+// readAll reads r to the end, failing once the evaluation has read more than
+// MaxRead bytes.
+func (s *state) readAll(r io.Reader) (string, error) {
+	if s.limits.MaxRead > 0 {
+		r = io.LimitReader(r, int64(s.limits.MaxRead-s.read)+1)
+	}
+	data, err := io.ReadAll(r)
+	if err := s.charge(len(data)); err != nil {
+		return "", err
+	}
+	return string(data), err
+}
+
+// charge counts n bytes read and returns an error wrapping ErrReadLimit once
+// there were too many.
+func (s *state) charge(n int) error {
+	s.read += n
+	if s.limits.MaxRead > 0 && s.read > s.limits.MaxRead {
+		return fmt.Errorf("%w (%d bytes)", ErrReadLimit, s.limits.MaxRead)
+	}
+	return nil
+}
+
+func limitError(err error, format string, a ...interface{}) *Error {
+	return &Error{Message: fmt.Sprintf("%s (%s)", err, fmt.Sprintf(format, a...)), Err: err}
+}
@@ -0,0 +1,91 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultDepthLimit(t *testing.T) {
+	program := parse(t, "(define loop (lambda '() (loop))) (loop)")
+	Resolve(program)
+	env := NewInterpreter().Env()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	errObj, ok := EvalContext(ctx, program, env).(*Error)
+	if !ok || !errors.Is(errObj.Err, ErrDepthLimit) {
+		t.Fatalf("got %v, want a depth limit error", errObj)
+	}
+	if env.state.depth != 0 {
+		t.Errorf("depth is %d after the evaluation", env.state.depth)
+	}
+	if got := run(t, "(define count (lambda '(n) (if (= n 0) 0 (+ 1 (count (- n 1)))))) (count 5000)"); got != "5000" {
+		t.Errorf("recursing 5000 calls deep gives %s", got)
+	}
+}
+
+func TestLimitsPerEval(t *testing.T) {
+	env := NewInterpreter(WithLimits(Limits{MaxSteps: 50})).Env()
+	program := parse(t, "(+ 1 2 3 4 5 6 7 8 9 10)")
+	for i := 0; i < 10; i++ {
+		if obj := Eval(program, env); isError(obj) {
+			t.Fatalf("evaluation %d: %s", i, obj.Inspect())
+		}
+	}
+	loop := parse(t, "(define loop (lambda '() (loop))) (loop)")
+	Resolve(loop)
+	if obj := Eval(loop, env); !isError(obj) || !errors.Is(obj.(*Error).Err, ErrStepLimit) {
+		t.Errorf("got %v, want a step limit error", obj)
+	}
+}
+
+func TestNativeLimits(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "big.txt"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "0123456789")
+	}))
+	defer server.Close()
+	input := func() Option { return WithInput(strings.NewReader("hello\nworld\n")) }
+	tests := []struct {
+		evalTest
+		opts []Option
+	}{
+		{evalTest{`(read-file "big.txt")`, "0123456789"}, []Option{WithFSRoot(dir), WithLimits(Limits{MaxRead: 10})}},
+		{evalTest{`(read-file "big.txt")`, "ERROR: read-file: read limit exceeded (5 bytes)"}, []Option{WithFSRoot(dir), WithLimits(Limits{MaxRead: 5})}},
+		{evalTest{"(read-line)", "ERROR: read-line: read limit exceeded (3 bytes)"}, []Option{input(), WithLimits(Limits{MaxRead: 3})}},
+		{evalTest{"(read-line) (read-line)", "ERROR: read-line: read limit exceeded (8 bytes)"}, []Option{input(), WithLimits(Limits{MaxRead: 8})}},
+		{evalTest{`(run-command "echo" "hello")`, "ERROR: run-command: read limit exceeded (3 bytes)"}, []Option{WithLimits(Limits{MaxRead: 3})}},
+		{evalTest{`(http-get "` + server.URL + `")`, "ERROR: http-get: read limit exceeded (4 bytes)"}, []Option{WithLimits(Limits{MaxRead: 4})}},
+		{evalTest{`(assert-error (read-line))`, "ERROR: read-line: read limit exceeded (3 bytes)"}, []Option{input(), WithLimits(Limits{MaxRead: 3})}},
+		{evalTest{"(command-line-arguments)", "ERROR: list size limit exceeded (1 elements)"}, []Option{WithArgs([]string{"a", "b"}), WithLimits(Limits{MaxListLen: 1})}},
+		{evalTest{`(list-directory ".")`, "ERROR: allocation limit exceeded (1 objects)"}, []Option{WithFSRoot(dir), WithLimits(Limits{MaxAllocs: 1})}},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.input, tt.opts...); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRunResetsDepth(t *testing.T) {
+	env := NewInterpreter(WithLimits(Limits{MaxDepth: 2})).Env()
+	// an embedder that returns without leaving the calls it entered
+	env.Run(nil, func() Object {
+		env.Enter()
+		env.Enter()
+		return nil
+	})
+	if got := show(Eval(parse(t, "((lambda '() 1))"), env)); got != "1" {
+		t.Errorf("got %s after unbalanced calls", got)
+	}
+}
@@ -0,0 +1,319 @@
+package eval
+
+import (
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// module is a file of doma code evaluated in an environment of its own. The
+// script being run is the root module.
+type module struct {
+	name string
+	// file is the path the module was loaded from as scripts see it, empty
+	// for code that doesn't come from a file.
+	file    string
+	exports []string
+	// declared is set once a module form has named the module.
+	declared bool
+	// done is set once the module has been evaluated.
+	done bool
+	env  *Env
+}
+
+// dir returns the directory the paths imported by m are relative to.
+func (m *module) dir() string {
+	if m.file == "" {
+		return "."
+	}
+	return path.Dir(filepath.ToSlash(m.file))
+}
+
+// topModule returns the module env is the top level environment of, or an
+// error naming the form that needs one.
+func topModule(expr *parser.Form, env *Env) (*module, *Error) {
+	if env.module == nil {
+		return nil, newError("%s is only allowed at the top level of a file", expr.First)
+	}
+	return env.module, nil
+}
+
+func evalModule(expr *parser.Form, env *Env) Object {
+	m, err := topModule(expr, env)
+	if err != nil {
+		return err
+	}
+	if len(expr.Rest) == 0 {
+		return newError("module expects a name")
+	}
+	name, ok := expr.Rest[0].(*parser.Identifier)
+	if !ok {
+		return newError("module expects first argument to be identifier, got %s", expr.Rest[0].TokenLiteral())
+	}
+	if m.declared {
+		return newError("module %s is already declared as %s", name.Value, m.name)
+	}
+	m.name, m.declared = name.Value, true
+	for _, arg := range expr.Rest[1:] {
+		form, ok := arg.(*parser.Form)
+		if !ok || !isBuiltin(form.First, lexer.EXPORT) {
+			return newError("module expects export forms, got %s", arg.TokenLiteral())
+		}
+		if err := evalExport(form, env); isError(err) {
+			return err
+		}
+	}
+	return &Nil{}
+}
+
+func evalExport(expr *parser.Form, env *Env) Object {
+	m, err := topModule(expr, env)
+	if err != nil {
+		return err
+	}
+	for _, arg := range expr.Rest {
+		name, ok := arg.(*parser.Identifier)
+		if !ok {
+			return newError("export expects identifiers, got %s", arg.TokenLiteral())
+		}
+		m.exports = append(m.exports, name.Value)
+	}
+	return &Nil{}
+}
+
+// importSpec is what an import or require form asks for.
+type importSpec struct {
+	path  string
+	alias string
+	// names are the exports to bind without a prefix, under their new names.
+	names   []string
+	renames []string
+}
+
+// parseImport reads (import "path" [as alias] ['(name (name new) ...)]), or
+// (require lib/name ...) where the path is the name with .doma added and the
+// prefix defaults to its last segment.
+func parseImport(expr *parser.Form) (*importSpec, *Error) {
+	op := strings.ToLower(expr.First.TokenLiteral())
+	if len(expr.Rest) == 0 {
+		return nil, newError("%s expects a module", op)
+	}
+	spec := &importSpec{}
+	switch arg := expr.Rest[0].(type) {
+	case *parser.String:
+		if isBuiltin(expr.First, lexer.REQUIRE) {
+			return nil, newError("require expects a module name, got %q", arg.Value)
+		}
+		spec.path = arg.Value
+	case *parser.Identifier:
+		if isBuiltin(expr.First, lexer.IMPORT) {
+			return nil, newError("import expects a path, got %s", arg.Value)
+		}
+		spec.path = arg.Value + ".doma"
+		spec.alias = path.Base(arg.Value)
+	default:
+		return nil, newError("%s expects a module, got %s", op, expr.Rest[0].TokenLiteral())
+	}
+	rest := expr.Rest[1:]
+	if len(rest) >= 2 {
+		if as, ok := rest[0].(*parser.Identifier); ok && as.Value == "as" {
+			alias, ok := rest[1].(*parser.Identifier)
+			if !ok {
+				return nil, newError("%s expects an alias after as, got %s", op, rest[1].TokenLiteral())
+			}
+			spec.alias = alias.Value
+			rest = rest[2:]
+		}
+	}
+	if len(rest) == 0 {
+		return spec, nil
+	}
+	names, ok := rest[0].(*parser.List)
+	if !ok || len(rest) > 1 {
+		return nil, newError("%s expects a list of names, got %s", op, rest[0].TokenLiteral())
+	}
+	for _, arg := range names.Args {
+		name, rename, ok := importName(arg)
+		if !ok {
+			return nil, newError("%s expects a name or (name new-name), got %s", op, arg.TokenLiteral())
+		}
+		spec.names = append(spec.names, name)
+		spec.renames = append(spec.renames, rename)
+	}
+	return spec, nil
+}
+
+func importName(expr parser.Expression) (string, string, bool) {
+	switch expr := expr.(type) {
+	case *parser.Identifier:
+		return expr.Value, expr.Value, true
+	case *parser.Form:
+		name, ok := expr.First.(*parser.Identifier)
+		if !ok || len(expr.Rest) != 1 {
+			return "", "", false
+		}
+		rename, ok := expr.Rest[0].(*parser.Identifier)
+		if !ok {
+			return "", "", false
+		}
+		return name.Value, rename.Value, true
+	}
+	return "", "", false
+}
+
+func evalImport(expr *parser.Form, env *Env) Object {
+	m, err := topModule(expr, env)
+	if err != nil {
+		return err
+	}
+	spec, err := parseImport(expr)
+	if err != nil {
+		return err
+	}
+	lib, err := env.state.load(m, spec.path)
+	if err != nil {
+		return err
+	}
+	exported := make(map[string]Object, len(lib.exports))
+	for _, name := range lib.exports {
+		exported[name] = lib.env.store[name]
+	}
+	for i, name := range spec.names {
+		if _, ok := exported[name]; !ok {
+			return newError("module %s does not export %s", lib.name, name)
+		}
+		env.Set(spec.renames[i], exported[name])
+	}
+	prefix := spec.alias
+	if prefix == "" {
+		prefix = lib.name
+	}
+	for name, obj := range exported {
+		env.Set(prefix+"/"+name, obj)
+	}
+	return &Nil{}
+}
+
+// load evaluates the module at file, as imported by from, unless it has
+// been loaded already.
+func (s *state) load(from *module, file string) (*module, *Error) {
+	name, host, ok := s.findModule(from, file)
+	if !ok {
+		return nil, newError("module not found: %s", file)
+	}
+	key, absErr := filepath.Abs(host)
+	if absErr != nil {
+		key = host
+	}
+	if m, ok := s.modules[key]; ok {
+		if !m.done {
+			return nil, s.cycle(m)
+		}
+		return m, nil
+	}
+	source, readErr := os.ReadFile(host)
+	if readErr != nil {
+		err := s.pathError(readErr)
+		return nil, &Error{Message: err.Error(), Err: err}
+	}
+	p := parser.New(lexer.New(string(source)))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return nil, newError("%s: %s", name, errs[0])
+	}
+
+	m := &module{name: strings.TrimSuffix(path.Base(name), path.Ext(name)), file: name}
+	m.env = &Env{outer: s.preludeEnv(), state: s, module: m}
+	if s.modules == nil {
+		s.modules = make(map[string]*module)
+	}
+	s.modules[key] = m
+	s.loading = append(s.loading, m)
+	Resolve(program)
+	obj := Eval(program, m.env)
+	s.loading = s.loading[:len(s.loading)-1]
+	if errObj, ok := obj.(*Error); ok {
+		delete(s.modules, key)
+		return nil, &Error{Message: fmt.Sprintf("%s: %s", name, errObj.Message), Err: errObj.Err}
+	}
+	if !m.declared {
+		for name := range m.env.store {
+			m.exports = append(m.exports, name)
+		}
+		sort.Strings(m.exports)
+	}
+	for _, export := range m.exports {
+		if _, ok := m.env.store[export]; !ok {
+			delete(s.modules, key)
+			return nil, newError("%s: module %s exports undefined name %s", name, m.name, export)
+		}
+	}
+	m.done = true
+	return m, nil
+}
+
+// findModule looks for file relative to the directory of from, then in the
+// vendor directory and each directory of the module path. A package, which
+// is a directory holding a file of the same name, can be imported as if it
+// were that file. It returns the path as scripts see it and the path on the
+// host.
+func (s *state) findModule(from *module, file string) (string, string, bool) {
+	dirs := []string{""}
+	if !path.IsAbs(file) {
+		dirs = []string{from.dir()}
+		if s.vendor != "" {
+			dirs = append(dirs, s.vendor)
+		}
+		dirs = append(dirs, s.modulePath...)
+	}
+	candidates := make([]string, 0, 2*len(dirs))
+	for _, dir := range dirs {
+		name := path.Join(filepath.ToSlash(dir), file)
+		candidates = append(candidates, name)
+		if ext := path.Ext(name); ext != "" {
+			candidates = append(candidates, path.Join(strings.TrimSuffix(name, ext), path.Base(name)))
+		}
+	}
+	for _, name := range candidates {
+		host, err := s.resolvePath(&String{Value: name})
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(host); err == nil && !info.IsDir() {
+			return name, host, true
+		}
+	}
+	return "", "", false
+}
+
+// cycle reports the chain of imports that leads back to m.
+func (s *state) cycle(m *module) *Error {
+	names := make([]string, 0)
+	for i := len(s.loading) - 1; i >= 0; i-- {
+		names = append([]string{s.loading[i].file}, names...)
+		if s.loading[i] == m {
+			break
+		}
+	}
+	names = append(names, m.file)
+	return newError("import cycle: %s", strings.Join(names, " -> "))
+}
+
+// preludeEnv returns the environment modules are evaluated in, which holds
+// the natives of the root environment but none of its definitions.
+func (s *state) preludeEnv() *Env {
+	if s.prelude == nil {
+		s.prelude = &Env{store: make(map[string]Object), state: s}
+		for name, obj := range s.root.store {
+			if native, ok := obj.(*Native); ok {
+				s.prelude.store[name] = native
+			}
+		}
+	}
+	return s.prelude
+}
@@ -19,6 +19,7 @@ const (
 	LAMBDA_OBJ    = "LAMBDA"
 	BUILTIN_OBJ   = "BUILTIN"
 	PROCEDURE_OBJ = "PROCEDURE"
+	NATIVE_OBJ    = "NATIVE"
 	SYMBOL_OBJ    = "SYMBOL"
 	NIL_OBJ       = "NIL"
 )
@@ -32,6 +33,9 @@ type Object interface {
 
 type Error struct {
 	Message string
+	// Err is set when the error has a cause embedders can match with
+	// errors.Is, such as ErrStepLimit.
+	Err error
 }
 
 func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
@@ -106,7 +110,7 @@ func (l *List) Inspect() string {
 	var out bytes.Buffer
 	args := make([]string, 0)
 	for _, arg := range l.Args {
-		args = append(args, arg.Inspect())
+		args = append(args, inspect(arg))
 	}
 	out.WriteString("'(")
 	out.WriteString(strings.Join(args, " "))
@@ -117,7 +121,10 @@ func (l *List) Inspect() string {
 type Lambda struct {
 	Params []*parser.Identifier
 	Body   []parser.Expression
-	Env    *Env
+	// Frame names the slots of a call, parameters first, once the lambda
+	// has been resolved.
+	Frame []string
+	Env   *Env
 }
 
 func (l *Lambda) Type() ObjectType { return LAMBDA_OBJ }
@@ -143,3 +150,24 @@ func (s *Procedure) Type() ObjectType { return PROCEDURE_OBJ }
 func (s *Procedure) Inspect() string {
 	return fmt.Sprintf("#<procedure:%s>", s.Name)
 }
+
+// VARIADIC marks a native function that accepts any number of arguments.
+const VARIADIC = -1
+
+type NativeFunc func(args []Object) (Object, error)
+
+type Native struct {
+	Name  string
+	Arity int
+	Fn    NativeFunc
+	Doc   string
+	// Form, when set, is called by the interpreter instead of Fn with the
+	// unevaluated call, for natives such as assert-error that decide how
+	// their arguments are evaluated. Compiled code still calls Fn.
+	Form func(expr *parser.Form, env *Env) Object
+}
+
+func (n *Native) Type() ObjectType { return NATIVE_OBJ }
+func (n *Native) Inspect() string {
+	return fmt.Sprintf("#<procedure:%s>", n.Name)
+}
@@ -0,0 +1,124 @@
+package eval
+
+import (
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+)
+
+// Resolve gives every lambda in expr a frame layout and annotates the
+// identifiers that refer to lambda parameters and definitions with their
+// (depth, index) address, so that evaluating them indexes a slot instead of
+// looking the name up. Identifiers outside of any lambda stay global and are
+// looked up by name.
+//
+// Eval resolves lambdas the first time they are evaluated, so calling
+// Resolve is only needed to avoid doing so while the program is being run,
+// for example when it is shared between goroutines.
+func Resolve(expr parser.Expression) {
+	resolve(expr, nil)
+}
+
+type frameScope struct {
+	slots map[string]int
+	names []string
+}
+
+func resolve(expr parser.Expression, scopes []*frameScope) {
+	switch expr := expr.(type) {
+	case *parser.Program:
+		for _, arg := range expr.Args {
+			resolve(arg, scopes)
+		}
+	case *parser.Identifier:
+		resolveIdentifier(expr, scopes)
+	case *parser.List:
+		// identifiers in a list are quoted
+		for _, arg := range expr.Args {
+			if _, ok := arg.(*parser.Identifier); !ok {
+				resolve(arg, scopes)
+			}
+		}
+	case *parser.Form:
+		if isBuiltin(expr.First, lexer.LAMBDA) {
+			resolveLambda(expr, scopes)
+			return
+		}
+		resolve(expr.First, scopes)
+		for _, arg := range expr.Rest {
+			resolve(arg, scopes)
+		}
+	}
+}
+
+func resolveIdentifier(ident *parser.Identifier, scopes []*frameScope) {
+	ident.Local = false
+	for depth := 0; depth < len(scopes); depth++ {
+		if slot, ok := scopes[len(scopes)-1-depth].slots[ident.Value]; ok {
+			ident.Local, ident.Depth, ident.Index = true, depth, slot
+			return
+		}
+	}
+}
+
+// resolveLambda lays out the frame of a lambda form: its parameters followed
+// by every name defined in its body, since define binds in the environment
+// of the call wherever in the body it appears. Malformed lambdas are left
+// alone for evalLambda to report.
+func resolveLambda(form *parser.Form, scopes []*frameScope) {
+	if len(form.Rest) < 2 {
+		return
+	}
+	params, ok := form.Rest[0].(*parser.List)
+	if !ok {
+		return
+	}
+	scope := &frameScope{slots: make(map[string]int), names: make([]string, 0, len(params.Args))}
+	for _, param := range params.Args {
+		ident, ok := param.(*parser.Identifier)
+		if !ok {
+			return
+		}
+		// a repeated parameter is bound to the last argument given for it
+		scope.slots[ident.Value] = len(scope.names)
+		ident.Local, ident.Depth, ident.Index = true, 0, len(scope.names)
+		scope.names = append(scope.names, ident.Value)
+	}
+	for _, expr := range form.Rest[1:] {
+		scope.hoist(expr)
+	}
+	scopes = append(scopes[:len(scopes):len(scopes)], scope)
+	for _, expr := range form.Rest[1:] {
+		resolve(expr, scopes)
+	}
+	form.Frame = scope.names
+}
+
+func (s *frameScope) hoist(expr parser.Expression) {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		if isBuiltin(expr.First, lexer.LAMBDA) {
+			return
+		}
+		if isBuiltin(expr.First, lexer.DEFINE) && len(expr.Rest) == 2 {
+			if name, ok := expr.Rest[0].(*parser.Identifier); ok {
+				if _, ok := s.slots[name.Value]; !ok {
+					s.slots[name.Value] = len(s.names)
+					s.names = append(s.names, name.Value)
+				}
+			}
+		}
+		s.hoist(expr.First)
+		for _, arg := range expr.Rest {
+			s.hoist(arg)
+		}
+	case *parser.List:
+		for _, arg := range expr.Args {
+			s.hoist(arg)
+		}
+	}
+}
+
+func isBuiltin(expr parser.Expression, tok lexer.TokenType) bool {
+	b, ok := expr.(*parser.BuiltinIdentifier)
+	return ok && b.Token.Type == tok
+}
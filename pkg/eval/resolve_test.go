@@ -0,0 +1,101 @@
+package eval
+
+import (
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// addresses lists the identifiers in expr in source order as name@depth.index,
+// or just the name when they are looked up globally, followed by the frame
+// of every lambda.
+func addresses(expr parser.Expression) (idents, frames []string) {
+	var walk func(expr parser.Expression)
+	walk = func(expr parser.Expression) {
+		switch expr := expr.(type) {
+		case *parser.Program:
+			for _, arg := range expr.Args {
+				walk(arg)
+			}
+		case *parser.Identifier:
+			if expr.Local {
+				idents = append(idents, fmt.Sprintf("%s@%d.%d", expr.Value, expr.Depth, expr.Index))
+			} else {
+				idents = append(idents, expr.Value)
+			}
+		case *parser.List:
+			for _, arg := range expr.Args {
+				walk(arg)
+			}
+		case *parser.Form:
+			if isBuiltin(expr.First, lexer.LAMBDA) {
+				frames = append(frames, "["+strings.Join(expr.Frame, " ")+"]")
+			}
+			walk(expr.First)
+			for _, arg := range expr.Rest {
+				walk(arg)
+			}
+		}
+	}
+	walk(expr)
+	return idents, frames
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		input  string
+		idents string
+		frames string
+	}{
+		{"(lambda '(x) x)", "x@0.0 x@0.0", "[x]"},
+		{"(lambda '(x y) (+ y x))", "x@0.0 y@0.1 y@0.1 x@0.0", "[x y]"},
+		// the inner parameter shadows the outer one
+		{"(lambda '(x) (lambda '(x) x))", "x@0.0 x@0.0 x@0.0", "[x] [x]"},
+		// closures reach the frames of the lambdas around them
+		{"(lambda '(x) (lambda '(y) (+ x y)))", "x@0.0 y@0.0 x@1.0 y@0.0", "[x] [y]"},
+		{"(lambda '(x) (lambda '(y) (lambda '() (+ x y))))", "x@0.0 y@0.0 x@2.0 y@1.0", "[x] [y] []"},
+		{"(define g 1) (lambda '(x) (+ g x))", "g x@0.0 g x@0.0", "[x]"},
+		// definitions get a slot wherever they are in the body
+		{"(lambda '(x) (display y) (define y x) y)", "x@0.0 y@0.1 y@0.1 x@0.0 y@0.1", "[x y]"},
+		{"(lambda '(x) (if x (define y 1) (define z 2)))", "x@0.0 x@0.0 y@0.1 z@0.2", "[x y z]"},
+		{"(lambda '(x) (define x 2) x)", "x@0.0 x@0.0 x@0.0", "[x]"},
+		// an inner definition shadows an outer parameter
+		{"(lambda '(x) (lambda '(y) (define x y) x))", "x@0.0 y@0.0 x@0.1 y@0.0 x@0.1", "[x] [y x]"},
+		// but doesn't get a slot in the frame of the outer lambda
+		{"(lambda '() (lambda '() (define z 1)) z)", "z@0.0 z", "[] [z]"},
+		// a repeated parameter is bound to the last argument
+		{"(lambda '(x x) x)", "x@0.0 x@0.1 x@0.1", "[x x]"},
+		// quoted identifiers aren't variables
+		{"(lambda '(x) '(x))", "x@0.0 x", "[x]"},
+	}
+	for _, tt := range tests {
+		program := parse(t, tt.input)
+		Resolve(program)
+		idents, frames := addresses(program)
+		if got := strings.Join(idents, " "); got != tt.idents {
+			t.Errorf("%s: identifiers %s, want %s", tt.input, got, tt.idents)
+		}
+		if got := strings.Join(frames, " "); got != tt.frames {
+			t.Errorf("%s: frames %s, want %s", tt.input, got, tt.frames)
+		}
+	}
+}
+
+func TestResolvedClosures(t *testing.T) {
+	tests := []evalTest{
+		{"((((lambda '(x) (lambda '(x) (lambda '() x))) 1) 2))", "2"},
+		{"(((lambda '(x) (lambda '(y) (- x y))) 5) 3)", "2"},
+		{"(define x 10) ((lambda '(y) (+ x y)) 1)", "11"},
+		{"(define f (lambda '(x) (define g (lambda '() x)) (define x 3) (g))) (f 1)", "3"},
+		{"(define make (lambda '(n) (lambda '() n))) (define a (make 1)) (define b (make 2)) (list (a) (b))", "'(1 2)"},
+		{"((lambda '(x x) x) 1 2)", "2"},
+		{"((lambda '(x) (define y x) ((lambda '(x) (+ x y)) 5)) 1)", "6"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.input); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
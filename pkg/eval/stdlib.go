@@ -0,0 +1,356 @@
+package eval
+
+import (
+	"bufio"
+	"context"
+	"doma/pkg/lexer"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Capability names a group of builtins that can be granted to a script.
+type Capability string
+
+const (
+	// CapPure covers the core language and is always granted.
+	CapPure Capability = "pure"
+	CapIO   Capability = "io"
+	CapFS   Capability = "fs"
+	CapOS   Capability = "os"
+	CapNet  Capability = "net"
+	CapTime Capability = "time"
+)
+
+var AllCapabilities = []Capability{CapPure, CapIO, CapFS, CapOS, CapNet, CapTime}
+
+var stdlib = map[Capability]func(env *Env){
+	CapIO:   defineIO,
+	CapFS:   defineFS,
+	CapOS:   defineOS,
+	CapNet:  defineNet,
+	CapTime: defineTime,
+}
+
+var builtinCapabilities = map[lexer.TokenType]Capability{
+	lexer.DISPLAY: CapIO,
+	lexer.PRINTF:  CapIO,
+	lexer.IMPORT:  CapFS,
+	lexer.REQUIRE: CapFS,
+}
+
+func (s *state) allowed(c Capability) bool {
+	return s.caps == nil || c == CapPure || s.caps[c]
+}
+
+// CheckBuiltin reports an error if the capabilities granted to the
+// environment don't allow the builtin tok.
+func (e *Env) CheckBuiltin(tok lexer.TokenType) *Error {
+	return e.state.checkBuiltin(tok)
+}
+
+func (s *state) checkBuiltin(tok lexer.TokenType) *Error {
+	c, ok := builtinCapabilities[tok]
+	if !ok || s.allowed(c) {
+		return nil
+	}
+	return newError("%s requires the %s capability", strings.ToLower(string(tok)), c)
+}
+
+func (s *state) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func defineIO(env *Env) {
+	env.DefineNative("read-line", 0, func(args []Object) (Object, error) {
+		if env.state.reader == nil {
+			env.state.reader = bufio.NewReader(env.state.in)
+		}
+		line, err := env.state.readLine()
+		if err == io.EOF && line == "" {
+			return &Nil{}, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return &String{Value: strings.TrimRight(line, "\r\n")}, nil
+	}).Doc = "(read-line) reads a line from standard input, or returns nil at the end of input"
+}
+
+// readLine reads a line from the input of the script, failing once the
+// evaluation has read more than MaxRead bytes.
+func (s *state) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := s.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err := s.charge(len(chunk)); err != nil {
+			return "", err
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+func defineFS(env *Env) {
+	st := env.state
+	env.DefineNative("read-file", 1, func(args []Object) (Object, error) {
+		name, err := st.resolvePath(args[0])
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, st.pathError(err)
+		}
+		defer f.Close()
+		data, err := st.readAll(f)
+		if err != nil {
+			return nil, st.pathError(err)
+		}
+		return &String{Value: data}, nil
+	}).Doc = "(read-file path) returns the contents of a file"
+	env.DefineNative("write-file", 2, func(args []Object) (Object, error) {
+		name, err := st.resolvePath(args[0])
+		if err != nil {
+			return nil, err
+		}
+		data, ok := args[1].(*String)
+		if !ok {
+			return nil, fmt.Errorf("expects STRING contents, got %s", args[1].Type())
+		}
+		if err := os.WriteFile(name, []byte(data.Value), 0o644); err != nil {
+			return nil, st.pathError(err)
+		}
+		return &Nil{}, nil
+	}).Doc = "(write-file path contents) replaces the contents of a file"
+	env.DefineNative("file-exists", 1, func(args []Object) (Object, error) {
+		name, err := st.resolvePath(args[0])
+		if err != nil {
+			return nil, err
+		}
+		_, err = os.Stat(name)
+		return &Boolean{Value: err == nil}, nil
+	}).Doc = "(file-exists path) reports whether a file exists"
+	env.DefineNative("delete-file", 1, func(args []Object) (Object, error) {
+		name, err := st.resolvePath(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Remove(name); err != nil {
+			return nil, st.pathError(err)
+		}
+		return &Nil{}, nil
+	}).Doc = "(delete-file path) removes a file"
+	env.DefineNative("list-directory", 1, func(args []Object) (Object, error) {
+		name, err := st.resolvePath(args[0])
+		if err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return nil, st.pathError(err)
+		}
+		names := make([]Object, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, &String{Value: entry.Name()})
+		}
+		return &List{Args: names}, nil
+	}).Doc = "(list-directory path) returns the names of the entries in a directory"
+}
+
+// resolvePath maps a script supplied path onto the host filesystem. With a
+// root configured the path is interpreted relative to it and may not escape
+// it, either lexically or by following symlinks.
+func (s *state) resolvePath(obj Object) (string, error) {
+	str, ok := obj.(*String)
+	if !ok {
+		return "", fmt.Errorf("expects STRING path, got %s", obj.Type())
+	}
+	if s.fsRoot == "" {
+		return str.Value, nil
+	}
+	name := filepath.Join(s.fsRoot, filepath.FromSlash(path.Clean("/"+str.Value)))
+	real, err := filepath.EvalSymlinks(name)
+	if errors.Is(err, os.ErrNotExist) {
+		// a dangling symlink can't be resolved, but writing to it would
+		// create its target wherever that is
+		if info, err := os.Lstat(name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symlink to a missing file", str.Value)
+		}
+		real, err = filepath.EvalSymlinks(filepath.Dir(name))
+		real = filepath.Join(real, filepath.Base(name))
+	}
+	if err != nil {
+		return "", s.pathError(err)
+	}
+	root, err := filepath.EvalSymlinks(s.fsRoot)
+	if err != nil {
+		return "", err
+	}
+	if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the sandbox", str.Value)
+	}
+	return name, nil
+}
+
+// pathError hides the host location of the sandbox root from scripts.
+func (s *state) pathError(err error) error {
+	if s.fsRoot == "" {
+		return err
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		rel, relErr := filepath.Rel(s.fsRoot, pathErr.Path)
+		if relErr == nil {
+			return fmt.Errorf("%s %s: %w", pathErr.Op, filepath.ToSlash(rel), pathErr.Err)
+		}
+	}
+	return err
+}
+
+// ExitError is the cause of the error returned by (exit code). Embedders
+// decide what exiting means, the CLI ends the process with Code.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+func defineOS(env *Env) {
+	env.DefineNative("command-line-arguments", 0, func(args []Object) (Object, error) {
+		list := make([]Object, 0, len(env.state.args))
+		for _, arg := range env.state.args {
+			list = append(list, &String{Value: arg})
+		}
+		return &List{Args: list}, nil
+	}).Doc = "(command-line-arguments) returns the arguments passed to the script"
+	env.DefineNative("getenv", 1, func(args []Object) (Object, error) {
+		name, ok := args[0].(*String)
+		if !ok {
+			return nil, fmt.Errorf("expects STRING name, got %s", args[0].Type())
+		}
+		val, ok := os.LookupEnv(name.Value)
+		if !ok {
+			return &Nil{}, nil
+		}
+		return &String{Value: val}, nil
+	}).Doc = "(getenv name) returns the value of an environment variable, or nil when it is unset"
+	env.DefineNative("setenv", 2, func(args []Object) (Object, error) {
+		name, ok := args[0].(*String)
+		if !ok {
+			return nil, fmt.Errorf("expects STRING name, got %s", args[0].Type())
+		}
+		val, ok := args[1].(*String)
+		if !ok {
+			return nil, fmt.Errorf("expects STRING value, got %s", args[1].Type())
+		}
+		return &Nil{}, os.Setenv(name.Value, val.Value)
+	}).Doc = "(setenv name value) sets an environment variable"
+	env.DefineNative("exit", VARIADIC, func(args []Object) (Object, error) {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("expects at most 1 argument, got %d", len(args))
+		}
+		code := 0
+		if len(args) == 1 {
+			n, ok := args[0].(*Number)
+			if !ok {
+				return nil, fmt.Errorf("expects NUMBER status, got %s", args[0].Type())
+			}
+			code = int(n.Value)
+		}
+		return nil, &ExitError{Code: code}
+	}).Doc = "(exit [code]) stops the script with the given exit status, 0 by default"
+	env.DefineNative("run-command", VARIADIC, func(args []Object) (Object, error) {
+		if len(args) == 0 {
+			return nil, errors.New("expects a command")
+		}
+		argv := make([]string, 0, len(args))
+		for _, arg := range args {
+			str, ok := arg.(*String)
+			if !ok {
+				return nil, fmt.Errorf("expects STRING arguments, got %s", arg.Type())
+			}
+			argv = append(argv, str.Value)
+		}
+		cmd := exec.CommandContext(env.state.context(), argv[0], argv[1:]...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		out, readErr := env.state.readAll(stdout)
+		if readErr != nil {
+			cmd.Process.Kill()
+		}
+		err = cmd.Wait()
+		if readErr != nil {
+			return nil, readErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &String{Value: out}, nil
+	}).Doc = "(run-command name args ...) runs a program and returns its output"
+}
+
+func defineNet(env *Env) {
+	env.DefineNative("http-get", 1, func(args []Object) (Object, error) {
+		url, ok := args[0].(*String)
+		if !ok {
+			return nil, fmt.Errorf("expects STRING url, got %s", args[0].Type())
+		}
+		req, err := http.NewRequestWithContext(env.state.context(), http.MethodGet, url.Value, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return nil, fmt.Errorf("%s returned %s", url.Value, resp.Status)
+		}
+		body, err := env.state.readAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &String{Value: body}, nil
+	}).Doc = "(http-get url) fetches url and returns the response body"
+}
+
+func defineTime(env *Env) {
+	env.DefineNative("current-time", 0, func(args []Object) (Object, error) {
+		return &Number{Value: time.Now().UnixMilli()}, nil
+	}).Doc = "(current-time) returns the unix time in milliseconds"
+	env.DefineNative("sleep", 1, func(args []Object) (Object, error) {
+		ms, ok := args[0].(*Number)
+		if !ok {
+			return nil, fmt.Errorf("expects NUMBER of milliseconds, got %s", args[0].Type())
+		}
+		timer := time.NewTimer(time.Duration(ms.Value) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return &Nil{}, nil
+		case <-env.state.context().Done():
+			return nil, env.state.context().Err()
+		}
+	}).Doc = "(sleep ms) pauses for ms milliseconds"
+}
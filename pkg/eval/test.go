@@ -0,0 +1,267 @@
+package eval
+
+import (
+	"context"
+	"doma/pkg/parser"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Test is a test defined with (deftest name body ...). Defining it only
+// records it, the body runs when Run is called.
+type Test struct {
+	Name string
+	// Line and Col are the position of the deftest form.
+	Line int
+	Col  int
+	Body []parser.Expression
+	env  *Env
+}
+
+// Tests lists the tests defined so far by code evaluated in env or in any
+// environment sharing its interpreter, in the order they were defined.
+func (e *Env) Tests() []*Test {
+	return e.state.tests
+}
+
+// Run evaluates the body of the test in a new environment enclosed by the
+// one it was defined in, stopping at the first error. A failed assertion is
+// an error whose cause is an *AssertionError.
+func (t *Test) Run(ctx context.Context) Object {
+	env := NewEnclosedEnv(t.env)
+	var last Object = &Nil{}
+	for _, expr := range t.Body {
+		last = EvalContext(ctx, expr, env)
+		if isError(last) {
+			return last
+		}
+	}
+	return last
+}
+
+// AssertionError is the cause of the error a failed assertion evaluates to.
+type AssertionError struct {
+	// Assertion is the name of the form that failed, such as assert-equal.
+	Assertion string
+	Line      int
+	Col       int
+	Message   string
+	// Expected and Actual are the Inspect output of the values compared by
+	// assert-equal.
+	Expected string
+	Actual   string
+}
+
+func (e *AssertionError) Error() string {
+	return fmt.Sprintf("%s failed at %d:%d: %s", e.Assertion, e.Line, e.Col, e.Message)
+}
+
+// defineAssertions binds the assertions used in tests. They are natives
+// rather than special forms so programs can still use their names, but get
+// the unevaluated call to report what failed and where.
+func defineAssertions(env *Env) {
+	assertions := []struct {
+		name string
+		doc  string
+		form func(expr *parser.Form, env *Env) Object
+	}{
+		{"assert-equal", "(assert-equal expected actual [message]) fails unless the values are equal", evalAssertEqual},
+		{"assert-true", "(assert-true v [message]) fails unless v is truthy", evalAssertTrue},
+		{"assert-error", "(assert-error expr [text]) fails unless expr is an error whose message contains text", evalAssertError},
+	}
+	for _, a := range assertions {
+		native := env.DefineNative(a.name, VARIADIC, func(args []Object) (Object, error) {
+			return nil, errors.New("not supported in compiled code")
+		})
+		native.Doc = a.doc
+		native.Form = a.form
+	}
+}
+
+func evalDeftest(expr *parser.Form, env *Env) Object {
+	if len(expr.Rest) == 0 {
+		return newError("deftest expects a name")
+	}
+	var name string
+	switch arg := expr.Rest[0].(type) {
+	case *parser.Identifier:
+		name = arg.Value
+	case *parser.String:
+		name = arg.Value
+	default:
+		return newError("deftest expects first argument to be identifier or string, got %s", arg.TokenLiteral())
+	}
+	for _, t := range env.state.tests {
+		if t.Name == name {
+			return newError("deftest: test %s is already defined", name)
+		}
+	}
+	env.state.tests = append(env.state.tests, &Test{
+		Name: name,
+		Line: expr.Token.Line,
+		Col:  expr.Token.Col,
+		Body: expr.Rest[1:],
+		env:  env,
+	})
+	return &Nil{}
+}
+
+// fail returns the error of a failed assertion, adding the message given
+// to it, if any.
+func fail(expr *parser.Form, env *Env, note parser.Expression, assertion *AssertionError) Object {
+	if note != nil {
+		obj := Eval(note, env)
+		if isError(obj) {
+			return obj
+		}
+		str, ok := obj.(*String)
+		if !ok {
+			return newError("%s expects a STRING message, got %s", assertion.Assertion, typeOf(obj))
+		}
+		assertion.Message += ": " + str.Value
+	}
+	assertion.Line, assertion.Col = expr.Token.Line, expr.Token.Col
+	return &Error{Message: assertion.Error(), Err: assertion}
+}
+
+// optional returns the argument at i, or nil if there are too few.
+func optional(expr *parser.Form, i int) parser.Expression {
+	if i < len(expr.Rest) {
+		return expr.Rest[i]
+	}
+	return nil
+}
+
+func evalAssertEqual(expr *parser.Form, env *Env) Object {
+	if len(expr.Rest) < 2 || len(expr.Rest) > 3 {
+		return newError("assert-equal expects 2 or 3 arguments, got %d", len(expr.Rest))
+	}
+	expected := Eval(expr.Rest[0], env)
+	if isError(expected) {
+		return expected
+	}
+	actual := Eval(expr.Rest[1], env)
+	if isError(actual) {
+		return actual
+	}
+	if equal(expected, actual) {
+		return &Boolean{Value: true}
+	}
+	return fail(expr, env, optional(expr, 2), &AssertionError{
+		Assertion: "assert-equal",
+		Message:   fmt.Sprintf("expected %s, got %s", inspect(expected), inspect(actual)),
+		Expected:  inspect(expected),
+		Actual:    inspect(actual),
+	})
+}
+
+func evalAssertTrue(expr *parser.Form, env *Env) Object {
+	if len(expr.Rest) < 1 || len(expr.Rest) > 2 {
+		return newError("assert-true expects 1 or 2 arguments, got %d", len(expr.Rest))
+	}
+	obj := Eval(expr.Rest[0], env)
+	if isError(obj) {
+		return obj
+	}
+	if isTruthy(obj) {
+		return &Boolean{Value: true}
+	}
+	return fail(expr, env, optional(expr, 1), &AssertionError{
+		Assertion: "assert-true",
+		Message:   fmt.Sprintf("%s is %s", expr.Rest[0], inspect(obj)),
+	})
+}
+
+// evalAssertError passes when its expression evaluates to an error, whose
+// message has to contain the given text if there is one, and returns the
+// message. Errors that stop the whole evaluation, such as exceeded limits,
+// aren't caught.
+func evalAssertError(expr *parser.Form, env *Env) Object {
+	if len(expr.Rest) < 1 || len(expr.Rest) > 2 {
+		return newError("assert-error expects 1 or 2 arguments, got %d", len(expr.Rest))
+	}
+	obj := Eval(expr.Rest[0], env)
+	errObj, ok := obj.(*Error)
+	if ok && uncatchable(errObj.Err) {
+		return errObj
+	}
+	want := ""
+	if len(expr.Rest) == 2 {
+		wantObj := Eval(expr.Rest[1], env)
+		if isError(wantObj) {
+			return wantObj
+		}
+		str, ok := wantObj.(*String)
+		if !ok {
+			return newError("assert-error expects a STRING as second arg, got %s", typeOf(wantObj))
+		}
+		want = str.Value
+	}
+	if !ok {
+		return fail(expr, env, nil, &AssertionError{
+			Assertion: "assert-error",
+			Message:   fmt.Sprintf("expected an error from %s, got %s", expr.Rest[0], inspect(obj)),
+		})
+	}
+	if !strings.Contains(errObj.Message, want) {
+		return fail(expr, env, nil, &AssertionError{
+			Assertion: "assert-error",
+			Message:   fmt.Sprintf("expected an error containing %q, got %q", want, errObj.Message),
+		})
+	}
+	return &String{Value: errObj.Message}
+}
+
+// uncatchable reports whether assert-error has to pass err on instead of
+// treating it as the error it expected: exits, exceeded limits and failed
+// assertions, which would otherwise make a test pass.
+func uncatchable(err error) bool {
+	var exit *ExitError
+	var assertion *AssertionError
+	for _, target := range []error{ErrCanceled, ErrStepLimit, ErrDepthLimit, ErrAllocLimit, ErrListLimit, ErrOutputLimit, ErrReadLimit} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return errors.As(err, &exit) || errors.As(err, &assertion)
+}
+
+// equal reports whether two values are the same, comparing lists element
+// by element and procedures by identity.
+func equal(a, b Object) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a := a.(type) {
+	case *Number:
+		return a.Value == b.(*Number).Value
+	case *String:
+		return a.Value == b.(*String).Value
+	case *Boolean:
+		return a.Value == b.(*Boolean).Value
+	case *Symbol:
+		return a.Value == b.(*Symbol).Value
+	case *Nil:
+		return true
+	case *Builtin:
+		return a.Value == b.(*Builtin).Value
+	case *Error:
+		return a.Message == b.(*Error).Message
+	case *List:
+		other := b.(*List)
+		if len(a.Args) != len(other.Args) {
+			return false
+		}
+		for i := range a.Args {
+			if !equal(a.Args[i], other.Args[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
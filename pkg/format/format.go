@@ -0,0 +1,317 @@
+// Package format pretty-prints doma source in its canonical layout.
+//
+// Forms written on one line stay on one line as long as they fit. Other
+// forms are broken Lisp style: define, lambda, let and begin indent their
+// bodies by two spaces, if aligns its branches under the condition and other
+// calls align their arguments under the first one. Comments stay next to the
+// code they precede or follow, and single blank lines are preserved.
+package format
+
+import (
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"errors"
+	"math"
+	"strings"
+)
+
+const maxWidth = 80
+
+// Source parses src, keeping its comments, and returns it formatted.
+func Source(src []byte) ([]byte, error) {
+	p := parser.New(lexer.NewWithMode(string(src), lexer.ScanComments))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return nil, errors.New(strings.Join(p.Errors(), "\n"))
+	}
+	return []byte(Program(program)), nil
+}
+
+// Program renders program as source. Comments are only reproduced when it
+// was parsed with lexer.ScanComments.
+func Program(program *parser.Program) string {
+	p := &printer{comments: program.Comments}
+	p.printBody(program.Args, 0, lexer.Token{Line: math.MaxInt})
+	p.flushComments(lexer.Token{Line: math.MaxInt}, 0)
+	if p.out.Len() > 0 {
+		p.out.WriteString("\n")
+	}
+	return p.out.String()
+}
+
+type printer struct {
+	out      strings.Builder
+	col      int
+	comments []lexer.Token
+	next     int
+	// line is the source line of the last thing printed
+	line int
+	// comment is set when the output line ends in a comment, so nothing
+	// else can follow on it
+	comment bool
+}
+
+func (p *printer) write(s string) {
+	p.out.WriteString(s)
+	p.col += len(s)
+	p.comment = false
+}
+
+// newline starts a new output line at indent, keeping a blank line when the
+// source had one before srcLine.
+func (p *printer) newline(srcLine int, indent int) {
+	if p.out.Len() > 0 {
+		p.out.WriteString("\n")
+		if p.line > 0 && srcLine > p.line+1 {
+			p.out.WriteString("\n")
+		}
+	}
+	p.out.WriteString(strings.Repeat(" ", indent))
+	p.col = indent
+	p.comment = false
+}
+
+// item prints expr on its own line, preceded by the comments before it and
+// followed by a comment on the same line that comes before limit.
+func (p *printer) item(expr parser.Expression, indent int, limit lexer.Token) {
+	start := startOf(expr)
+	p.flushComments(start, indent)
+	p.newline(start.Line, indent)
+	p.print(expr)
+	p.line = endLine(expr)
+	p.trailingComment(limit)
+}
+
+// flushComments prints each pending comment before tok on its own line.
+func (p *printer) flushComments(tok lexer.Token, indent int) {
+	for p.commentBefore(tok) {
+		c := p.comments[p.next]
+		p.newline(c.Line, indent)
+		p.write(c.Literal)
+		p.comment = true
+		p.line = c.Line
+		p.next++
+	}
+}
+
+func (p *printer) commentBefore(tok lexer.Token) bool {
+	if p.next >= len(p.comments) {
+		return false
+	}
+	c := p.comments[p.next]
+	return c.Line < tok.Line || (c.Line == tok.Line && c.Col < tok.Col)
+}
+
+// trailingComment appends a comment that follows the code just printed on
+// the same source line, unless more code comes first.
+func (p *printer) trailingComment(limit lexer.Token) {
+	if p.commentBefore(limit) && p.comments[p.next].Line == p.line {
+		p.write(" " + p.comments[p.next].Literal)
+		p.comment = true
+		p.next++
+	}
+}
+
+func (p *printer) print(expr parser.Expression) {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		p.printForm(expr)
+	case *parser.List:
+		p.printList(expr)
+	default:
+		p.write(flat(expr))
+	}
+}
+
+func (p *printer) fitsFlat(expr parser.Expression, close lexer.Token) bool {
+	if startOf(expr).Line != close.Line || p.commentBefore(close) {
+		return false
+	}
+	return p.col+len(flat(expr)) <= maxWidth
+}
+
+// sameLine prints expr after what was printed last, as long as no comment
+// would end up out of place.
+func (p *printer) sameLine(expr parser.Expression) bool {
+	if p.commentBefore(startOf(expr)) {
+		return false
+	}
+	p.write(" ")
+	p.print(expr)
+	p.line = endLine(expr)
+	return true
+}
+
+func (p *printer) printForm(form *parser.Form) {
+	if p.fitsFlat(form, form.Close) {
+		p.write(flat(form))
+		return
+	}
+	open := p.col
+	p.write("(")
+	p.print(form.First)
+	p.line = endLine(form.First)
+	args := form.Rest
+	indent := open + 1
+	switch headName(form.First) {
+	case "define", "lambda", "let", "deftest", "module":
+		if len(args) > 0 && p.sameLine(args[0]) {
+			args = args[1:]
+		}
+		indent = open + 2
+	case "if":
+		if len(args) > 0 && p.sameLine(args[0]) {
+			args = args[1:]
+		}
+		indent = open + 4
+	case "begin":
+		indent = open + 2
+	default:
+		if _, ok := form.First.(*parser.Form); !ok && len(args) > 0 {
+			align := p.col + 1
+			if p.sameLine(args[0]) {
+				args = args[1:]
+				indent = align
+			}
+		}
+	}
+	p.printBody(args, indent, form.Close)
+	p.closeParen(form.Close, open, indent)
+}
+
+func (p *printer) printList(lst *parser.List) {
+	if p.fitsFlat(lst, lst.Close) {
+		p.write(flat(lst))
+		return
+	}
+	open := p.col
+	args := lst.Args
+	indent := open + 2
+	if lst.Head.Type == lexer.LIST {
+		p.write("(list")
+		p.line = lst.Head.Line
+		indent = open + 1
+		if len(args) > 0 {
+			align := p.col + 1
+			if p.sameLine(args[0]) {
+				args = args[1:]
+				indent = align
+			}
+		}
+	} else {
+		p.write("'(")
+		if len(args) > 0 && !p.commentBefore(startOf(args[0])) {
+			p.print(args[0])
+			p.line = endLine(args[0])
+			args = args[1:]
+		}
+	}
+	p.printBody(args, indent, lst.Close)
+	p.closeParen(lst.Close, open, indent)
+}
+
+// printBody prints each expression on its own line. close is the token that
+// ends the enclosing form.
+func (p *printer) printBody(body []parser.Expression, indent int, close lexer.Token) {
+	for i, expr := range body {
+		limit := close
+		if i+1 < len(body) {
+			limit = startOf(body[i+1])
+		}
+		if i == 0 {
+			p.trailingComment(startOf(expr))
+		}
+		p.item(expr, indent, limit)
+	}
+	if len(body) == 0 {
+		p.trailingComment(close)
+	}
+}
+
+// closeParen prints the closing parenthesis, moving it onto its own line
+// when comments come before it.
+func (p *printer) closeParen(close lexer.Token, open int, indent int) {
+	if p.commentBefore(close) {
+		p.flushComments(close, indent)
+	}
+	if p.comment {
+		p.newline(p.line, open)
+		p.line = close.Line
+	}
+	p.write(")")
+}
+
+func headName(expr parser.Expression) string {
+	switch expr := expr.(type) {
+	case *parser.BuiltinIdentifier:
+		return expr.Token.Literal
+	case *parser.Identifier:
+		return expr.Value
+	}
+	return ""
+}
+
+// flat renders expr on a single line, keeping the syntax it was written
+// with.
+func flat(expr parser.Expression) string {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		parts := make([]string, 0, len(expr.Rest)+1)
+		parts = append(parts, flat(expr.First))
+		for _, arg := range expr.Rest {
+			parts = append(parts, flat(arg))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	case *parser.List:
+		parts := make([]string, 0, len(expr.Args)+1)
+		if expr.Head.Type == lexer.LIST {
+			parts = append(parts, "list")
+		}
+		for _, arg := range expr.Args {
+			parts = append(parts, flat(arg))
+		}
+		if expr.Head.Type == lexer.LIST {
+			return "(" + strings.Join(parts, " ") + ")"
+		}
+		return "'(" + strings.Join(parts, " ") + ")"
+	case *parser.Number, *parser.BuiltinIdentifier, *parser.Boolean:
+		return expr.TokenLiteral()
+	case nil:
+		return ""
+	}
+	return expr.String()
+}
+
+func startOf(expr parser.Expression) lexer.Token {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		return expr.Token
+	case *parser.List:
+		return expr.Token
+	case *parser.String:
+		return expr.Token
+	case *parser.Number:
+		return expr.Token
+	case *parser.Identifier:
+		return expr.Token
+	case *parser.BuiltinIdentifier:
+		return expr.Token
+	case *parser.Boolean:
+		return expr.Token
+	case *parser.Symbol:
+		return expr.Token
+	}
+	return lexer.Token{}
+}
+
+func endLine(expr parser.Expression) int {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		return expr.Close.Line
+	case *parser.List:
+		return expr.Close.Line
+	case *parser.String:
+		return expr.Token.Line + strings.Count(expr.Value, "\n")
+	}
+	return startOf(expr).Line
+}
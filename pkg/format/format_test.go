@@ -0,0 +1,180 @@
+package format
+
+import (
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the .golden files")
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"(define x  5)", "(define x 5)\n"},
+		{"(list 1 2 3)", "(list 1 2 3)\n"},
+		{"(list)", "(list)\n"},
+		{"'(1 (list 2) '(3))", "'(1 (list 2) '(3))\n"},
+		{"(if true   #f\n 'sym)", "(if true\n    #f\n    'sym)\n"},
+		{"(a)\n\n\n(b)\n", "(a)\n\n(b)\n"},
+		{"(define f (lambda '(x) (* x x)))", "(define f (lambda '(x) (* x x)))\n"},
+		{"(define f\n(lambda '(x)\n(* x x)))", "(define f\n  (lambda '(x)\n    (* x x)))\n"},
+		{
+			"(define xs (list \"aaaaaaaaaaaaaaaaaaaa\" \"bbbbbbbbbbbbbbbbbbbbbbbbb\" \"ccccccccccccccccccccccccc\" \"d\"))",
+			"(define xs\n  (list \"aaaaaaaaaaaaaaaaaaaa\"\n        \"bbbbbbbbbbbbbbbbbbbbbbbbb\"\n        \"ccccccccccccccccccccccccc\"\n        \"d\"))\n",
+		},
+		{"(begin (f)\n(g))", "(begin\n  (f)\n  (g))\n"},
+		{"(display \"a  b\")", "(display \"a  b\")\n"},
+	}
+	for _, tt := range tests {
+		got, err := Source([]byte(tt.input))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"; a\n(f) ; b\n", "; a\n(f) ; b\n"},
+		{"(f)\n\n; end", "(f)\n\n; end\n"},
+		{"(define x ; why\n  5)", "(define x ; why\n  5)\n"},
+		{"(f 1 ; one\n   2) ; after", "(f 1 ; one\n   2) ; after\n"},
+		{"'(1 ; one\n ; two\n 2)", "'(1 ; one\n  ; two\n  2)\n"},
+		{"(list ; c\n 1)", "(list ; c\n 1)\n"},
+		{
+			"(define f (lambda '(x)\n; body\n(* x x)\n; end\n))",
+			"(define f\n  (lambda '(x)\n    ; body\n    (* x x)\n    ; end\n  ))\n",
+		},
+	}
+	for _, tt := range tests {
+		got, err := Source([]byte(tt.input))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func TestCommentBeforeClose(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"(+ 1 2 ; sum\n)", "(+ 1\n   2 ; sum\n)\n"},
+		{"'(1 2 ; two\n)", "'(1\n  2 ; two\n)\n"},
+		{"(display ; c\n)", "(display ; c\n)\n"},
+		{"(list 1 ; one\n)", "(list 1 ; one\n)\n"},
+		{"(f (g ; c\n))", "(f (g ; c\n   ))\n"},
+		{
+			"(define f (lambda '(x)\n  (* x x) ; square\n))",
+			"(define f\n  (lambda '(x)\n    (* x x) ; square\n  ))\n",
+		},
+		{"(f 1\n  ; last\n\n)", "(f 1\n   ; last\n)\n"},
+	}
+	for _, tt := range tests {
+		got, err := Source([]byte(tt.input))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.input, got, err, tt.want)
+			continue
+		}
+		if again, err := Source(got); err != nil || string(again) != string(got) {
+			t.Errorf("%q: formatting twice gives %q, %v", tt.input, again, err)
+		}
+		if a, b := tree(t, tt.input), tree(t, string(got)); a != b {
+			t.Errorf("%q: formatting changed the program from %q to %q", tt.input, a, b)
+		}
+	}
+}
+
+// tree returns the parsed program of src, printed.
+func tree(t *testing.T, src string) string {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("%q: %v", src, p.Errors())
+	}
+	return program.String()
+}
+
+func TestErrors(t *testing.T) {
+	if _, err := Source([]byte("(f 1")); err == nil || !strings.Contains(err.Error(), "unexpected end of input") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// TestExamples formats every script in examples and compares the result
+// with its .golden file in testdata. The output must format to itself and
+// hold the same tokens, comments included, as the input.
+func TestExamples(t *testing.T) {
+	files := make([]string, 0)
+	err := filepath.WalkDir("../../examples", func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Ext(path) == ".doma" {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no examples found")
+	}
+	for _, file := range files {
+		name, _ := filepath.Rel("../../examples", file)
+		t.Run(filepath.ToSlash(name), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Source(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, err := Source(got); err != nil || string(again) != string(got) {
+				t.Errorf("formatting is not idempotent, second pass gives:\n%s", again)
+			}
+			if a, b := tokens(string(src)), tokens(string(got)); a != b {
+				t.Errorf("formatting changed the tokens\nbefore: %s\nafter:  %s", a, b)
+			}
+
+			golden := filepath.Join("testdata", strings.TrimSuffix(name, ".doma")+".golden")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("output differs from %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+// tokens lists the tokens and comments of src, leaving out whitespace.
+func tokens(src string) string {
+	var out strings.Builder
+	l := lexer.NewWithMode(src, lexer.ScanComments)
+	for tok := l.NextToken(); tok.Type != lexer.EOF; tok = l.NextToken() {
+		out.WriteString(string(tok.Type) + ":" + tok.Literal + " ")
+	}
+	return out.String()
+}
@@ -0,0 +1,539 @@
+// Package gogen translates doma programs to Go. The generated package has a
+// Program type whose Run method runs the top level of the doma program and
+// whose other methods call the procedures it defines, using the eval.Object
+// types for values and package rt for the builtins.
+package gogen
+
+import (
+	"bytes"
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"doma/pkg/vm"
+	"fmt"
+	"go/format"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Options configures the generated package.
+type Options struct {
+	// Package is the name of the package. It has to be an identifier other
+	// than a Go keyword or main, since the package is meant to be imported.
+	Package string
+	// Source is the name of the doma file, mentioned in comments.
+	Source string
+}
+
+// Generate returns the formatted source of a Go package implementing program.
+// Like the VM, the generated code reports malformed forms when they run.
+func Generate(program *parser.Program, opts Options) ([]byte, error) {
+	if !token.IsIdentifier(opts.Package) || opts.Package == "main" {
+		return nil, fmt.Errorf("invalid package name %q", opts.Package)
+	}
+	g := &generator{
+		consts:   make(map[string]string),
+		builtins: make(map[lexer.TokenType]string),
+		globals:  make(map[string]string),
+		names:    make(map[string]int),
+	}
+	for _, expr := range program.Args {
+		g.hoistGlobals(expr)
+	}
+	g.emit("// Run runs the top level of the program and returns the value of its")
+	g.emit("// last expression or the *eval.Error that stopped it.")
+	g.emit("func (p *Program) Run() eval.Object {")
+	g.emit("var last eval.Object")
+	for _, expr := range program.Args {
+		g.emit("last = %s", g.expr(expr))
+	}
+	g.emit("return last")
+	g.emit("}")
+	for _, expr := range program.Args {
+		g.export(expr)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by doma gogen from %s. DO NOT EDIT.\n\n", opts.Source)
+	fmt.Fprintf(&out, "// Package %s implements the doma program %s.\n", opts.Package, opts.Source)
+	fmt.Fprintf(&out, "package %s\n\n", opts.Package)
+	out.WriteString("import (\n\"doma/pkg/eval\"\n\"doma/pkg/gogen/rt\"\n\"io\"\n)\n\n")
+	out.WriteString("// Program holds the globals of a run of the program.\ntype Program struct {\nrt *rt.Runtime\n")
+	for _, name := range g.globalOrder {
+		fmt.Fprintf(&out, "%s eval.Object // %s\n", g.globals[name], name)
+	}
+	out.WriteString("}\n\n")
+	out.WriteString("// New returns a program that runs with the natives and capabilities of env,\n// which may be nil.\n")
+	out.WriteString("func New(env *eval.Env) *Program {\nreturn &Program{rt: rt.New(env)}\n}\n\n")
+	out.WriteString("// SetOutput redirects display and printf, which write to os.Stdout by default.\n")
+	out.WriteString("func (p *Program) SetOutput(w io.Writer) {\np.rt.SetOutput(w)\n}\n\n")
+	out.Write(g.out.Bytes())
+	if len(g.constOrder) > 0 || len(g.builtins) > 0 {
+		out.WriteString("\nvar (\n")
+		for _, decl := range g.constOrder {
+			out.WriteString(decl + "\n")
+		}
+		ops := make([]string, 0, len(g.builtins))
+		for op := range g.builtins {
+			ops = append(ops, string(op))
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			fmt.Fprintf(&out, "%s = &eval.Builtin{Value: %q}\n", g.builtins[lexer.TokenType(op)], op)
+		}
+		out.WriteString(")\n")
+	}
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %w", err)
+	}
+	return src, nil
+}
+
+type generator struct {
+	out bytes.Buffer
+	// consts maps the Go expressions of literals to the variables holding them.
+	consts     map[string]string
+	constOrder []string
+	builtins   map[lexer.TokenType]string
+	// globals maps the names defined at the top level to their fields.
+	globals     map[string]string
+	globalOrder []string
+	exported    map[string]bool
+	// names counts the uses of each Go name so they can be made unique.
+	names  map[string]int
+	temps  int
+	scopes []*scope
+}
+
+// scope holds the variables of a lambda: its parameters and the names
+// defined in its body.
+type scope struct {
+	vars  map[string]*variable
+	order []*variable
+}
+
+func (s *scope) add(name string, v *variable) {
+	s.vars[name] = v
+	s.order = append(s.order, v)
+}
+
+type variable struct {
+	name  string
+	param bool
+}
+
+func (g *generator) emit(format string, a ...any) {
+	fmt.Fprintf(&g.out, format+"\n", a...)
+}
+
+func (g *generator) temp() string {
+	g.temps++
+	return fmt.Sprintf("t%d", g.temps)
+}
+
+// unique returns name, numbered if it has been used before.
+func (g *generator) unique(name string) string {
+	g.names[name]++
+	if n := g.names[name]; n > 1 {
+		return fmt.Sprintf("%s%d", name, n)
+	}
+	return name
+}
+
+// check makes the code return the value of t if it is an error.
+func (g *generator) check(t string) {
+	g.emit("if rt.IsError(%s) {", t)
+	g.emit("return %s", t)
+	g.emit("}")
+}
+
+// discard marks a value as unused.
+func (g *generator) discard(x string) {
+	if x != "nil" {
+		g.emit("_ = %s", x)
+	}
+}
+
+func (g *generator) fail(format string, a ...any) string {
+	t := g.temp()
+	g.emit("var %s eval.Object = rt.Error(%s)", t, strconv.Quote(fmt.Sprintf(format, a...)))
+	g.check(t)
+	return t
+}
+
+func (g *generator) constant(expr string) string {
+	if name, ok := g.consts[expr]; ok {
+		return name
+	}
+	name := fmt.Sprintf("k%d", len(g.constOrder)+1)
+	g.consts[expr] = name
+	g.constOrder = append(g.constOrder, fmt.Sprintf("%s eval.Object = %s", name, expr))
+	return name
+}
+
+func (g *generator) builtin(op lexer.TokenType) string {
+	if name, ok := g.builtins[op]; ok {
+		return name
+	}
+	name := "b" + camel(strings.ToLower(string(op)))
+	g.builtins[op] = name
+	return name
+}
+
+// hoistGlobals gives the names defined outside of lambdas fields.
+func (g *generator) hoistGlobals(expr parser.Expression) {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		if isBuiltin(expr.First, lexer.LAMBDA) {
+			return
+		}
+		if isBuiltin(expr.First, lexer.DEFINE) && len(expr.Rest) == 2 {
+			if name, ok := expr.Rest[0].(*parser.Identifier); ok {
+				if _, ok := g.globals[name.Value]; !ok {
+					g.globals[name.Value] = g.unique("g" + camel(name.Value))
+					g.globalOrder = append(g.globalOrder, name.Value)
+				}
+			}
+		}
+		g.hoistGlobals(expr.First)
+		for _, arg := range expr.Rest {
+			g.hoistGlobals(arg)
+		}
+	case *parser.List:
+		for _, arg := range expr.Args {
+			g.hoistGlobals(arg)
+		}
+	}
+}
+
+// export adds a method calling a procedure defined at the top level.
+func (g *generator) export(expr parser.Expression) {
+	form, ok := expr.(*parser.Form)
+	if !ok || !isBuiltin(form.First, lexer.DEFINE) || len(form.Rest) != 2 {
+		return
+	}
+	name, ok := form.Rest[0].(*parser.Identifier)
+	if !ok {
+		return
+	}
+	if lambda, ok := form.Rest[1].(*parser.Form); !ok || !isBuiltin(lambda.First, lexer.LAMBDA) {
+		return
+	}
+	method := camel(name.Value)
+	if method == "" || !unicode.IsUpper([]rune(method)[0]) || method == "Run" || method == "SetOutput" || g.exported[method] {
+		return
+	}
+	if g.exported == nil {
+		g.exported = make(map[string]bool)
+	}
+	g.exported[method] = true
+	g.emit("")
+	g.emit("// %s calls the procedure %s, which Run defines.", method, name.Value)
+	g.emit("func (p *Program) %s(args ...eval.Object) eval.Object {", method)
+	g.emit("fn := p.rt.Global(p.%s, %q)", g.globals[name.Value], name.Value)
+	g.check("fn")
+	g.emit("if !rt.Callable(fn) {")
+	g.emit("return rt.Error(%q)", "unknown procedure: "+name.Value)
+	g.emit("}")
+	g.emit("return p.rt.Call(fn, args)")
+	g.emit("}")
+}
+
+// expr emits the code computing expr and returns a Go expression for its
+// value that stays valid until more code is emitted.
+func (g *generator) expr(expr parser.Expression) string {
+	switch expr := expr.(type) {
+	case *parser.Number:
+		return g.constant(fmt.Sprintf("&eval.Number{Value: %d}", expr.Value))
+	case *parser.String:
+		return g.constant(fmt.Sprintf("&eval.String{Value: %s}", strconv.Quote(expr.Value)))
+	case *parser.Boolean:
+		return g.constant(fmt.Sprintf("&eval.Boolean{Value: %t}", expr.Value))
+	case *parser.Symbol:
+		return g.symbol(expr.Value)
+	case *parser.BuiltinIdentifier:
+		return g.builtin(expr.Token.Type)
+	case *parser.Identifier:
+		return g.identifier(expr.Value, len(g.scopes)-1)
+	case *parser.List:
+		items := make([]string, 0, len(expr.Args))
+		for _, arg := range expr.Args {
+			switch arg := arg.(type) {
+			case *parser.Identifier:
+				items = append(items, g.symbol(arg.Value))
+			case *parser.BuiltinIdentifier:
+				items = append(items, g.symbol(arg.Value))
+			default:
+				items = append(items, g.expr(arg))
+			}
+		}
+		t := g.temp()
+		g.emit("%s := &eval.List{Args: []eval.Object{%s}}", t, strings.Join(items, ", "))
+		return t
+	case *parser.Form:
+		return g.form(expr)
+	}
+	// eval.Eval returns nothing for expressions it doesn't know
+	return "nil"
+}
+
+func (g *generator) symbol(name string) string {
+	return g.constant(fmt.Sprintf("&eval.Symbol{Value: %s}", strconv.Quote(name)))
+}
+
+// identifier reads name as seen from scope index from. A name defined in the
+// body of a lambda refers to an outer variable until the definition runs.
+func (g *generator) identifier(name string, from int) string {
+	t := g.temp()
+	for i := from; i >= 0; i-- {
+		v, ok := g.scopes[i].vars[name]
+		if !ok {
+			continue
+		}
+		g.emit("%s := %s", t, v.name)
+		if !v.param {
+			g.emit("if %s == nil {", t)
+			g.emit("%s = %s", t, g.identifier(name, i-1))
+			g.emit("}")
+		}
+		return t
+	}
+	field := "nil"
+	if f, ok := g.globals[name]; ok {
+		field = "p." + f
+	}
+	g.emit("%s := p.rt.Global(%s, %q)", t, field, name)
+	g.check(t)
+	return t
+}
+
+func (g *generator) args(exprs []parser.Expression) string {
+	args := make([]string, 0, len(exprs))
+	for _, expr := range exprs {
+		args = append(args, g.expr(expr))
+	}
+	return strings.Join(args, ", ")
+}
+
+func (g *generator) form(form *parser.Form) string {
+	if head, ok := form.First.(*parser.BuiltinIdentifier); ok {
+		return g.builtinForm(head.Token.Type, form)
+	}
+	fn := g.expr(form.First)
+	g.emit("if !rt.Callable(%s) {", fn)
+	g.emit("return rt.Error(%s)", strconv.Quote(fmt.Sprintf("unknown procedure: %s", form.First)))
+	g.emit("}")
+	args := g.args(form.Rest)
+	t := g.temp()
+	g.emit("%s := p.rt.Call(%s, []eval.Object{%s})", t, fn, args)
+	g.check(t)
+	return t
+}
+
+// arities holds the number of arguments of the builtins that take a fixed
+// number of them.
+var arities = map[lexer.TokenType]int{
+	lexer.EQ:       2,
+	lexer.LT:       2,
+	lexer.LTE:      2,
+	lexer.GT:       2,
+	lexer.GTE:      2,
+	lexer.FIRST:    1,
+	lexer.REST:     1,
+	lexer.LENGTH:   1,
+	lexer.CONS:     2,
+	lexer.LIST_REF: 2,
+}
+
+func (g *generator) builtinForm(op lexer.TokenType, form *parser.Form) string {
+	n := len(form.Rest)
+	switch op {
+	case lexer.IF:
+		return g.ifForm(form)
+	case lexer.BEGIN:
+		last := "nil"
+		for i, arg := range form.Rest {
+			if i > 0 {
+				g.discard(last)
+			}
+			last = g.expr(arg)
+		}
+		return last
+	case lexer.DEFINE:
+		return g.define(form)
+	case lexer.LAMBDA:
+		return g.lambda(form)
+	case lexer.MODULE, lexer.EXPORT, lexer.IMPORT, lexer.REQUIRE, lexer.DEFTEST:
+		return g.fail("%s is not supported in generated code", strings.ToLower(string(op)))
+	case lexer.PLUS, lexer.MINUS, lexer.ASTERISK, lexer.SLASH:
+		if n == 0 {
+			return g.arityError(op, n)
+		}
+		b := g.builtin(op)
+		acc := g.temp()
+		// calling the builtin with one argument checks that it is a number
+		g.emit("%s := p.rt.Call(%s, []eval.Object{%s})", acc, b, g.expr(form.Rest[0]))
+		g.check(acc)
+		for _, arg := range form.Rest[1:] {
+			x := g.expr(arg)
+			g.emit("%s = p.rt.Arith(%s, %s, %s)", acc, b, acc, x)
+			g.check(acc)
+		}
+		return acc
+	}
+	if arity, ok := arities[op]; ok && n != arity {
+		return g.arityError(op, n)
+	}
+	args := g.args(form.Rest)
+	t := g.temp()
+	g.emit("%s := p.rt.Call(%s, []eval.Object{%s})", t, g.builtin(op), args)
+	g.check(t)
+	return t
+}
+
+// arityError fails with the error the builtin gives for n arguments, which
+// it reports before evaluating any of them.
+func (g *generator) arityError(op lexer.TokenType, n int) string {
+	err := vm.New(nil).Apply(&eval.Builtin{Value: op}, make([]eval.Object, n)).(*eval.Error)
+	return g.fail("%s", err.Message)
+}
+
+func (g *generator) ifForm(form *parser.Form) string {
+	if len(form.Rest) < 2 {
+		return g.fail("if expects 2 arguments, got %d", len(form.Rest))
+	}
+	cond := g.expr(form.Rest[0])
+	t := g.temp()
+	g.emit("var %s eval.Object", t)
+	g.emit("if rt.Truthy(%s) {", cond)
+	g.emit("%s = %s", t, g.expr(form.Rest[1]))
+	g.emit("} else {")
+	if len(form.Rest) >= 3 {
+		g.emit("%s = %s", t, g.expr(form.Rest[2]))
+	} else {
+		g.emit("%s = &eval.Nil{}", t)
+	}
+	g.emit("}")
+	return t
+}
+
+func (g *generator) define(form *parser.Form) string {
+	if len(form.Rest) != 2 {
+		return g.fail("define expects 2 arguments, got %d", len(form.Rest))
+	}
+	name, ok := form.Rest[0].(*parser.Identifier)
+	if !ok {
+		return g.fail("define expects first argument to be identifier, got %s", form.Rest[0].TokenLiteral())
+	}
+	value := g.expr(form.Rest[1])
+	target := "p." + g.globals[name.Value]
+	if len(g.scopes) > 0 {
+		target = g.scopes[len(g.scopes)-1].vars[name.Value].name
+	}
+	g.emit("%s = rt.Named(%s, %q)", target, value, name.Value)
+	t := g.temp()
+	g.emit("%s := %s", t, target)
+	return t
+}
+
+func (g *generator) lambda(form *parser.Form) string {
+	if len(form.Rest) < 2 {
+		return g.fail("lambda expects at least 2 arguments, got %d", len(form.Rest))
+	}
+	params, ok := form.Rest[0].(*parser.List)
+	if !ok {
+		return g.fail("lambda expects first argument to be a list, got %s", form.First.TokenLiteral())
+	}
+	for _, arg := range params.Args {
+		if _, ok := arg.(*parser.Identifier); !ok {
+			return g.fail("lambda args expect to be all parameters to be identifiers, got %s", arg.TokenLiteral())
+		}
+	}
+	t := g.temp()
+	g.emit("%s := &rt.Procedure{Fn: func(args []eval.Object) eval.Object {", t)
+	s := &scope{vars: make(map[string]*variable)}
+	for i, arg := range params.Args {
+		ident := arg.(*parser.Identifier)
+		// a repeated parameter is bound to the last argument given for it
+		v := &variable{name: g.unique("v" + camel(ident.Value)), param: true}
+		s.add(ident.Value, v)
+		g.emit("%s := rt.Arg(args, %d)", v.name, i)
+	}
+	for _, expr := range form.Rest[1:] {
+		g.hoistLocals(s, expr)
+	}
+	for _, v := range s.order {
+		if !v.param {
+			g.emit("var %s eval.Object", v.name)
+		}
+	}
+	for _, v := range s.order {
+		g.emit("_ = %s", v.name)
+	}
+	g.scopes = append(g.scopes, s)
+	for i, expr := range form.Rest[1:] {
+		x := g.expr(expr)
+		if i == len(form.Rest)-2 {
+			g.emit("return %s", x)
+		} else {
+			g.discard(x)
+		}
+	}
+	g.scopes = g.scopes[:len(g.scopes)-1]
+	g.emit("}}")
+	return t
+}
+
+// hoistLocals gives the names defined in the body of a lambda variables,
+// since define binds in the environment of the call wherever in the body it
+// appears.
+func (g *generator) hoistLocals(s *scope, expr parser.Expression) {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		if isBuiltin(expr.First, lexer.LAMBDA) {
+			return
+		}
+		if isBuiltin(expr.First, lexer.DEFINE) && len(expr.Rest) == 2 {
+			if name, ok := expr.Rest[0].(*parser.Identifier); ok {
+				if _, ok := s.vars[name.Value]; !ok {
+					s.add(name.Value, &variable{name: g.unique("v" + camel(name.Value))})
+				}
+			}
+		}
+		g.hoistLocals(s, expr.First)
+		for _, arg := range expr.Rest {
+			g.hoistLocals(s, arg)
+		}
+	case *parser.List:
+		for _, arg := range expr.Args {
+			g.hoistLocals(s, arg)
+		}
+	}
+}
+
+// camel turns a doma name like list-ref into a Go one like ListRef.
+func camel(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isBuiltin(expr parser.Expression, tok lexer.TokenType) bool {
+	b, ok := expr.(*parser.BuiltinIdentifier)
+	return ok && b.Token.Type == tok
+}
@@ -0,0 +1,165 @@
+package gogen
+
+import (
+	"bytes"
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var snippets = []string{
+	`(* 2 3 4) (- 5) (+ 1 "a")`,
+	`(define add (lambda '(a b) (+ a b))) (list (add 1 2) (add 1))`,
+	`(define dup (lambda '(a a) a)) (dup 1 2)`,
+	`(define adder (lambda '(n) (lambda '(m) (+ n m)))) ((adder 3) 4)`,
+	`(define y 100) (define f (lambda '() (define z y) (define y 1) (+ z y))) (f)`,
+	`(define f (lambda '(x) (define g (lambda '() x)) g)) (list (f 7) ((f 7)))`,
+	`(define f +) (f 1 2 3)`,
+	`(define d '(1 2)) (cons 0 d) d`,
+	`(first 1 2)`,
+	`(if #f 1)`,
+	`(if 1)`,
+	`(define 1 2)`,
+	`(lambda a a)`,
+	`(undefined 1)`,
+	`("a")`,
+	`(display (+ 1 "x")) (display "never")`,
+	`(printf "a\tb\n" 1)`,
+	`(define f (lambda '(n) (if (= n 0) 'done (f (- n 1))))) (f 1000)`,
+	`'(1 a "b" (+ 1 2) +)`,
+	`(begin)`,
+	`(define counter (lambda '(n) (if (> n 0) (begin (display n) (counter (- n 1))) 'liftoff))) (counter 3)`,
+}
+
+func parse(t *testing.T, src string) *parser.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parse errors: %v", p.Errors())
+	}
+	return program
+}
+
+func show(obj eval.Object) string {
+	if obj == nil {
+		return "<none>"
+	}
+	return obj.Inspect()
+}
+
+const separator = "\n--- end of program ---\n"
+
+// TestGenerate translates the examples and the snippets above to Go, runs
+// them with go run and compares their output with eval's.
+func TestGenerate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds generated code")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	files, err := filepath.Glob("../../examples/*.doma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files)+len(snippets))
+	srcs := append([]string{}, snippets...)
+	for i := range snippets {
+		names = append(names, fmt.Sprintf("snippet %d", i))
+	}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.Base(file))
+		srcs = append(srcs, string(src))
+	}
+
+	// the generated packages live in a module of their own that replaces
+	// doma with this checkout
+	dir := t.TempDir()
+	root, err := filepath.Abs("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gomod := fmt.Sprintf("module gen\n\ngo 1.23\n\nrequire doma v0.0.0\n\nreplace doma => %s\n", root)
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := os.ReadFile(filepath.Join(root, "go.sum")); err == nil {
+		if err := os.WriteFile(filepath.Join(dir, "go.sum"), sum, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var main bytes.Buffer
+	main.WriteString("package main\n\nimport (\n\"doma/pkg/eval\"\n\"fmt\"\n\"os\"\n")
+	for i := range srcs {
+		fmt.Fprintf(&main, "p%d \"gen/p%d\"\n", i, i)
+	}
+	main.WriteString(")\n\nfunc main() {\n")
+	want := make([]string, len(srcs))
+	for i, src := range srcs {
+		pkg := fmt.Sprintf("p%d", i)
+		code, err := Generate(parse(t, src), Options{Package: pkg, Source: names[i]})
+		if err != nil {
+			t.Fatalf("%s: %v", names[i], err)
+		}
+		if err := os.Mkdir(filepath.Join(dir, pkg), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, pkg, pkg+".go"), code, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&main, "{\nenv := eval.NewInterpreter(eval.WithCapabilities(eval.CapIO)).Env()\n")
+		fmt.Fprintf(&main, "p := %s.New(env)\np.SetOutput(os.Stdout)\nobj := p.Run()\n", pkg)
+		fmt.Fprintf(&main, "if obj == nil {\nfmt.Print(\"<none>\")\n} else {\nfmt.Print(obj.Inspect())\n}\nfmt.Print(%q)\n}\n", separator)
+
+		var out bytes.Buffer
+		env := eval.NewInterpreter(eval.WithOutput(&out), eval.WithCapabilities(eval.CapIO)).Env()
+		obj := eval.Eval(parse(t, src), env)
+		want[i] = out.String() + show(obj)
+	}
+	main.WriteString("}\n")
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), main.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("go run: %v\n%s", err, stderr.String())
+	}
+	got := strings.Split(string(out), separator)
+	if len(got) != len(srcs)+1 {
+		t.Fatalf("got output for %d programs, want %d:\n%s", len(got)-1, len(srcs), out)
+	}
+	for i := range srcs {
+		if got[i] != want[i] {
+			t.Errorf("%s: generated code differs\neval: %q\ngo:   %q", names[i], want[i], got[i])
+		}
+	}
+}
+
+func TestPackageNames(t *testing.T) {
+	program := parse(t, "(+ 1 2)")
+	for _, name := range []string{"", "main", "type", "func", "my-lib", "2d"} {
+		if _, err := Generate(program, Options{Package: name, Source: "a.doma"}); err == nil {
+			t.Errorf("package name %q is accepted", name)
+		}
+	}
+	if _, err := Generate(program, Options{Package: "geometry", Source: "a.doma"}); err != nil {
+		t.Error(err)
+	}
+}
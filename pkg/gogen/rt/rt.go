@@ -0,0 +1,130 @@
+// Package rt is the runtime support of the Go code generated by doma gogen.
+// Builtins behave exactly as they do in the VM, which runs them.
+package rt
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/vm"
+	"fmt"
+	"io"
+)
+
+// Procedure is a doma lambda translated to Go. It behaves like eval.Lambda,
+// or eval.Procedure once it has been defined under a name.
+type Procedure struct {
+	Name string
+	Fn   func(args []eval.Object) eval.Object
+}
+
+func (p *Procedure) Type() eval.ObjectType {
+	if p.Name != "" {
+		return eval.PROCEDURE_OBJ
+	}
+	return eval.LAMBDA_OBJ
+}
+func (p *Procedure) Inspect() string {
+	if p.Name != "" {
+		return fmt.Sprintf("#<procedure:%s>", p.Name)
+	}
+	return "#<procedure>"
+}
+
+// Runtime holds the natives and capabilities generated code runs with.
+type Runtime struct {
+	vm *vm.VM
+}
+
+// New returns a runtime for the names bound in env, usually the natives of
+// an eval.Interpreter, which honors the capabilities granted to it. env may
+// be nil.
+func New(env *eval.Env) *Runtime {
+	return &Runtime{vm: vm.New(env)}
+}
+
+// SetOutput redirects display and printf, which write to os.Stdout by default.
+func (r *Runtime) SetOutput(w io.Writer) {
+	r.vm.SetOutput(w)
+}
+
+// Global returns obj, the value of the global name in generated code, or
+// looks name up in the environment of the runtime if it hasn't been defined.
+func (r *Runtime) Global(obj eval.Object, name string) eval.Object {
+	if obj != nil {
+		return obj
+	}
+	if obj, ok := r.vm.Get(name); ok {
+		return obj
+	}
+	return Error(fmt.Sprintf("identifier not found: %s", name))
+}
+
+// Call calls callee with arguments that have already been evaluated.
+func (r *Runtime) Call(callee eval.Object, args []eval.Object) eval.Object {
+	if p, ok := callee.(*Procedure); ok {
+		return p.Fn(args)
+	}
+	return r.vm.Apply(callee, args)
+}
+
+// Arith applies an arithmetic builtin to two values.
+func (r *Runtime) Arith(b *eval.Builtin, left, right eval.Object) eval.Object {
+	if l, ok := left.(*eval.Number); ok {
+		if n, ok := right.(*eval.Number); ok {
+			switch b.Value {
+			case lexer.PLUS:
+				return &eval.Number{Value: l.Value + n.Value}
+			case lexer.MINUS:
+				return &eval.Number{Value: l.Value - n.Value}
+			case lexer.ASTERISK:
+				return &eval.Number{Value: l.Value * n.Value}
+			}
+		}
+	}
+	return r.Call(b, []eval.Object{left, right})
+}
+
+// Callable reports whether obj can be called.
+func Callable(obj eval.Object) bool {
+	switch obj.(type) {
+	case *Procedure, *eval.Native, *eval.Builtin:
+		return true
+	}
+	return false
+}
+
+// Named gives a procedure being defined its name.
+func Named(obj eval.Object, name string) eval.Object {
+	if p, ok := obj.(*Procedure); ok && p.Name == "" {
+		return &Procedure{Name: name, Fn: p.Fn}
+	}
+	return obj
+}
+
+// Arg returns argument i of a call, or nil, the doma value, when too few
+// were given.
+func Arg(args []eval.Object, i int) eval.Object {
+	if i < len(args) {
+		return args[i]
+	}
+	return &eval.Nil{}
+}
+
+func Truthy(obj eval.Object) bool {
+	if obj == nil || obj.Type() == eval.NIL_OBJ {
+		return false
+	}
+	if b, ok := obj.(*eval.Boolean); ok {
+		return b.Value
+	}
+	return true
+}
+
+func IsError(obj eval.Object) bool {
+	_, ok := obj.(*eval.Error)
+	return ok
+}
+
+func Error(message string) *eval.Error {
+	return &eval.Error{Message: message}
+}
@@ -0,0 +1,29 @@
+package lexer
+
+import "testing"
+
+func FuzzNextToken(f *testing.F) {
+	for _, seed := range []string{"", "(+ 1 -2)", "'(a \"b\" #t) 'sym", "; c\n#!x\n(<= a b)", "\"open", "#", "'", "-"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		for _, mode := range []Mode{0, ScanTrivia} {
+			l := NewWithMode(input, mode)
+			offset := -1
+			for n := 0; ; n++ {
+				if n > len(input)+1 {
+					t.Fatalf("%q: more tokens than bytes", input)
+				}
+				tok := l.NextToken()
+				if tok.Offset < offset || tok.Offset > len(input) {
+					t.Fatalf("%q: token %+v at offset %d after %d", input, tok, tok.Offset, offset)
+				}
+				offset = tok.Offset
+				if tok.Type == EOF {
+					break
+				}
+			}
+		}
+		IsComplete(input)
+	})
+}
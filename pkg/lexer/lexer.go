@@ -1,22 +1,65 @@
 package lexer
 
+import "strings"
+
 type Lexer struct {
 	input   string
 	pos     int
 	readPos int
 	ch      byte
+	line    int
+	col     int
+	mode    Mode
 }
 
+// Mode controls which tokens that don't affect evaluation are emitted.
+type Mode uint
+
+const (
+	// ScanComments emits COMMENT tokens, including a leading #! line,
+	// instead of skipping them.
+	ScanComments Mode = 1 << iota
+	// ScanTrivia emits WHITESPACE tokens as well as comments, so that the
+	// literals of consecutive tokens can be sliced out of the input.
+	ScanTrivia
+)
+
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewWithMode(input, 0)
+}
+
+func NewWithMode(input string, mode Mode) *Lexer {
+	if mode&ScanTrivia != 0 {
+		mode |= ScanComments
+	}
+	l := &Lexer{input: input, mode: mode, line: 1}
 	l.readChar()
+	if mode&ScanComments == 0 {
+		l.skipShebang()
+	}
 	return l
 }
 
 func (l *Lexer) NextToken() Token {
 	var tok Token
+	if l.mode&ScanTrivia != 0 && isWhitespace(l.ch) {
+		tok.Line, tok.Col, tok.Offset = l.line, l.col, l.pos
+		tok.Type = WHITESPACE
+		tok.Literal = l.readWhitespace()
+		return tok
+	}
 	l.skipWhitespace()
-	l.skipComments()
+	if l.mode&ScanComments != 0 {
+		if l.ch == ';' || (l.pos == 0 && l.ch == '#' && l.peekChar() == '!') {
+			tok.Line, tok.Col, tok.Offset = l.line, l.col, l.pos
+			tok.Type = COMMENT
+			tok.Literal = l.readComment()
+			return tok
+		}
+	} else {
+		l.skipComments()
+	}
+	tok.Line, tok.Col, tok.Offset = l.line, l.col, l.pos
 	switch l.ch {
 	case 0:
 		tok.Type = EOF
@@ -47,8 +90,14 @@ func (l *Lexer) NextToken() Token {
 			tok.Literal = string(l.ch)
 		}
 	case '"':
-		tok.Type = STRING
-		tok.Literal = l.readString()
+		str, ok := l.readString()
+		if ok {
+			tok.Type = STRING
+			tok.Literal = str
+		} else {
+			tok.Type = ILLEGAL
+			tok.Literal = "\"" + str
+		}
 	case '=':
 		tok.Type = EQ
 		tok.Literal = string(l.ch)
@@ -120,7 +169,7 @@ func (l *Lexer) NextToken() Token {
 	return tok
 }
 
-func (l *Lexer) readString() string {
+func (l *Lexer) readString() (string, bool) {
 	pos := l.pos + 1
 	for {
 		l.readChar()
@@ -128,7 +177,7 @@ func (l *Lexer) readString() string {
 			break
 		}
 	}
-	return l.input[pos:l.pos]
+	return l.input[pos:l.pos], l.ch == '"'
 }
 
 func (l *Lexer) readInt() string {
@@ -148,9 +197,32 @@ func (l *Lexer) readIdent() string {
 }
 
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+	for isWhitespace(l.ch) {
+		l.readChar()
+	}
+}
+
+func (l *Lexer) readWhitespace() string {
+	pos := l.pos
+	l.skipWhitespace()
+	return l.input[pos:l.pos]
+}
+
+// skipShebang ignores a leading #! line so doma files can be executable.
+func (l *Lexer) skipShebang() {
+	if l.ch == '#' && l.peekChar() == '!' {
+		for l.ch != 0 && l.ch != '\n' {
+			l.readChar()
+		}
+	}
+}
+
+func (l *Lexer) readComment() string {
+	pos := l.pos
+	for l.ch != 0 && l.ch != '\n' {
 		l.readChar()
 	}
+	return strings.TrimRight(l.input[pos:l.pos], "\r")
 }
 
 func (l *Lexer) skipComments() {
@@ -163,12 +235,17 @@ func (l *Lexer) skipComments() {
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.col = 0
+	}
+	l.col++
 	if l.readPos >= len(l.input) {
 		l.ch = 0
 	} else {
 		l.ch = l.input[l.readPos]
 	}
-	l.pos = l.readPos
+	l.pos = min(l.readPos, len(l.input))
 	l.readPos++
 }
 
@@ -186,6 +263,32 @@ func isLetter(ch byte) bool {
 		ch == '_' || ch == '-' || ch == '/'
 }
 
+func isWhitespace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
+
 func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
+
+// IsComplete reports whether input can be parsed as is, meaning every
+// parenthesis and string that was opened has been closed.
+func IsComplete(input string) bool {
+	l := New(input)
+	depth := 0
+	for {
+		tok := l.NextToken()
+		switch tok.Type {
+		case EOF:
+			return depth <= 0
+		case LPAREN:
+			depth++
+		case RPAREN:
+			depth--
+		case ILLEGAL:
+			if strings.HasPrefix(tok.Literal, "\"") {
+				return false
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package lexer
+
+import (
+	"sort"
+	"testing"
+)
+
+type token struct {
+	typ     TokenType
+	literal string
+}
+
+func scan(input string, mode Mode) []token {
+	l := NewWithMode(input, mode)
+	tokens := make([]token, 0)
+	for {
+		tok := l.NextToken()
+		tokens = append(tokens, token{tok.Type, tok.Literal})
+		if tok.Type == EOF {
+			return tokens
+		}
+	}
+}
+
+func TestNextToken(t *testing.T) {
+	tests := []struct {
+		input string
+		mode  Mode
+		want  []token
+	}{
+		{"", 0, []token{{EOF, ""}}},
+		{"()", 0, []token{{LPAREN, "("}, {RPAREN, ")"}, {EOF, ""}}},
+		{`"hello world"`, 0, []token{{STRING, "hello world"}, {EOF, ""}}},
+		{`""`, 0, []token{{STRING, ""}, {EOF, ""}}},
+		{`"open`, 0, []token{{ILLEGAL, `"open`}, {EOF, ""}}},
+		{"42 -7 0", 0, []token{{NUMBER, "42"}, {NUMBER, "-7"}, {NUMBER, "0"}, {EOF, ""}}},
+		{"foo bar_baz list/map kebab-case", 0, []token{{IDENT, "foo"}, {IDENT, "bar_baz"}, {IDENT, "list/map"}, {IDENT, "kebab-case"}, {EOF, ""}}},
+		{"#t #f true false", 0, []token{{TRUE, "#t"}, {FALSE, "#f"}, {TRUE, "true"}, {FALSE, "false"}, {EOF, ""}}},
+		{"'sym 'list-ref", 0, []token{{SYMBOL, "sym"}, {SYMBOL, "list-ref"}, {EOF, ""}}},
+		{"'(1)", 0, []token{{TICK, "'"}, {LPAREN, "("}, {NUMBER, "1"}, {RPAREN, ")"}, {EOF, ""}}},
+		{"+ - * / = < <= > >=", 0, []token{{PLUS, "+"}, {MINUS, "-"}, {ASTERISK, "*"}, {SLASH, "/"}, {EQ, "="}, {LT, "<"}, {LTE, "<="}, {GT, ">"}, {GTE, ">="}, {EOF, ""}}},
+		{"(- 1)", 0, []token{{LPAREN, "("}, {MINUS, "-"}, {NUMBER, "1"}, {RPAREN, ")"}, {EOF, ""}}},
+		{"@ #x", 0, []token{{ILLEGAL, "@"}, {ILLEGAL, ""}, {IDENT, "x"}, {EOF, ""}}},
+		{"1 ; comment\n2", 0, []token{{NUMBER, "1"}, {NUMBER, "2"}, {EOF, ""}}},
+		{"1 ; comment\n2", ScanComments, []token{{NUMBER, "1"}, {COMMENT, "; comment"}, {NUMBER, "2"}, {EOF, ""}}},
+		{"#!/usr/bin/env doma\n(f)", 0, []token{{LPAREN, "("}, {IDENT, "f"}, {RPAREN, ")"}, {EOF, ""}}},
+		{"#!/usr/bin/env doma\n1", ScanComments, []token{{COMMENT, "#!/usr/bin/env doma"}, {NUMBER, "1"}, {EOF, ""}}},
+		{" (a  b)\n", ScanTrivia, []token{{WHITESPACE, " "}, {LPAREN, "("}, {IDENT, "a"}, {WHITESPACE, "  "}, {IDENT, "b"}, {RPAREN, ")"}, {WHITESPACE, "\n"}, {EOF, ""}}},
+	}
+	for _, tt := range tests {
+		got := scan(tt.input, tt.mode)
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.input, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: token %d is %v, want %v", tt.input, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	for word, typ := range keywords {
+		got := scan(word, 0)
+		if len(got) != 2 || got[0] != (token{typ, word}) {
+			t.Errorf("%s: got %v, want %s", word, got, typ)
+		}
+	}
+	for word := range forms {
+		if got := scan(word, 0); len(got) != 2 || got[0] != (token{IDENT, word}) {
+			t.Errorf("%s: got %v, want IDENT", word, got)
+		}
+	}
+	words := Keywords()
+	if len(words) != len(keywords)+len(forms) || !sort.StringsAreSorted(words) {
+		t.Errorf("Keywords() = %v", words)
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	for _, typ := range builtins {
+		if !IsBuiltinToken(typ) {
+			t.Errorf("%s is not a builtin", typ)
+		}
+	}
+	for _, typ := range []TokenType{IDENT, NUMBER, LIST, TRUE, TICK} {
+		if IsBuiltinToken(typ) {
+			t.Errorf("%s is a builtin", typ)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	l := New("(a\n  \"b\")")
+	want := []Token{
+		{Type: LPAREN, Literal: "(", Line: 1, Col: 1, Offset: 0},
+		{Type: IDENT, Literal: "a", Line: 1, Col: 2, Offset: 1},
+		{Type: STRING, Literal: "b", Line: 2, Col: 3, Offset: 5},
+		{Type: RPAREN, Literal: ")", Line: 2, Col: 6, Offset: 8},
+		{Type: EOF, Literal: "", Line: 2, Col: 7, Offset: 9},
+	}
+	for _, w := range want {
+		if got := l.NextToken(); got != w {
+			t.Errorf("got %+v, want %+v", got, w)
+		}
+	}
+}
+
+func TestIsComplete(t *testing.T) {
+	tests := map[string]bool{
+		"":              true,
+		"(+ 1 2)":       true,
+		"(+ 1":          false,
+		"(display \"a)": false,
+		"(a))":          true,
+		"'(1 (2)":       false,
+	}
+	for input, want := range tests {
+		if got := IsComplete(input); got != want {
+			t.Errorf("IsComplete(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package lexer
 
+import "sort"
+
 type Token struct {
 	Type    TokenType
 	Literal string
+	// Line and Col are the 1-based position of the start of the token.
+	Line int
+	Col  int
+	// Offset is the byte offset of the start of the token in the input.
+	Offset int
 }
 
 type TokenType string
@@ -18,6 +25,9 @@ const (
 	TRUE    = "TRUE"
 	FALSE   = "FALSE"
 	SYMBOL  = "SYMBOL"
+	COMMENT = "COMMENT"
+	// WHITESPACE is only emitted in ScanTrivia mode.
+	WHITESPACE = "WHITESPACE"
 
 	PLUS     = "PLUS"
 	MINUS    = "MINUS"
@@ -42,6 +52,14 @@ const (
 	LENGTH   = "LENGTH"
 	LIST_REF = "LIST_REF"
 	BEGIN    = "BEGIN"
+
+	// The forms below are identifiers except at the head of a form, see
+	// LookupForm.
+	MODULE  = "MODULE"
+	EXPORT  = "EXPORT"
+	IMPORT  = "IMPORT"
+	REQUIRE = "REQUIRE"
+	DEFTEST = "DEFTEST"
 )
 
 var keywords = map[string]TokenType{
@@ -62,6 +80,16 @@ var keywords = map[string]TokenType{
 	"begin":    BEGIN,
 }
 
+// forms are only special at the head of a form, so programs can still use
+// their names as variables.
+var forms = map[string]TokenType{
+	"module":  MODULE,
+	"export":  EXPORT,
+	"import":  IMPORT,
+	"require": REQUIRE,
+	"deftest": DEFTEST,
+}
+
 func lookupIdent(ident string) TokenType {
 	if tok, ok := keywords[ident]; ok {
 		return tok
@@ -69,6 +97,13 @@ func lookupIdent(ident string) TokenType {
 	return IDENT
 }
 
+// LookupForm returns the builtin an identifier names when it is the first
+// element of a form, such as import in (import "lib.doma").
+func LookupForm(ident string) (TokenType, bool) {
+	tok, ok := forms[ident]
+	return tok, ok
+}
+
 var builtins = []TokenType{
 	PLUS,
 	MINUS,
@@ -90,6 +125,11 @@ var builtins = []TokenType{
 	CONS,
 	LIST_REF,
 	BEGIN,
+	MODULE,
+	EXPORT,
+	IMPORT,
+	REQUIRE,
+	DEFTEST,
 }
 
 func IsBuiltinToken(token TokenType) bool {
@@ -100,3 +140,17 @@ func IsBuiltinToken(token TokenType) bool {
 	}
 	return false
 }
+
+// Keywords lists the reserved words and the names of the forms recognised
+// by LookupForm.
+func Keywords() []string {
+	words := make([]string, 0, len(keywords)+len(forms))
+	for word := range keywords {
+		words = append(words, word)
+	}
+	for word := range forms {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	return words
+}
@@ -0,0 +1,359 @@
+package lsp
+
+import (
+	"doma/pkg/check"
+	"doma/pkg/eval"
+	"doma/pkg/format"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// document is an open file along with what the parser and checker found in
+// it. It is rebuilt on every change.
+type document struct {
+	uri     string
+	text    string
+	lines   []string
+	env     *eval.Env
+	program *parser.Program
+	syntax  []parser.SyntaxError
+	result  *check.Result
+}
+
+func newDocument(uri string, text string, env *eval.Env) *document {
+	p := parser.New(lexer.New(text))
+	program := p.ParseProgram()
+	return &document{
+		uri:     uri,
+		text:    text,
+		lines:   strings.Split(text, "\n"),
+		env:     env,
+		program: program,
+		syntax:  p.SyntaxErrors(),
+		result:  check.Analyze(program, env),
+	}
+}
+
+// toPosition converts a 1-based line and byte column into an LSP position,
+// whose character offset counts UTF-16 code units.
+func (d *document) toPosition(line int, col int) position {
+	if line < 1 || line > len(d.lines) {
+		return position{Line: max(line-1, 0)}
+	}
+	text := d.lines[line-1]
+	col = min(max(col-1, 0), len(text))
+	return position{Line: line - 1, Character: utf16Len(text[:col])}
+}
+
+// fromPosition is the inverse of toPosition.
+func (d *document) fromPosition(pos position) (int, int) {
+	if pos.Line < 0 || pos.Line >= len(d.lines) {
+		return pos.Line + 1, 1
+	}
+	text := d.lines[pos.Line]
+	units := 0
+	for i, r := range text {
+		if units >= pos.Character {
+			return pos.Line + 1, i + 1
+		}
+		units += utf16Len(string(r))
+	}
+	return pos.Line + 1, len(text) + 1
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *document) tokenRange(tok lexer.Token, length int) lspRange {
+	return lspRange{
+		Start: d.toPosition(tok.Line, tok.Col),
+		End:   d.toPosition(tok.Line, tok.Col+length),
+	}
+}
+
+// wordLength returns the length of the token starting at line and col.
+func (d *document) wordLength(line int, col int) int {
+	if line < 1 || line > len(d.lines) || col < 1 || col > len(d.lines[line-1]) {
+		return 0
+	}
+	text := d.lines[line-1][col-1:]
+	if text[0] == '(' || text[0] == ')' {
+		return 1
+	}
+	n := strings.IndexAny(text, " \t\r()")
+	if n < 0 {
+		return len(text)
+	}
+	return max(n, 1)
+}
+
+func (d *document) diagnostics() []diagnostic {
+	diags := make([]diagnostic, 0)
+	for _, err := range d.syntax {
+		diags = append(diags, diagnostic{
+			Range:    d.tokenRange(err.Token, max(len(err.Token.Literal), 1)),
+			Severity: severityError,
+			Source:   "doma",
+			Message:  err.Message,
+		})
+	}
+	if len(d.syntax) > 0 {
+		// the checker only adds noise while the source doesn't parse
+		return diags
+	}
+	for _, diag := range d.result.Diagnostics {
+		severity := severityError
+		if diag.Severity == check.Warning {
+			severity = severityWarning
+		}
+		tok := lexer.Token{Line: diag.Line, Col: diag.Col}
+		diags = append(diags, diagnostic{
+			Range:    d.tokenRange(tok, d.wordLength(diag.Line, diag.Col)),
+			Severity: severity,
+			Source:   "doma check",
+			Message:  diag.Message,
+		})
+	}
+	return diags
+}
+
+func walk(expr parser.Expression, fn func(parser.Expression)) {
+	if expr == nil {
+		return
+	}
+	fn(expr)
+	switch expr := expr.(type) {
+	case *parser.Program:
+		for _, arg := range expr.Args {
+			walk(arg, fn)
+		}
+	case *parser.Form:
+		walk(expr.First, fn)
+		for _, arg := range expr.Rest {
+			walk(arg, fn)
+		}
+	case *parser.List:
+		for _, arg := range expr.Args {
+			walk(arg, fn)
+		}
+	}
+}
+
+// nameAt returns the identifier or builtin under pos, if any.
+func (d *document) nameAt(pos position) parser.Expression {
+	line, col := d.fromPosition(pos)
+	var found parser.Expression
+	walk(d.program, func(expr parser.Expression) {
+		var tok lexer.Token
+		switch expr := expr.(type) {
+		case *parser.Identifier:
+			tok = expr.Token
+		case *parser.BuiltinIdentifier:
+			tok = expr.Token
+		default:
+			return
+		}
+		if tok.Line == line && tok.Col <= col && col <= tok.Col+len(tok.Literal) {
+			found = expr
+		}
+	})
+	return found
+}
+
+// bindingAt returns the binding that the identifier under pos refers to or
+// introduces.
+func (d *document) bindingAt(pos position) (*check.Binding, *parser.Identifier) {
+	ident, ok := d.nameAt(pos).(*parser.Identifier)
+	if !ok {
+		return nil, nil
+	}
+	if b, ok := d.result.Uses[ident]; ok {
+		return b, ident
+	}
+	for _, b := range d.result.Bindings {
+		if b.Token.Line == ident.Token.Line && b.Token.Col == ident.Token.Col {
+			return b, ident
+		}
+	}
+	return nil, ident
+}
+
+func (d *document) location(tok lexer.Token) location {
+	return location{URI: d.uri, Range: d.tokenRange(tok, len(tok.Literal))}
+}
+
+func (d *document) definition(pos position) []location {
+	b, _ := d.bindingAt(pos)
+	if b == nil || b.Token.Line == 0 {
+		return nil
+	}
+	return []location{d.location(b.Token)}
+}
+
+func (d *document) references(pos position) []location {
+	b, _ := d.bindingAt(pos)
+	if b == nil {
+		return nil
+	}
+	locs := make([]location, 0, len(b.Refs)+1)
+	if b.Token.Line > 0 {
+		locs = append(locs, d.location(b.Token))
+	}
+	for _, ref := range b.Refs {
+		locs = append(locs, d.location(ref.Token))
+	}
+	return locs
+}
+
+func (d *document) hover(pos position) *hover {
+	var signature, doc string
+	var tok lexer.Token
+	switch expr := d.nameAt(pos).(type) {
+	case *parser.BuiltinIdentifier:
+		tok = expr.Token
+		signature = expr.Value
+		doc = eval.Doc(&eval.Builtin{Value: expr.Token.Type})
+	case *parser.Identifier:
+		tok = expr.Token
+		b, _ := d.bindingAt(pos)
+		if b == nil {
+			return nil
+		}
+		signature, doc = d.describe(b)
+	default:
+		return nil
+	}
+	value := "```doma\n" + signature + "\n```"
+	if doc != "" {
+		value += "\n\n" + doc
+	}
+	r := d.tokenRange(tok, len(tok.Literal))
+	return &hover{Contents: markupContent{Kind: "markdown", Value: value}, Range: &r}
+}
+
+// describe returns a signature and the documentation for a binding.
+func (d *document) describe(b *check.Binding) (string, string) {
+	if b.Token.Line == 0 {
+		obj, ok := d.env.Get(b.Name)
+		if !ok {
+			return b.Name, ""
+		}
+		if native, ok := obj.(*eval.Native); ok {
+			if native.Arity == eval.VARIADIC {
+				return b.Name + " ; any number of arguments", native.Doc
+			}
+			if native.Arity == 1 {
+				return b.Name + " ; 1 argument", native.Doc
+			}
+			return fmt.Sprintf("%s ; %d arguments", b.Name, native.Arity), native.Doc
+		}
+		return b.Name, eval.Doc(obj)
+	}
+	if form, ok := b.Value.(*parser.Form); ok && len(form.Rest) > 1 {
+		if params, ok := form.Rest[0].(*parser.List); ok {
+			if head, ok := form.First.(*parser.BuiltinIdentifier); ok && head.Token.Type == lexer.LAMBDA {
+				names := []string{b.Name}
+				for _, param := range params.Args {
+					names = append(names, param.String())
+				}
+				return "(" + strings.Join(names, " ") + ")", eval.Doc(&eval.Lambda{Body: form.Rest[1:]})
+			}
+		}
+	}
+	if b.Value == nil {
+		return b.Name + " ; parameter", ""
+	}
+	return b.Name, ""
+}
+
+func (d *document) completion(pos position) []completionItem {
+	seen := make(map[string]bool)
+	items := make([]completionItem, 0)
+	add := func(label string, kind int, detail string) {
+		if !seen[label] {
+			seen[label] = true
+			items = append(items, completionItem{Label: label, Kind: kind, Detail: detail})
+		}
+	}
+	for _, b := range d.result.Bindings {
+		kind := completionVariable
+		if b.Arity != eval.VARIADIC {
+			kind = completionFunction
+		}
+		signature, _ := d.describe(b)
+		add(b.Name, kind, signature)
+	}
+	if d.env != nil {
+		for _, name := range d.env.Names() {
+			obj, _ := d.env.Get(name)
+			add(name, completionFunction, eval.Doc(obj))
+		}
+	}
+	for _, word := range lexer.Keywords() {
+		add(word, completionKeyword, "")
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+func (d *document) symbols() []documentSymbol {
+	symbols := make([]documentSymbol, 0)
+	for _, expr := range d.program.Args {
+		form, ok := expr.(*parser.Form)
+		if !ok || len(form.Rest) == 0 {
+			continue
+		}
+		if head, ok := form.First.(*parser.BuiltinIdentifier); !ok || head.Token.Type != lexer.DEFINE {
+			continue
+		}
+		name, ok := form.Rest[0].(*parser.Identifier)
+		if !ok {
+			continue
+		}
+		kind := symbolVariable
+		if len(form.Rest) > 1 {
+			if value, ok := form.Rest[1].(*parser.Form); ok {
+				if head, ok := value.First.(*parser.BuiltinIdentifier); ok && head.Token.Type == lexer.LAMBDA {
+					kind = symbolFunction
+				}
+			}
+		}
+		symbols = append(symbols, documentSymbol{
+			Name: name.Value,
+			Kind: kind,
+			Range: lspRange{
+				Start: d.toPosition(form.Token.Line, form.Token.Col),
+				End:   d.toPosition(form.Close.Line, form.Close.Col+1),
+			},
+			SelectionRange: d.tokenRange(name.Token, len(name.Value)),
+		})
+	}
+	return symbols
+}
+
+func (d *document) formatting() []textEdit {
+	formatted, err := format.Source([]byte(d.text))
+	if err != nil || string(formatted) == d.text {
+		return []textEdit{}
+	}
+	last := len(d.lines)
+	return []textEdit{{
+		Range: lspRange{
+			Start: position{},
+			End:   d.toPosition(last, len(d.lines[last-1])+1),
+		},
+		NewText: string(formatted),
+	}}
+}
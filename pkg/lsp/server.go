@@ -0,0 +1,253 @@
+// Package lsp implements a Language Server Protocol server for doma. It
+// speaks JSON-RPC over a reader and writer, usually stdin and stdout, and
+// keeps the open documents in memory using full text synchronization.
+package lsp
+
+import (
+	"bufio"
+	"doma/pkg/eval"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrNoShutdown is returned by Serve when the client asked the server to
+// exit without shutting it down first.
+var ErrNoShutdown = errors.New("exit before shutdown")
+
+type Server struct {
+	in       *bufio.Reader
+	out      io.Writer
+	env      *eval.Env
+	docs     map[string]*document
+	shutdown bool
+}
+
+// NewServer returns a server that reads requests from in and writes
+// responses to out. Names bound in env, usually the natives of an
+// eval.Interpreter, are offered for completion and hover.
+func NewServer(in io.Reader, out io.Writer, env *eval.Env) *Server {
+	return &Server{
+		in:   bufio.NewReader(in),
+		out:  out,
+		env:  env,
+		docs: make(map[string]*document),
+	}
+}
+
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  any              `json:"result,omitempty"`
+	Error   *responseError   `json:"error,omitempty"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	codeParseError     = -32700
+	codeInvalidParams  = -32602
+	codeMethodNotFound = -32601
+	codeInvalidRequest = -32600
+)
+
+// Serve handles messages until the client sends exit or the input ends.
+func (s *Server) Serve() error {
+	for {
+		body, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			s.reply(nil, nil, &responseError{Code: codeParseError, Message: err.Error()})
+			continue
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return ErrNoShutdown
+			}
+			return nil
+		}
+		result, rerr := s.handle(msg.Method, msg.Params)
+		if msg.ID != nil {
+			s.reply(msg.ID, result, rerr)
+		}
+	}
+}
+
+func (s *Server) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length: %s", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("missing Content-Length header")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.in, body)
+	return body, err
+}
+
+func (s *Server) write(msg message) {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *Server) reply(id *json.RawMessage, result any, rerr *responseError) {
+	if id == nil {
+		null := json.RawMessage("null")
+		id = &null
+	}
+	msg := message{ID: id, Error: rerr}
+	if rerr == nil {
+		// a null result still has to be sent
+		if result == nil {
+			result = json.RawMessage("null")
+		}
+		msg.Result = result
+	}
+	s.write(msg)
+}
+
+func (s *Server) notify(method string, params any) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	s.write(message{Method: method, Params: raw})
+}
+
+func (s *Server) handle(method string, raw json.RawMessage) (any, *responseError) {
+	if s.shutdown && method != "exit" {
+		return nil, &responseError{Code: codeInvalidRequest, Message: "server is shut down"}
+	}
+	switch method {
+	case "initialize":
+		return initializeResult{
+			Capabilities: capabilities{
+				TextDocumentSync:           1,
+				DefinitionProvider:         true,
+				ReferencesProvider:         true,
+				HoverProvider:              true,
+				CompletionProvider:         &struct{}{},
+				DocumentSymbolProvider:     true,
+				DocumentFormattingProvider: true,
+			},
+			ServerInfo: serverInfo{Name: "doma"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		s.open(params.TextDocument.URI, params.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.open(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params textDocumentParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.docs, params.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         params.TextDocument.URI,
+			Diagnostics: []diagnostic{},
+		})
+		return nil, nil
+	case "textDocument/definition":
+		return withPosition(s, raw, (*document).definition)
+	case "textDocument/references":
+		return withPosition(s, raw, (*document).references)
+	case "textDocument/hover":
+		return withPosition(s, raw, (*document).hover)
+	case "textDocument/completion":
+		return withPosition(s, raw, (*document).completion)
+	case "textDocument/documentSymbol":
+		var params textDocumentParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if doc, ok := s.docs[params.TextDocument.URI]; ok {
+			return doc.symbols(), nil
+		}
+		return nil, nil
+	case "textDocument/formatting":
+		var params textDocumentParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if doc, ok := s.docs[params.TextDocument.URI]; ok {
+			return doc.formatting(), nil
+		}
+		return nil, nil
+	case "initialized", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration":
+		return nil, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: "method not found: " + method}
+}
+
+func withPosition[T any](s *Server, raw json.RawMessage, fn func(*document, position) T) (any, *responseError) {
+	var params textDocumentPositionParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, invalidParams(err)
+	}
+	doc, ok := s.docs[params.TextDocument.URI]
+	if !ok {
+		return nil, nil
+	}
+	return fn(doc, params.Position), nil
+}
+
+func invalidParams(err error) *responseError {
+	return &responseError{Code: codeInvalidParams, Message: err.Error()}
+}
+
+func (s *Server) open(uri string, text string) {
+	doc := newDocument(uri, text, s.env)
+	s.docs[uri] = doc
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+		URI:         uri,
+		Diagnostics: doc.diagnostics(),
+	})
+}
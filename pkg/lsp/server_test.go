@@ -0,0 +1,163 @@
+package lsp
+
+import (
+	"bufio"
+	"doma/pkg/eval"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// client drives a Server over in-memory pipes.
+type client struct {
+	t    *testing.T
+	in   io.Writer
+	out  *bufio.Reader
+	next int
+}
+
+type response struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+func newClient(t *testing.T) (*client, chan error) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := NewServer(inR, outW, eval.NewInterpreter().Env()).Serve()
+		outW.Close()
+		done <- err
+	}()
+	t.Cleanup(func() { inW.Close() })
+	return &client{t: t, in: inW, out: bufio.NewReader(outR)}, done
+}
+
+func (c *client) send(method string, params any, request bool) {
+	c.t.Helper()
+	msg := map[string]any{"jsonrpc": "2.0", "method": method, "params": params}
+	if request {
+		c.next++
+		msg["id"] = c.next
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (c *client) receive() response {
+	c.t.Helper()
+	length := -1
+	for {
+		line, err := c.out.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if value, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+			length, _ = strconv.Atoi(value)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.out, body); err != nil {
+		c.t.Fatal(err)
+	}
+	var resp response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		c.t.Fatalf("%s: %v", body, err)
+	}
+	return resp
+}
+
+// call sends a request and returns the result of its response.
+func (c *client) call(method string, params any) string {
+	c.t.Helper()
+	c.send(method, params, true)
+	resp := c.receive()
+	if resp.ID == nil || *resp.ID != c.next {
+		c.t.Fatalf("%s: got %+v, want the response to request %d", method, resp, c.next)
+	}
+	if resp.Error != nil {
+		c.t.Fatalf("%s: %s", method, resp.Error.Message)
+	}
+	return string(resp.Result)
+}
+
+func at(line, char int) map[string]any {
+	return map[string]any{
+		"textDocument": map[string]any{"uri": "file:///a.doma"},
+		"position":     map[string]any{"line": line, "character": char},
+	}
+}
+
+func TestSession(t *testing.T) {
+	c, done := newClient(t)
+	if got := c.call("initialize", map[string]any{}); !strings.Contains(got, `"hoverProvider":true`) || !strings.Contains(got, `"name":"doma"`) {
+		t.Errorf("initialize: %s", got)
+	}
+	c.send("initialized", map[string]any{}, false)
+
+	src := "(define square (lambda '(x) (* x x)))\n(display (square 2)  y)\n"
+	c.send("textDocument/didOpen", map[string]any{
+		"textDocument": map[string]any{"uri": "file:///a.doma", "languageId": "doma", "version": 1, "text": src},
+	}, false)
+	diags := c.receive()
+	if diags.Method != "textDocument/publishDiagnostics" {
+		t.Fatalf("got %+v after didOpen", diags)
+	}
+	for _, want := range []string{`"line":1,"character":21`, `"message":"undefined: y"`} {
+		if !strings.Contains(string(diags.Params), want) {
+			t.Errorf("diagnostics %s don't contain %s", diags.Params, want)
+		}
+	}
+
+	tests := []struct {
+		method string
+		params any
+		want   string
+	}{
+		{"textDocument/hover", at(1, 11), "{\"contents\":{\"kind\":\"markdown\",\"value\":\"```doma\\n(square x)\\n```\"},\"range\":{\"start\":{\"line\":1,\"character\":10},\"end\":{\"line\":1,\"character\":16}}}"},
+		{"textDocument/hover", at(0, 1), "{\"contents\":{\"kind\":\"markdown\",\"value\":\"```doma\\ndefine\\n```\\n\\n(define name value) binds value to name in the current environment\"},\"range\":{\"start\":{\"line\":0,\"character\":1},\"end\":{\"line\":0,\"character\":7}}}"},
+		{"textDocument/hover", at(1, 17), "null"},
+		{"textDocument/definition", at(1, 11), `[{"uri":"file:///a.doma","range":{"start":{"line":0,"character":8},"end":{"line":0,"character":14}}}]`},
+		{"textDocument/references", at(0, 9), `[{"uri":"file:///a.doma","range":{"start":{"line":0,"character":8},"end":{"line":0,"character":14}}},{"uri":"file:///a.doma","range":{"start":{"line":1,"character":10},"end":{"line":1,"character":16}}}]`},
+		{"textDocument/formatting", map[string]any{"textDocument": map[string]any{"uri": "file:///a.doma"}}, `[{"range":{"start":{"line":0,"character":0},"end":{"line":2,"character":0}},"newText":"(define square (lambda '(x) (* x x)))\n(display (square 2) y)\n"}]`},
+	}
+	for _, tt := range tests {
+		if got := c.call(tt.method, tt.params); got != tt.want {
+			t.Errorf("%s %v:\ngot:  %s\nwant: %s", tt.method, tt.params, got, tt.want)
+		}
+	}
+
+	if got := c.call("shutdown", nil); got != "null" {
+		t.Errorf("shutdown: %s", got)
+	}
+	c.send("textDocument/hover", at(0, 1), true)
+	if resp := c.receive(); resp.Error == nil || resp.Error.Message != "server is shut down" {
+		t.Errorf("request after shutdown: %+v", resp)
+	}
+	c.send("exit", nil, false)
+	if err := <-done; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	c, done := newClient(t)
+	c.send("exit", nil, false)
+	if err := <-done; err != ErrNoShutdown {
+		t.Errorf("Serve: %v", err)
+	}
+}
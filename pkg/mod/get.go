@@ -0,0 +1,340 @@
+package mod
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Project is a directory with a doma.mod, opened to change what it requires.
+// Changes are only saved by Save.
+type Project struct {
+	Dir      string
+	Manifest *Manifest
+	Sum      Sum
+}
+
+// Open loads the project in dir.
+func Open(dir string) (*Project, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := ReadSum(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Project{Dir: dir, Manifest: m, Sum: sum}, nil
+}
+
+// Init returns a new project in dir named module.
+func Init(dir, module string) *Project {
+	return &Project{Dir: dir, Manifest: &Manifest{Module: module}, Sum: make(Sum)}
+}
+
+// Save writes doma.mod and doma.sum.
+func (p *Project) Save() error {
+	if err := p.Manifest.Write(p.Dir); err != nil {
+		return err
+	}
+	return p.Sum.Write(p.Dir)
+}
+
+func (p *Project) vendorDir() string {
+	return filepath.Join(p.Dir, VendorDir)
+}
+
+// Get vendors the package at source, checked out at version if it is a git
+// repository, along with the packages it requires, and adds it to the
+// manifest in place of any requirement with the same name. A relative
+// source is relative to the working directory and is recorded relative to
+// the project. If name is empty the package is named by the module of its
+// doma.mod, or else by the last element of source.
+func (p *Project) Get(source, version, name string) (*Requirement, error) {
+	if isLocal(source) {
+		abs, err := filepath.Abs(source)
+		if err != nil {
+			return nil, err
+		}
+		if rel, err := filepath.Rel(p.Dir, abs); err == nil {
+			source = filepath.ToSlash(rel)
+		} else {
+			source = abs
+		}
+	}
+	v := &vendorer{p: p, seen: make(map[string]string)}
+	name, err := v.vendor(Requirement{Name: name, Source: source, Version: version}, p.Dir)
+	if err != nil {
+		return nil, err
+	}
+	req := Requirement{Name: name, Source: source, Version: version}
+	for i, r := range p.Manifest.Require {
+		if r.Name == name {
+			p.Manifest.Require[i] = req
+			return &req, nil
+		}
+	}
+	p.Manifest.Require = append(p.Manifest.Require, req)
+	return &req, nil
+}
+
+// Sync vendors every package the manifest requires, at the version recorded
+// in doma.sum if there is one, and fails if the files of a package differ
+// from its recorded hash. Packages that are no longer required are removed.
+func (p *Project) Sync() error {
+	v := &vendorer{p: p, locked: true, seen: make(map[string]string)}
+	for _, req := range p.Manifest.Require {
+		if _, err := v.vendor(req, p.Dir); err != nil {
+			return err
+		}
+	}
+	for name := range p.Sum {
+		if _, ok := v.seen[name]; !ok {
+			delete(p.Sum, name)
+			if err := os.RemoveAll(filepath.Join(p.vendorDir(), name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Verify checks that the vendor directory holds exactly the packages in
+// doma.sum, with the files they had when they were vendored.
+func (p *Project) Verify() error {
+	var errs []error
+	for _, req := range p.Manifest.Require {
+		if _, ok := p.Sum[req.Name]; !ok {
+			errs = append(errs, fmt.Errorf("%s: missing from %s", req.Name, SumFile))
+		}
+	}
+	names := make([]string, 0, len(p.Sum))
+	for name := range p.Sum {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hash, err := Hash(filepath.Join(p.vendorDir(), name))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			errs = append(errs, fmt.Errorf("%s: not vendored", name))
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		case hash != p.Sum[name].Hash:
+			errs = append(errs, fmt.Errorf("%s: vendored files differ from %s", name, SumFile))
+		}
+	}
+	entries, err := os.ReadDir(p.vendorDir())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	for _, entry := range entries {
+		if _, ok := p.Sum[entry.Name()]; !ok {
+			errs = append(errs, fmt.Errorf("%s: vendored but not in %s", entry.Name(), SumFile))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type vendorer struct {
+	p *Project
+	// locked checks out the versions in doma.sum and checks the hashes.
+	locked bool
+	// seen maps the packages vendored so far to their sources.
+	seen map[string]string
+}
+
+// vendor copies the package req names into the vendor directory, followed
+// by the ones it requires, and returns its name. Relative local sources are
+// relative to base.
+func (v *vendorer) vendor(req Requirement, base string) (string, error) {
+	source := req.Source
+	if isLocal(source) && !filepath.IsAbs(source) {
+		if base == "" {
+			return "", fmt.Errorf("%s: relative source in a remote package", source)
+		}
+		source = filepath.Join(base, filepath.FromSlash(source))
+	}
+	version := req.Version
+	if sum, ok := v.p.Sum[req.Name]; v.locked && ok && sum.Version != "-" {
+		version = sum.Version
+	}
+	if err := os.MkdirAll(v.p.vendorDir(), 0o755); err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(v.p.vendorDir(), ".get-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	pkg := filepath.Join(staging, "pkg")
+	rev, err := fetch(source, version, staging, pkg)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", req.Source, err)
+	}
+
+	name := req.Name
+	if name == "" {
+		name = packageName(pkg, source)
+	}
+	if !validName(name) {
+		return "", fmt.Errorf("%s: invalid package name %q", req.Source, name)
+	}
+	if prev, ok := v.seen[name]; ok {
+		if prev != source {
+			return "", fmt.Errorf("%s is required from both %s and %s", name, prev, source)
+		}
+		return name, nil
+	}
+	v.seen[name] = source
+	hash, err := Hash(pkg)
+	if err != nil {
+		return "", err
+	}
+	if sum, ok := v.p.Sum[name]; v.locked && ok && sum.Hash != hash {
+		return "", fmt.Errorf("checksum mismatch for %s: %s has %s, got %s", name, SumFile, sum.Hash, hash)
+	}
+	dst := filepath.Join(v.p.vendorDir(), name)
+	if err := os.RemoveAll(dst); err != nil {
+		return "", err
+	}
+	if err := os.Rename(pkg, dst); err != nil {
+		return "", err
+	}
+	v.p.Sum[name] = Checksum{Version: rev, Hash: hash}
+
+	deps, err := ReadManifest(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return name, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !isLocal(source) {
+		source = ""
+	}
+	for _, dep := range deps.Require {
+		if _, err := v.vendor(dep, source); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// fetch copies the files of the package at source into dst and returns the
+// commit it was checked out at, or "-" if it isn't a git repository.
+func fetch(source, version, staging, dst string) (string, error) {
+	if !isGit(source, version) {
+		info, err := os.Stat(source)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("not a directory")
+		}
+		return "-", copyTree(source, dst)
+	}
+	if strings.HasPrefix(version, "-") {
+		return "", fmt.Errorf("invalid version %q", version)
+	}
+	repo := filepath.Join(staging, "repo")
+	if _, err := git("clone", "--quiet", "--", source, repo); err != nil {
+		return "", err
+	}
+	if version != "" {
+		if _, err := git("-C", repo, "checkout", "--quiet", version, "--"); err != nil {
+			return "", err
+		}
+	}
+	rev, err := git("-C", repo, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return rev, copyTree(repo, dst)
+}
+
+func git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// copyTree copies the files of a package, leaving out version control data
+// and the packages it has vendored itself.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir() && (d.Name() == ".git" || rel == VendorDir):
+			return filepath.SkipDir
+		case d.IsDir():
+			return os.MkdirAll(filepath.Join(dst, rel), 0o755)
+		case !d.Type().IsRegular():
+			return fmt.Errorf("%s is not a regular file", filepath.ToSlash(rel))
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0o644)
+	})
+}
+
+// isLocal reports whether source is a path rather than a URL.
+func isLocal(source string) bool {
+	if strings.Contains(source, "://") {
+		return false
+	}
+	// scp-like syntax such as git@host:repo.git
+	at, colon := strings.Index(source, "@"), strings.Index(source, ":")
+	return at < 0 || colon < at
+}
+
+func isGit(source, version string) bool {
+	if version != "" || !isLocal(source) || strings.HasSuffix(source, ".git") {
+		return true
+	}
+	// a bare repository
+	_, head := os.Stat(filepath.Join(source, "HEAD"))
+	_, objects := os.Stat(filepath.Join(source, "objects"))
+	return head == nil && objects == nil
+}
+
+func packageName(dir, source string) string {
+	if m, err := ReadManifest(dir); err == nil && m.Module != "" {
+		return m.Module
+	}
+	return strings.TrimSuffix(path.Base(filepath.ToSlash(strings.TrimRight(source, "/"))), ".git")
+}
+
+// validName reports whether name can be required, which needs it to be an
+// identifier without slashes.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if !('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' || ch == '-') {
+			return false
+		}
+	}
+	return true
+}
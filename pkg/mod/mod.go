@@ -0,0 +1,159 @@
+// Package mod manages the packages a doma project depends on. A project is a
+// directory with a doma.mod manifest listing its requirements. They are
+// copied into its vendor directory, where the module loader finds them, and
+// doma.sum records the version and content hash of each so that the same
+// code is vendored every time. Sources are local directories or git
+// repositories, so nothing needs the network.
+package mod
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"doma/pkg/config"
+	"doma/pkg/format"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	ManifestFile = "doma.mod"
+	SumFile      = "doma.sum"
+	VendorDir    = "vendor"
+)
+
+// Manifest is the content of doma.mod, which is a doma config file.
+type Manifest struct {
+	Module  string        `doma:"module"`
+	Require []Requirement `doma:"require,omitempty"`
+}
+
+// Requirement is a package a project depends on. Source is a directory or a
+// git repository, relative paths being relative to the project. Version is
+// the git revision to check out, the default branch when empty.
+type Requirement struct {
+	Name    string `doma:"name"`
+	Source  string `doma:"source"`
+	Version string `doma:"version,omitempty"`
+}
+
+// Find returns the project dir belongs to, the closest directory at or
+// above it that has a doma.mod.
+func Find(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		if info, err := os.Stat(filepath.Join(dir, ManifestFile)); err == nil && !info.IsDir() {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// ReadManifest reads the doma.mod in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	m := &Manifest{}
+	if err := config.Load(filepath.Join(dir, ManifestFile), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Write saves m as the doma.mod in dir.
+func (m *Manifest) Write(dir string) error {
+	data, err := config.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if data, err = format.Source(data); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), data, 0o644)
+}
+
+// Checksum is what doma.sum records about a vendored package: the git
+// commit it was checked out at, or "-" for a directory, and the hash of
+// its files.
+type Checksum struct {
+	Version string
+	Hash    string
+}
+
+// Sum is the content of doma.sum, which has a line with the name, version
+// and hash of every vendored package.
+type Sum map[string]Checksum
+
+// ReadSum reads the doma.sum in dir, which is empty when there is none.
+func ReadSum(dir string) (Sum, error) {
+	sum := make(Sum)
+	f, err := os.Open(filepath.Join(dir, SumFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return sum, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed line", SumFile, line)
+		}
+		sum[fields[0]] = Checksum{Version: fields[1], Hash: fields[2]}
+	}
+	return sum, scanner.Err()
+}
+
+// Write saves s as the doma.sum in dir, sorted by name.
+func (s Sum) Write(dir string) error {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s %s %s\n", name, s[name].Version, s[name].Hash)
+	}
+	return os.WriteFile(filepath.Join(dir, SumFile), []byte(b.String()), 0o644)
+}
+
+// Hash returns the hash of the files in dir, which covers their paths and
+// contents.
+func Hash(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%x  %s\n", sha256.Sum256(data), filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,140 @@
+package mod
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func write(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetSyncVerify(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "geometry", "geometry.doma"), "(define area (lambda '(w h) (* w h)))\n")
+	write(t, filepath.Join(dir, "geometry", ManifestFile), "'('('module \"geometry\") '('require '('('('source \"../strings\")))))\n")
+	write(t, filepath.Join(dir, "strings", "strings.doma"), "(define shout (lambda '(s) s))\n")
+	write(t, filepath.Join(dir, "strings", ".git", "HEAD"), "ignored\n")
+	app := filepath.Join(dir, "app")
+	if err := os.Mkdir(app, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Init(app, "app")
+	req, err := p.Get(filepath.Join(dir, "geometry"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Name != "geometry" || req.Source != "../geometry" {
+		t.Errorf("got requirement %+v", req)
+	}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"geometry/geometry.doma", "strings/strings.doma"} {
+		if _, err := os.Stat(filepath.Join(app, VendorDir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(app, VendorDir, "strings", ".git")); err == nil {
+		t.Error(".git was vendored")
+	}
+
+	p, err = Open(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Manifest.Require) != 1 || len(p.Sum) != 2 {
+		t.Fatalf("got manifest %+v and sum %+v", p.Manifest, p.Sum)
+	}
+	if err := p.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, filepath.Join(app, VendorDir, "strings", "strings.doma"), "(define shout 1)\n")
+	if err := p.Verify(); err == nil || !strings.Contains(err.Error(), "strings: vendored files differ") {
+		t.Errorf("Verify after editing a vendored file: %v", err)
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(); err != nil {
+		t.Errorf("Verify after Sync: %v", err)
+	}
+
+	write(t, filepath.Join(dir, "geometry", "geometry.doma"), "(define area 0)\n")
+	if err := p.Sync(); err == nil || !strings.Contains(err.Error(), "checksum mismatch for geometry") {
+		t.Errorf("Sync after changing a source: %v", err)
+	}
+}
+
+func TestGetGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "strings")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=doma", "-c", "user.email=doma@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write(t, filepath.Join(repo, "strings.doma"), "(define v 1)\n")
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-qm", "one")
+	git("tag", "v1")
+	first := git("rev-parse", "HEAD")
+	write(t, filepath.Join(repo, "strings.doma"), "(define v 2)\n")
+	git("commit", "-qam", "two")
+
+	p := Init(filepath.Join(dir, "app"), "app")
+	if err := os.Mkdir(p.Dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get(repo, "v1", "str"); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Sum["str"].Version; got != first {
+		t.Errorf("vendored commit %s, want %s", got, first)
+	}
+	data, err := os.ReadFile(filepath.Join(p.Dir, VendorDir, "str", "strings.doma"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "(define v 1)\n" {
+		t.Errorf("vendored %q", data)
+	}
+}
+
+func TestSumRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	sum := Sum{"b": {Version: "-", Hash: "sha256:00"}, "a": {Version: "abc", Hash: "sha256:11"}}
+	if err := sum.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, SumFile))
+	if want := "a abc sha256:11\nb - sha256:00\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	got, err := ReadSum(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["a"] != sum["a"] || got["b"] != sum["b"] {
+		t.Errorf("got %v, want %v", got, sum)
+	}
+}
@@ -0,0 +1,300 @@
+// Package optimize rewrites doma programs into equivalent ones that do less
+// work when run: builtin calls on literals are folded to their value, if
+// forms with a literal condition are replaced by the branch taken, and calls
+// to small global procedures are inlined.
+package optimize
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"fmt"
+)
+
+// maxInline is the largest number of nodes in the body of a procedure that
+// gets inlined.
+const maxInline = 24
+
+// Program optimizes program in place and returns it. The result behaves like
+// the original when run as a whole, so it shouldn't be used for code whose
+// globals may be redefined later on, as in the REPL.
+func Program(program *parser.Program) *parser.Program {
+	o := &optimizer{env: eval.NewEnv(), bindings: make(map[string]int), inline: make(map[string]*procedure)}
+	for _, expr := range program.Args {
+		o.count(expr)
+	}
+	for i, expr := range program.Args {
+		program.Args[i] = o.expr(expr)
+		o.define(program.Args[i])
+	}
+	return program
+}
+
+type optimizer struct {
+	// env folds builtin calls. They don't depend on any bindings.
+	env *eval.Env
+	// bindings counts the definitions and parameters named by each name.
+	bindings map[string]int
+	// inline holds the global procedures defined so far that can be inlined.
+	inline map[string]*procedure
+}
+
+type procedure struct {
+	params []string
+	body   parser.Expression
+}
+
+func (o *optimizer) count(expr parser.Expression) {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		switch {
+		case isBuiltin(expr.First, lexer.DEFINE) && len(expr.Rest) > 0:
+			if name, ok := expr.Rest[0].(*parser.Identifier); ok {
+				o.bindings[name.Value]++
+			}
+		case isBuiltin(expr.First, lexer.LAMBDA) && len(expr.Rest) > 0:
+			if params, ok := expr.Rest[0].(*parser.List); ok {
+				for _, param := range params.Args {
+					if ident, ok := param.(*parser.Identifier); ok {
+						o.bindings[ident.Value]++
+					}
+				}
+			}
+		case isBuiltin(expr.First, lexer.IMPORT) || isBuiltin(expr.First, lexer.REQUIRE):
+			// the names an import binds depend on the module, so any
+			// name in it may be rebound
+			o.names(expr)
+		}
+		o.count(expr.First)
+		for _, arg := range expr.Rest {
+			o.count(arg)
+		}
+	case *parser.List:
+		for _, arg := range expr.Args {
+			o.count(arg)
+		}
+	}
+}
+
+func (o *optimizer) names(expr parser.Expression) {
+	switch expr := expr.(type) {
+	case *parser.Identifier:
+		o.bindings[expr.Value]++
+	case *parser.Form:
+		o.names(expr.First)
+		for _, arg := range expr.Rest {
+			o.names(arg)
+		}
+	case *parser.List:
+		for _, arg := range expr.Args {
+			o.names(arg)
+		}
+	}
+}
+
+// define records a top level definition of a procedure that can be inlined
+// into the code after it. The name has to be bound nowhere else, so that it
+// means the same procedure at every call.
+func (o *optimizer) define(expr parser.Expression) {
+	form, ok := expr.(*parser.Form)
+	if !ok || !isBuiltin(form.First, lexer.DEFINE) || len(form.Rest) != 2 {
+		return
+	}
+	name, ok := form.Rest[0].(*parser.Identifier)
+	if !ok || o.bindings[name.Value] != 1 {
+		return
+	}
+	lambda, ok := form.Rest[1].(*parser.Form)
+	if !ok || !isBuiltin(lambda.First, lexer.LAMBDA) || len(lambda.Rest) != 2 {
+		return
+	}
+	params, ok := lambda.Rest[0].(*parser.List)
+	if !ok {
+		return
+	}
+	proc := &procedure{body: lambda.Rest[1]}
+	for _, param := range params.Args {
+		ident, ok := param.(*parser.Identifier)
+		if !ok {
+			return
+		}
+		proc.params = append(proc.params, ident.Value)
+	}
+	if n, ok := inlinable(proc.body, proc.params); ok && n <= maxInline {
+		o.inline[name.Value] = proc
+	}
+}
+
+// inlinable reports whether body only uses params, literals and pure
+// builtins, which makes it mean the same wherever it is copied to and keeps
+// it from recursing, and returns its number of nodes.
+func inlinable(body parser.Expression, params []string) (int, bool) {
+	switch body := body.(type) {
+	case *parser.Number, *parser.String, *parser.Boolean, *parser.Symbol:
+		return 1, true
+	case *parser.Identifier:
+		for _, param := range params {
+			if param == body.Value {
+				return 1, true
+			}
+		}
+	case *parser.Form:
+		head, ok := body.First.(*parser.BuiltinIdentifier)
+		if !ok || !pure[head.Token.Type] && head.Token.Type != lexer.IF {
+			return 0, false
+		}
+		size := 1
+		for _, arg := range body.Rest {
+			n, ok := inlinable(arg, params)
+			if !ok {
+				return 0, false
+			}
+			size += n
+		}
+		return size, true
+	}
+	return 0, false
+}
+
+// pure holds the builtins that only compute a value from their arguments.
+var pure = map[lexer.TokenType]bool{
+	lexer.PLUS:     true,
+	lexer.MINUS:    true,
+	lexer.ASTERISK: true,
+	lexer.SLASH:    true,
+	lexer.EQ:       true,
+	lexer.LT:       true,
+	lexer.LTE:      true,
+	lexer.GT:       true,
+	lexer.GTE:      true,
+}
+
+func (o *optimizer) expr(expr parser.Expression) parser.Expression {
+	switch expr := expr.(type) {
+	case *parser.List:
+		for i, arg := range expr.Args {
+			// identifiers in a list are quoted
+			if _, ok := arg.(*parser.Identifier); !ok {
+				expr.Args[i] = o.expr(arg)
+			}
+		}
+	case *parser.Form:
+		return o.form(expr)
+	}
+	return expr
+}
+
+func (o *optimizer) form(form *parser.Form) parser.Expression {
+	switch {
+	case isBuiltin(form.First, lexer.LAMBDA):
+		for i := 1; i < len(form.Rest); i++ {
+			form.Rest[i] = o.expr(form.Rest[i])
+		}
+		return form
+	case isBuiltin(form.First, lexer.DEFINE):
+		if len(form.Rest) == 2 {
+			form.Rest[1] = o.expr(form.Rest[1])
+		}
+		return form
+	case isBuiltin(form.First, lexer.MODULE), isBuiltin(form.First, lexer.EXPORT),
+		isBuiltin(form.First, lexer.IMPORT), isBuiltin(form.First, lexer.REQUIRE):
+		return form
+	}
+	form.First = o.expr(form.First)
+	for i, arg := range form.Rest {
+		form.Rest[i] = o.expr(arg)
+	}
+	switch head := form.First.(type) {
+	case *parser.Identifier:
+		if proc, ok := o.inline[head.Value]; ok && len(form.Rest) == len(proc.params) && allLiteral(form.Rest) {
+			args := make(map[string]parser.Expression, len(proc.params))
+			for i, param := range proc.params {
+				args[param] = form.Rest[i]
+			}
+			return o.expr(substitute(proc.body, args))
+		}
+	case *parser.BuiltinIdentifier:
+		switch {
+		case head.Token.Type == lexer.IF:
+			if len(form.Rest) >= 2 && isLiteral(form.Rest[0]) {
+				if truthy(form.Rest[0]) {
+					return form.Rest[1]
+				}
+				if len(form.Rest) >= 3 {
+					return form.Rest[2]
+				}
+			}
+		case pure[head.Token.Type] && allLiteral(form.Rest):
+			if folded := o.fold(form); folded != nil {
+				return folded
+			}
+		}
+	}
+	return form
+}
+
+// fold evaluates a pure builtin call on literals, returning nil if it fails
+// so that the error is still reported when the program runs.
+func (o *optimizer) fold(form *parser.Form) parser.Expression {
+	tok := form.Token
+	switch obj := eval.Eval(form, o.env).(type) {
+	case *eval.Number:
+		tok.Type, tok.Literal = lexer.NUMBER, fmt.Sprintf("%d", obj.Value)
+		return &parser.Number{Token: tok, Value: obj.Value}
+	case *eval.Boolean:
+		tok.Type, tok.Literal = lexer.FALSE, "#f"
+		if obj.Value {
+			tok.Type, tok.Literal = lexer.TRUE, "#t"
+		}
+		return &parser.Boolean{Token: tok, Value: obj.Value}
+	case *eval.String:
+		tok.Type, tok.Literal = lexer.STRING, obj.Value
+		return &parser.String{Token: tok, Value: obj.Value}
+	}
+	return nil
+}
+
+// substitute copies body with the parameters in it replaced by args.
+func substitute(body parser.Expression, args map[string]parser.Expression) parser.Expression {
+	switch body := body.(type) {
+	case *parser.Identifier:
+		if arg, ok := args[body.Value]; ok {
+			return arg
+		}
+	case *parser.Form:
+		form := &parser.Form{Token: body.Token, First: body.First, Close: body.Close, Rest: make([]parser.Expression, len(body.Rest))}
+		for i, arg := range body.Rest {
+			form.Rest[i] = substitute(arg, args)
+		}
+		return form
+	}
+	return body
+}
+
+func isLiteral(expr parser.Expression) bool {
+	switch expr.(type) {
+	case *parser.Number, *parser.String, *parser.Boolean, *parser.Symbol:
+		return true
+	}
+	return false
+}
+
+func allLiteral(exprs []parser.Expression) bool {
+	for _, expr := range exprs {
+		if !isLiteral(expr) {
+			return false
+		}
+	}
+	return true
+}
+
+// truthy reports whether a literal counts as true, where only false does not.
+func truthy(expr parser.Expression) bool {
+	b, ok := expr.(*parser.Boolean)
+	return !ok || b.Value
+}
+
+func isBuiltin(expr parser.Expression, tok lexer.TokenType) bool {
+	b, ok := expr.(*parser.BuiltinIdentifier)
+	return ok && b.Token.Type == tok
+}
@@ -0,0 +1,121 @@
+package optimize
+
+import (
+	"bytes"
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, src string) *parser.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parse errors: %v", p.Errors())
+	}
+	return program
+}
+
+func run(t *testing.T, program *parser.Program) string {
+	t.Helper()
+	var out bytes.Buffer
+	env := eval.NewInterpreter(eval.WithOutput(&out), eval.WithCapabilities(eval.CapIO)).Env()
+	obj := eval.Eval(program, env)
+	if obj == nil {
+		return out.String() + "<none>"
+	}
+	return out.String() + obj.Inspect()
+}
+
+func TestProgram(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`(* 60 60 24)`, `86400`},
+		{`(- 10 (+ 1 2) 3)`, `4`},
+		{`(< 1 2)`, `#t`},
+		{`(= "a" "a")`, `#t`},
+		{`(if #t 1 2)`, `1`},
+		{`(if #f 1 2)`, `2`},
+		{`(if (> 1 2) (display 1) (display 2))`, `(display 2)`},
+		{`(if 0 'yes 'no)`, `'yes`},
+		{`(if #f 1)`, `(if #f 1)`},
+		{`(/ 1 0)`, `(/ 1 0)`},
+		{`(+ 1 "a")`, `(+ 1 "a")`},
+		{`(+ x 1)`, `(+ x 1)`},
+		{`'(a (+ 1 2))`, `'(a 3)`},
+		{`(define sq (lambda '(x) (* x x))) (sq 5)`, "(define sq (lambda '(x) (* x x)))\n25"},
+		{`(define sq (lambda '(x) (* x x))) (define f (lambda '(y) (sq (sq 3)))) (f 1)`, "(define sq (lambda '(x) (* x x)))\n(define f (lambda '(y) 81))\n81"},
+		{`(define abs (lambda '(n) (if (< n 0) (- 0 n) n))) (abs -4)`, "(define abs (lambda '(n) (if (< n 0) (- 0 n) n)))\n4"},
+		// a call with an argument that isn't a literal
+		{`(define sq (lambda '(x) (* x x))) (sq y)`, "(define sq (lambda '(x) (* x x)))\n(sq y)"},
+		// a call before the definition
+		{`(sq 2) (define sq (lambda '(x) (* x x)))`, "(sq 2)\n(define sq (lambda '(x) (* x x)))"},
+		// a name defined twice
+		{`(define sq (lambda '(x) (* x x))) (define sq 1) (sq 2)`, "(define sq (lambda '(x) (* x x)))\n(define sq 1)\n(sq 2)"},
+		// a name shadowed by a parameter
+		{`(define sq (lambda '(x) (* x x))) (define f (lambda '(sq) (sq 2)))`, "(define sq (lambda '(x) (* x x)))\n(define f (lambda '(sq) (sq 2)))"},
+		// a recursive procedure
+		{`(define f (lambda '(n) (if (= n 0) 0 (f (- n 1))))) (f 3)`, "(define f (lambda '(n) (if (= n 0) 0 (f (- n 1)))))\n(f 3)"},
+		// the wrong number of arguments
+		{`(define sq (lambda '(x) (* x x))) (sq)`, "(define sq (lambda '(x) (* x x)))\n(sq)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			got := strings.TrimSuffix(Program(parse(t, tt.src)).String(), "\n")
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+var equivalent = []string{
+	`(* 60 60 24)`,
+	`(+ 1 "a")`,
+	`(< 1)`,
+	`(if #f 1)`,
+	`(if (= 1 1) (display "yes") (display "no"))`,
+	`(if 1)`,
+	`(if #t 1 2 3)`,
+	`(define sq (lambda '(x) (* x x))) (sq 5)`,
+	`(define sq (lambda '(x) (* x x))) (sq "a")`,
+	`(define sq (lambda '(x) (* x x))) (sq 1 2)`,
+	`(define sq (lambda '(x) (* x x))) (define sq 2) sq`,
+	`(define dup (lambda '(a a) a)) (dup 1 2)`,
+	`(define k (lambda '(a) 7)) (k 1)`,
+	`(define sign (lambda '(n) (if (< n 0) -1 (if (= n 0) 0 1)))) (list (sign -5) (sign 0) (sign 5))`,
+	`(define f (lambda '(x) (define y (+ 1 2)) (if #f y (+ x y)))) (f 3)`,
+	`(define g (lambda '() (if #f (define z 1)) z)) (define z 5) (g)`,
+	`'(a (+ 1 2) "b")`,
+}
+
+func TestEquivalence(t *testing.T) {
+	files, err := filepath.Glob("../../examples/*.doma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcs := append([]string{}, equivalent...)
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, string(src))
+	}
+	for _, src := range srcs {
+		t.Run(src, func(t *testing.T) {
+			want := run(t, parse(t, src))
+			got := run(t, Program(parse(t, src)))
+			if got != want {
+				t.Errorf("optimized program differs\nwant: %q\ngot:  %q", want, got)
+			}
+		})
+	}
+}
@@ -24,8 +24,11 @@ type String struct {
 func (s *String) TokenLiteral() string {
 	return s.Token.Literal
 }
+
+// String prints the literal as source, quoted, so that a printed program
+// parses back into the same program.
 func (s *String) String() string {
-	return s.Value
+	return "\"" + s.Value + "\""
 }
 
 // ---
@@ -47,6 +50,12 @@ func (n *Number) String() string {
 type Identifier struct {
 	Token lexer.Token
 	Value string
+	// Local is set by the resolver when the identifier names a lambda
+	// parameter or a definition in a lambda body. The variable is then in
+	// slot Index of the frame Depth lambdas out from the current one.
+	Local bool
+	Depth int
+	Index int
 }
 
 func (i *Identifier) TokenLiteral() string {
@@ -94,8 +103,10 @@ type Symbol struct {
 func (s *Symbol) TokenLiteral() string {
 	return s.Token.Literal
 }
+
+// String prints the symbol as source, with its tick.
 func (s *Symbol) String() string {
-	return s.Token.Literal
+	return "'" + s.Value
 }
 
 // ------------------------------
@@ -104,6 +115,9 @@ func (s *Symbol) String() string {
 
 type Program struct {
 	Args []Expression
+	// Comments holds the comments in source order when the lexer was
+	// created with lexer.ScanComments.
+	Comments []lexer.Token
 }
 
 func (p *Program) TokenLiteral() string {
@@ -126,6 +140,10 @@ type Form struct {
 	Token lexer.Token
 	First Expression
 	Rest  []Expression
+	Close lexer.Token
+	// Frame names the slots of the call frame of a resolved lambda form,
+	// parameters first. It is nil for other forms.
+	Frame []string
 }
 
 func (f *Form) TokenLiteral() string {
@@ -148,7 +166,11 @@ func (f *Form) String() string {
 
 type List struct {
 	Token lexer.Token
+	// Head is the list keyword of a (list ...) form. It is zero for the
+	// '(...) shorthand.
+	Head  lexer.Token
 	Args  []Expression
+	Close lexer.Token
 }
 
 func (lf *List) TokenLiteral() string {
@@ -0,0 +1,228 @@
+package parser
+
+import (
+	"doma/pkg/lexer"
+	"strings"
+)
+
+// Trivia is source text that doesn't affect evaluation: whitespace or a
+// comment.
+type Trivia struct {
+	Token lexer.Token
+	Text  string
+}
+
+// Node is a node of a concrete syntax tree. Unlike an Expression it keeps
+// every byte of the source, so String returns the original text exactly.
+type Node interface {
+	// Leaves returns the tokens of the node in source order.
+	Leaves() []*Leaf
+	String() string
+}
+
+// Leaf is a single token along with its exact source text. Leading holds the
+// whitespace and comments before it, Trailing a comment that follows it on
+// the same line together with the whitespace in between.
+type Leaf struct {
+	Leading  []Trivia
+	Token    lexer.Token
+	Text     string
+	Trailing []Trivia
+}
+
+func (l *Leaf) Leaves() []*Leaf {
+	return []*Leaf{l}
+}
+func (l *Leaf) String() string {
+	var out strings.Builder
+	for _, t := range l.Leading {
+		out.WriteString(t.Text)
+	}
+	out.WriteString(l.Text)
+	for _, t := range l.Trailing {
+		out.WriteString(t.Text)
+	}
+	return out.String()
+}
+
+// Comments returns the comments attached to the leaf.
+func (l *Leaf) Comments() []lexer.Token {
+	comments := make([]lexer.Token, 0)
+	for _, trivia := range [][]Trivia{l.Leading, l.Trailing} {
+		for _, t := range trivia {
+			if t.Token.Type == lexer.COMMENT {
+				comments = append(comments, t.Token)
+			}
+		}
+	}
+	return comments
+}
+
+// Group is a parenthesized form or list. Tick is set for the '( shorthand
+// and Close is nil when the input ended before the group was closed.
+type Group struct {
+	Tick  *Leaf
+	Open  *Leaf
+	Items []Node
+	Close *Leaf
+}
+
+func (g *Group) Leaves() []*Leaf {
+	leaves := make([]*Leaf, 0, len(g.Items)+3)
+	if g.Tick != nil {
+		leaves = append(leaves, g.Tick)
+	}
+	leaves = append(leaves, g.Open)
+	for _, item := range g.Items {
+		leaves = append(leaves, item.Leaves()...)
+	}
+	if g.Close != nil {
+		leaves = append(leaves, g.Close)
+	}
+	return leaves
+}
+func (g *Group) String() string {
+	return leavesString(g.Leaves())
+}
+
+// File is the concrete syntax tree of a whole source file. The trivia after
+// the last item is attached to the EOF leaf.
+type File struct {
+	Items []Node
+	EOF   *Leaf
+}
+
+func (f *File) Leaves() []*Leaf {
+	leaves := make([]*Leaf, 0, len(f.Items)+1)
+	for _, item := range f.Items {
+		leaves = append(leaves, item.Leaves()...)
+	}
+	return append(leaves, f.EOF)
+}
+func (f *File) String() string {
+	return leavesString(f.Leaves())
+}
+
+func leavesString(leaves []*Leaf) string {
+	var out strings.Builder
+	for _, l := range leaves {
+		out.WriteString(l.String())
+	}
+	return out.String()
+}
+
+// ParseCST builds the concrete syntax tree of src. The tree is built even
+// when src is malformed, so that String always reproduces src; the problems
+// found are returned alongside it.
+func ParseCST(src string) (*File, []string) {
+	c := &cstParser{src: src}
+	l := lexer.NewWithMode(src, lexer.ScanTrivia)
+	for {
+		tok := l.NextToken()
+		c.tokens = append(c.tokens, tok)
+		if tok.Type == lexer.EOF {
+			break
+		}
+	}
+	file := &File{Items: make([]Node, 0)}
+	for c.peek().Type != lexer.EOF {
+		if c.peek().Type == lexer.RPAREN {
+			c.errors = append(c.errors, "unexpected )")
+			file.Items = append(file.Items, c.leaf())
+			continue
+		}
+		file.Items = append(file.Items, c.node())
+	}
+	file.EOF = c.leaf()
+	return file, c.errors
+}
+
+type cstParser struct {
+	src    string
+	tokens []lexer.Token
+	pos    int
+	errors []string
+}
+
+// peek returns the next token that isn't trivia.
+func (c *cstParser) peek() lexer.Token {
+	for i := c.pos; i < len(c.tokens); i++ {
+		if !isTrivia(c.tokens[i]) {
+			return c.tokens[i]
+		}
+	}
+	return c.tokens[len(c.tokens)-1]
+}
+
+func (c *cstParser) node() Node {
+	switch c.peek().Type {
+	case lexer.LPAREN:
+		return c.group(nil)
+	case lexer.TICK:
+		tick := c.leaf()
+		if c.peek().Type != lexer.LPAREN {
+			c.errors = append(c.errors, "expected ( after '")
+			return tick
+		}
+		return c.group(tick)
+	}
+	return c.leaf()
+}
+
+func (c *cstParser) group(tick *Leaf) *Group {
+	g := &Group{Tick: tick, Open: c.leaf(), Items: make([]Node, 0)}
+	for {
+		switch c.peek().Type {
+		case lexer.RPAREN:
+			g.Close = c.leaf()
+			return g
+		case lexer.EOF:
+			c.errors = append(c.errors, "unexpected end of input, expected )")
+			return g
+		}
+		g.Items = append(g.Items, c.node())
+	}
+}
+
+// leaf consumes the next token together with its trivia.
+func (c *cstParser) leaf() *Leaf {
+	l := &Leaf{}
+	for isTrivia(c.tokens[c.pos]) {
+		l.Leading = append(l.Leading, c.trivia())
+	}
+	l.Token, l.Text = c.tokens[c.pos], c.text(c.pos)
+	if l.Token.Type == lexer.EOF {
+		return l
+	}
+	c.pos++
+	i := c.pos
+	if c.tokens[i].Type == lexer.WHITESPACE && !strings.Contains(c.tokens[i].Literal, "\n") {
+		i++
+	}
+	if c.tokens[i].Type == lexer.COMMENT {
+		for c.pos <= i {
+			l.Trailing = append(l.Trailing, c.trivia())
+		}
+	}
+	return l
+}
+
+func (c *cstParser) trivia() Trivia {
+	t := Trivia{Token: c.tokens[c.pos], Text: c.text(c.pos)}
+	c.pos++
+	return t
+}
+
+// text slices the source of token i, which runs up to the next token since
+// trivia covers everything in between.
+func (c *cstParser) text(i int) string {
+	end := len(c.src)
+	if i+1 < len(c.tokens) {
+		end = c.tokens[i+1].Offset
+	}
+	return c.src[c.tokens[i].Offset:end]
+}
+
+func isTrivia(tok lexer.Token) bool {
+	return tok.Type == lexer.WHITESPACE || tok.Type == lexer.COMMENT
+}
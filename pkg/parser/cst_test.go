@@ -0,0 +1,87 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCSTRoundTrip(t *testing.T) {
+	inputs := []string{
+		"",
+		" ",
+		"\n\n",
+		"; only a comment",
+		"; comment\n\n\n(f)   ; trailing\n\n",
+		"#!/usr/bin/env doma\n(display 1)\n",
+		"#!/usr/bin/env doma",
+		"(define x\n\t; inside\n  '(1 \"a ; not a comment\" 'b))\r\n",
+		"(f\n  ; before close\n  )",
+		"(list 1\n\n\n 2)",
+		"(f (g",
+		"\"unterminated",
+		"'x '",
+		"()) )",
+		"(a @ b)",
+		"  (λ)  ",
+	}
+	files, err := filepath.Glob("../../examples/*/*.doma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, _ := filepath.Glob("../../examples/*.doma")
+	for _, file := range append(top, files...) {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, string(src))
+	}
+	for _, src := range inputs {
+		file, _ := ParseCST(src)
+		if got := file.String(); got != src {
+			t.Errorf("%q prints as %q", src, got)
+		}
+	}
+}
+
+func TestCSTTrivia(t *testing.T) {
+	file, errs := ParseCST("; head\n(f x) ; tail\n\n(g")
+	if len(file.Items) != 2 {
+		t.Fatalf("got %d items", len(file.Items))
+	}
+	f := file.Items[0].(*Group)
+	if c := f.Open.Comments(); len(c) != 1 || c[0].Literal != "; head" {
+		t.Errorf("leading comments are %+v", c)
+	}
+	if c := f.Close.Comments(); len(c) != 1 || c[0].Literal != "; tail" {
+		t.Errorf("trailing comments are %+v", c)
+	}
+	if len(f.Close.Trailing) != 2 || f.Close.Trailing[0].Text != " " {
+		t.Errorf("trailing trivia is %+v", f.Close.Trailing)
+	}
+	g := file.Items[1].(*Group)
+	if g.Close != nil || g.Open.Leading[0].Text != "\n\n" {
+		t.Errorf("unterminated group is %+v", g)
+	}
+	if len(errs) != 1 || errs[0] != "unexpected end of input, expected )" {
+		t.Errorf("got errors %v", errs)
+	}
+}
+
+func TestCSTErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{")", "unexpected )"},
+		{"'1", "expected ( after '"},
+		{"(f", "unexpected end of input, expected )"},
+	}
+	for _, tt := range tests {
+		_, errs := ParseCST(tt.input)
+		if len(errs) != 1 || errs[0] != tt.want {
+			t.Errorf("%q: got %v, want %q", tt.input, errs, tt.want)
+		}
+	}
+}
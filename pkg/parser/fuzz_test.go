@@ -0,0 +1,52 @@
+package parser
+
+import (
+	"doma/pkg/lexer"
+	"testing"
+	"time"
+)
+
+// parseQuickly parses src, failing the test if that doesn't terminate.
+func parseQuickly(t *testing.T, src string) (*Program, []string) {
+	t.Helper()
+	type result struct {
+		program *Program
+		errs    []string
+	}
+	done := make(chan result, 1)
+	go func() {
+		p := New(lexer.New(src))
+		program := p.ParseProgram()
+		done <- result{program, p.Errors()}
+	}()
+	select {
+	case r := <-done:
+		return r.program, r.errs
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%q: parsing doesn't terminate", src)
+		return nil, nil
+	}
+}
+
+func FuzzParseProgram(f *testing.F) {
+	for _, seed := range []string{"", "(define x (list 1 2))", "(lambda '(x) (* x x))", "'(a (b c) '(d))", "(+ 1", "())", "'x", "@", "#!/bin/doma\n; c\n(f) ; d\n"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		if file, _ := ParseCST(src); file.String() != src {
+			t.Fatalf("%q has a concrete syntax tree that prints as %q", src, file.String())
+		}
+		program, errs := parseQuickly(t, src)
+		if len(errs) > 0 {
+			return
+		}
+		printed := program.String()
+		again, errs := parseQuickly(t, printed)
+		if len(errs) > 0 {
+			t.Fatalf("%q prints as %q, which doesn't parse: %v", src, printed, errs)
+		}
+		if again.String() != printed {
+			t.Fatalf("%q prints as %q, which prints as %q", src, printed, again.String())
+		}
+	})
+}
@@ -7,16 +7,27 @@ import (
 )
 
 type Parser struct {
-	l      *lexer.Lexer
-	cur    lexer.Token
-	peek   lexer.Token
-	errors []string
+	l        *lexer.Lexer
+	cur      lexer.Token
+	peek     lexer.Token
+	errors   []SyntaxError
+	comments []lexer.Token
+}
+
+// SyntaxError is a parse error along with the token it was found at.
+type SyntaxError struct {
+	Token   lexer.Token
+	Message string
+}
+
+func (e SyntaxError) Error() string {
+	return e.Message
 }
 
 func New(l *lexer.Lexer) *Parser {
 	p := &Parser{
 		l:      l,
-		errors: []string{},
+		errors: []SyntaxError{},
 	}
 	p.nextToken()
 	p.nextToken()
@@ -24,9 +35,22 @@ func New(l *lexer.Lexer) *Parser {
 }
 
 func (p *Parser) Errors() []string {
+	errors := make([]string, 0, len(p.errors))
+	for _, err := range p.errors {
+		errors = append(errors, err.Message)
+	}
+	return errors
+}
+
+// SyntaxErrors returns the errors found so far with their positions.
+func (p *Parser) SyntaxErrors() []SyntaxError {
 	return p.errors
 }
 
+func (p *Parser) error(format string, a ...any) {
+	p.errors = append(p.errors, SyntaxError{Token: p.cur, Message: fmt.Sprintf(format, a...)})
+}
+
 func (p *Parser) ParseProgram() *Program {
 	program := &Program{Args: []Expression{}}
 
@@ -37,6 +61,7 @@ func (p *Parser) ParseProgram() *Program {
 		}
 		p.nextToken()
 	}
+	program.Comments = p.comments
 
 	return program
 }
@@ -70,13 +95,17 @@ func (p *Parser) parseExpression() Expression {
 				Value: p.cur.Literal,
 			}
 		} else {
-			p.errors = append(p.errors, fmt.Sprintf("illegal character: %s", p.cur.Literal))
+			p.error("illegal character: %s", p.cur.Literal)
 			return nil
 		}
 	}
 }
 
 func (p *Parser) parseListShorthand() Expression {
+	if !p.peekTokenIs(lexer.LPAREN) {
+		p.error("expected ( after ', got %s", p.peek.Type)
+		return nil
+	}
 	p.nextToken()
 	lf := &List{
 		Token: p.cur, // (
@@ -84,25 +113,36 @@ func (p *Parser) parseListShorthand() Expression {
 	}
 	p.nextToken()
 	for !p.curTokenIs(lexer.RPAREN) {
+		if p.curTokenIs(lexer.EOF) {
+			p.error("unexpected end of input, expected )")
+			break
+		}
 		expr := p.parseExpression()
 		lf.Args = append(lf.Args, expr)
 		p.nextToken()
 	}
+	lf.Close = p.cur
 	return lf
 }
 
 func (p *Parser) parseList() Expression {
 	lf := &List{
 		Token: p.cur, // (
+		Head:  p.peek,
 		Args:  make([]Expression, 0),
 	}
 	p.nextToken()
 	p.nextToken()
 	for !p.curTokenIs(lexer.RPAREN) {
+		if p.curTokenIs(lexer.EOF) {
+			p.error("unexpected end of input, expected )")
+			break
+		}
 		expr := p.parseExpression()
 		lf.Args = append(lf.Args, expr)
 		p.nextToken()
 	}
+	lf.Close = p.cur
 	return lf
 }
 
@@ -116,19 +156,37 @@ func (p *Parser) parseForm() Expression {
 	}
 	p.nextToken()
 	form.First = p.parseExpression()
+	if ident, ok := form.First.(*Identifier); ok {
+		if typ, ok := lexer.LookupForm(ident.Value); ok {
+			tok := ident.Token
+			tok.Type = typ
+			form.First = &BuiltinIdentifier{Token: tok, Value: ident.Value}
+		}
+	}
 	p.nextToken()
 	form.Rest = make([]Expression, 0)
 	for !p.curTokenIs(lexer.RPAREN) {
+		if p.curTokenIs(lexer.EOF) {
+			p.error("unexpected end of input, expected )")
+			break
+		}
 		expr := p.parseExpression()
 		form.Rest = append(form.Rest, expr)
 		p.nextToken()
 	}
+	form.Close = p.cur
 	return form
 }
 
 func (p *Parser) nextToken() {
 	p.cur = p.peek
 	p.peek = p.l.NextToken()
+	for p.peek.Type == lexer.COMMENT || p.peek.Type == lexer.WHITESPACE {
+		if p.peek.Type == lexer.COMMENT {
+			p.comments = append(p.comments, p.peek)
+		}
+		p.peek = p.l.NextToken()
+	}
 }
 
 func (p *Parser) curTokenIs(t lexer.TokenType) bool {
@@ -149,7 +207,7 @@ func (p *Parser) parseString() Expression {
 func (p *Parser) parseNumber() Expression {
 	value, err := strconv.ParseInt(p.cur.Literal, 10, 64)
 	if err != nil {
-		p.errors = append(p.errors, fmt.Sprintf("Could not parse %s as integer", p.cur.Literal))
+		p.error("Could not parse %s as integer", p.cur.Literal)
 		return nil
 	}
 	return &Number{
@@ -0,0 +1,108 @@
+package parser
+
+import (
+	"doma/pkg/lexer"
+	"reflect"
+	"testing"
+)
+
+func parse(t testing.TB, src string) *Program {
+	t.Helper()
+	p := New(lexer.New(src))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		t.Fatalf("%q: parse errors: %v", src, errs)
+	}
+	return program
+}
+
+func TestParseProgram(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"1 -2 \"s\"", "1\n-2\n\"s\"\n"},
+		{"#t true #f false", "#t\ntrue\n#f\nfalse\n"},
+		{"'sym", "'sym\n"},
+		{"(a 'b #t \"s\" 'c)", "(a 'b #t \"s\" 'c)\n"},
+		{"(+ 1 (* 2 3))", "(+ 1 (* 2 3))\n"},
+		{"'()", "'()\n"},
+		{"'(a (b c) '(d))", "'(a (b c) '(d))\n"},
+		{"(list 1 2)", "'(1 2)\n"},
+		{"(define x (list))", "(define x '())\n"},
+		{"(lambda '(x) (* x x))", "(lambda '(x) (* x x))\n"},
+		{"; comment\n(display 1) ; trailing\n", "(display 1)\n"},
+	}
+	for _, tt := range tests {
+		if got := parse(t, tt.input).String(); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionTypes(t *testing.T) {
+	program := parse(t, "(define x '(1 \"a\" #t 'b))")
+	form := program.Args[0].(*Form)
+	if _, ok := form.First.(*BuiltinIdentifier); !ok {
+		t.Errorf("define is %T", form.First)
+	}
+	if _, ok := form.Rest[0].(*Identifier); !ok {
+		t.Errorf("x is %T", form.Rest[0])
+	}
+	list := form.Rest[1].(*List)
+	want := []Expression{&Number{}, &String{}, &Boolean{}, &Symbol{}}
+	for i, arg := range list.Args {
+		if reflect.TypeOf(arg) != reflect.TypeOf(want[i]) {
+			t.Errorf("element %d is %T, want %T", i, arg, want[i])
+		}
+	}
+	if form.Token.Col != 1 || form.Close.Col != 25 || list.Token.Col != 12 || list.Close.Col != 24 {
+		t.Errorf("positions are %d-%d and %d-%d", form.Token.Col, form.Close.Col, list.Token.Col, list.Close.Col)
+	}
+}
+
+func TestHeadForms(t *testing.T) {
+	program := parse(t, "(import \"a.doma\") (define import 1) (f import)")
+	head, ok := program.Args[0].(*Form).First.(*BuiltinIdentifier)
+	if !ok || head.Token.Type != lexer.IMPORT || head.Token.Col != 2 {
+		t.Errorf("head of import form is %#v", program.Args[0].(*Form).First)
+	}
+	for _, expr := range program.Args[1:] {
+		if arg, ok := expr.(*Form).Rest[0].(*Identifier); !ok || arg.Value != "import" {
+			t.Errorf("import in %s is %T", expr, expr.(*Form).Rest[0])
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	p := New(lexer.NewWithMode("; a\n(f) ; b\n", lexer.ScanComments))
+	program := p.ParseProgram()
+	if len(program.Comments) != 2 || program.Comments[0].Literal != "; a" || program.Comments[1].Line != 2 {
+		t.Errorf("got comments %+v", program.Comments)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		line  int
+	}{
+		{"(+ 1", "unexpected end of input, expected )", 1},
+		{"'(1\n", "unexpected end of input, expected )", 2},
+		{"(list 1", "unexpected end of input, expected )", 1},
+		{"(f\n @)", "illegal character: @", 2},
+		{"(f '1 2)", "expected ( after ', got NUMBER", 1},
+		{"'", "expected ( after ', got EOF", 1},
+		{"99999999999999999999", "Could not parse 99999999999999999999 as integer", 1},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errs := p.SyntaxErrors()
+		if len(errs) == 0 || errs[0].Message != tt.want || errs[0].Token.Line != tt.line {
+			t.Errorf("%q: got %+v, want %q at line %d", tt.input, errs, tt.want, tt.line)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package readline
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+const maxHistory = 1000
+
+type history struct {
+	entries []string
+	file    string
+}
+
+func (h *history) load(file string) error {
+	h.file = file
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			h.entries = append(h.entries, unescapeEntry(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(h.entries) > maxHistory {
+		// add only appends, so the file is cut back here
+		h.trim()
+		return h.save()
+	}
+	return nil
+}
+
+// save replaces the history file with the entries, going through a
+// temporary file so that a failed write doesn't lose the history.
+func (h *history) save() error {
+	var b strings.Builder
+	for _, entry := range h.entries {
+		b.WriteString(escapeEntry(entry) + "\n")
+	}
+	tmp := h.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.file)
+}
+
+func (h *history) add(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == line {
+		return nil
+	}
+	h.entries = append(h.entries, line)
+	h.trim()
+	if h.file == "" {
+		return nil
+	}
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(escapeEntry(line) + "\n")
+	return err
+}
+
+func (h *history) trim() {
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+}
+
+// search looks backwards from index from for an entry containing query.
+func (h *history) search(query string, from int) int {
+	if from >= len(h.entries) {
+		from = len(h.entries) - 1
+	}
+	for i := from; i >= 0; i-- {
+		if strings.Contains(h.entries[i], query) {
+			return i
+		}
+	}
+	return -1
+}
+
+func escapeEntry(line string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(line)
+}
+
+func unescapeEntry(line string) string {
+	var out strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) {
+			i++
+			if line[i] == 'n' {
+				out.WriteByte('\n')
+			} else {
+				out.WriteByte(line[i])
+			}
+			continue
+		}
+		out.WriteByte(line[i])
+	}
+	return out.String()
+}
@@ -0,0 +1,486 @@
+// Package readline is a small line editor for the doma REPL. On a terminal
+// it supports cursor movement, persistent history, reverse search, tab
+// completion and highlighting of matching parentheses. Other inputs are
+// read line by line without editing.
+package readline
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ErrInterrupt is returned by ReadLine when the user presses Ctrl-C.
+var ErrInterrupt = errors.New("interrupt")
+
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlG     = 7
+	keyCtrlH     = 8
+	keyTab       = 9
+	keyCtrlJ     = 10
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlR     = 18
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyBackspace = 127
+)
+
+// synthetic keys produced by escape sequences
+const (
+	keyUp rune = -(iota + 1)
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+	keyUnknown
+)
+
+type Editor struct {
+	// Completer returns the words that may complete the identifier before
+	// the cursor. Candidates that don't start with prefix are ignored.
+	Completer func(prefix string) []string
+
+	in      *bufio.Reader
+	out     io.Writer
+	fd      int
+	tty     bool
+	history history
+}
+
+func New(in io.Reader, out io.Writer) *Editor {
+	e := &Editor{in: bufio.NewReader(in), out: out, fd: -1}
+	if f, ok := in.(*os.File); ok && isTerminal(int(f.Fd())) {
+		e.fd = int(f.Fd())
+		e.tty = true
+	}
+	return e
+}
+
+// LoadHistory reads previous entries from file and appends new ones to it.
+func (e *Editor) LoadHistory(file string) error {
+	return e.history.load(file)
+}
+
+func (e *Editor) AddHistory(line string) error {
+	return e.history.add(line)
+}
+
+// ReadLine prints prompt and returns the next line of input without its
+// line ending. It returns io.EOF once the input is exhausted.
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	if !e.tty {
+		return e.readPlain(prompt)
+	}
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return e.readPlain(prompt)
+	}
+	defer restore()
+	return e.edit(prompt)
+}
+
+func (e *Editor) readPlain(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	line, err := e.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+type lineState struct {
+	prompt  string
+	buf     []rune
+	pos     int
+	histIdx int
+	pending []rune
+}
+
+func (e *Editor) edit(prompt string) (string, error) {
+	s := &lineState{prompt: prompt, histIdx: len(e.history.entries)}
+	lastTab := false
+	e.refresh(s)
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			return "", err
+		}
+		if key != keyTab {
+			lastTab = false
+		}
+		switch key {
+		case keyEnter, keyCtrlJ:
+			s.pos = len(s.buf)
+			e.refreshPlain(s)
+			fmt.Fprint(e.out, "\r\n")
+			return string(s.buf), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", ErrInterrupt
+		case keyCtrlD:
+			if len(s.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			s.deleteAt(s.pos)
+		case keyCtrlA, keyHome:
+			s.pos = 0
+		case keyCtrlE, keyEnd:
+			s.pos = len(s.buf)
+		case keyCtrlB, keyLeft:
+			if s.pos > 0 {
+				s.pos--
+			}
+		case keyCtrlF, keyRight:
+			if s.pos < len(s.buf) {
+				s.pos++
+			}
+		case keyBackspace, keyCtrlH:
+			if s.pos > 0 {
+				s.pos--
+				s.deleteAt(s.pos)
+			}
+		case keyDelete:
+			s.deleteAt(s.pos)
+		case keyCtrlK:
+			s.buf = s.buf[:s.pos]
+		case keyCtrlU:
+			s.buf = append([]rune{}, s.buf[s.pos:]...)
+			s.pos = 0
+		case keyCtrlW:
+			start := s.pos
+			for start > 0 && s.buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && s.buf[start-1] != ' ' {
+				start--
+			}
+			s.buf = append(s.buf[:start], s.buf[s.pos:]...)
+			s.pos = start
+		case keyCtrlL:
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case keyCtrlP, keyUp:
+			e.historyMove(s, -1)
+		case keyCtrlN, keyDown:
+			e.historyMove(s, 1)
+		case keyCtrlR:
+			line, submit, err := e.reverseSearch(s)
+			if err != nil {
+				return "", err
+			}
+			s.buf, s.pos = []rune(line), len([]rune(line))
+			if submit {
+				e.refreshPlain(s)
+				fmt.Fprint(e.out, "\r\n")
+				return line, nil
+			}
+		case keyTab:
+			e.complete(s, lastTab)
+			lastTab = true
+		default:
+			if key >= ' ' {
+				s.insert(key)
+			}
+		}
+		e.refresh(s)
+	}
+}
+
+func (s *lineState) insert(r rune) {
+	s.buf = append(s.buf, 0)
+	copy(s.buf[s.pos+1:], s.buf[s.pos:])
+	s.buf[s.pos] = r
+	s.pos++
+}
+
+func (s *lineState) deleteAt(pos int) {
+	if pos < len(s.buf) {
+		s.buf = append(s.buf[:pos], s.buf[pos+1:]...)
+	}
+}
+
+func (e *Editor) historyMove(s *lineState, dir int) {
+	entries := e.history.entries
+	next := s.histIdx + dir
+	if next < 0 || next > len(entries) {
+		return
+	}
+	if s.histIdx == len(entries) {
+		s.pending = s.buf
+	}
+	s.histIdx = next
+	if next == len(entries) {
+		s.buf = s.pending
+	} else {
+		s.buf = []rune(entries[next])
+	}
+	s.pos = len(s.buf)
+}
+
+// reverseSearch implements Ctrl-R. It returns the chosen line and whether
+// it should be submitted right away.
+func (e *Editor) reverseSearch(s *lineState) (string, bool, error) {
+	query := []rune{}
+	idx := -1
+	from := len(e.history.entries) - 1
+	for {
+		match := ""
+		if idx >= 0 {
+			match = e.history.entries[idx]
+		}
+		status := "(reverse-i-search)`"
+		if idx < 0 && len(query) > 0 {
+			status = "(failed reverse-i-search)`"
+		}
+		fmt.Fprintf(e.out, "\r%s%s': %s\x1b[K", status, string(query), match)
+		key, err := e.readKey()
+		if err != nil {
+			return "", false, err
+		}
+		switch key {
+		case keyEnter, keyCtrlJ:
+			if idx < 0 {
+				return string(s.buf), true, nil
+			}
+			return match, true, nil
+		case keyCtrlG, keyCtrlC:
+			return string(s.buf), false, nil
+		case keyCtrlR:
+			if idx > 0 {
+				if next := e.history.search(string(query), idx-1); next >= 0 {
+					idx = next
+				}
+			}
+			continue
+		case keyBackspace, keyCtrlH:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+			}
+		default:
+			if key < ' ' {
+				if idx < 0 {
+					return string(s.buf), false, nil
+				}
+				return match, false, nil
+			}
+			query = append(query, key)
+		}
+		idx = -1
+		if len(query) > 0 {
+			idx = e.history.search(string(query), from)
+		}
+	}
+}
+
+func (e *Editor) complete(s *lineState, listAll bool) {
+	if e.Completer == nil {
+		return
+	}
+	start := s.pos
+	for start > 0 && isWordRune(s.buf[start-1]) {
+		start--
+	}
+	prefix := string(s.buf[start:s.pos])
+	seen := make(map[string]bool)
+	matches := make([]string, 0)
+	for _, c := range e.Completer(prefix) {
+		if strings.HasPrefix(c, prefix) && !seen[c] {
+			seen[c] = true
+			matches = append(matches, c)
+		}
+	}
+	sort.Strings(matches)
+	switch {
+	case len(matches) == 0:
+		fmt.Fprint(e.out, "\a")
+	case len(matches) == 1:
+		e.replaceWord(s, start, matches[0]+" ")
+	default:
+		common := longestCommonPrefix(matches)
+		if len(common) > len(prefix) {
+			e.replaceWord(s, start, common)
+		} else if listAll {
+			fmt.Fprint(e.out, "\r\n"+strings.Join(matches, "  ")+"\r\n")
+		} else {
+			fmt.Fprint(e.out, "\a")
+		}
+	}
+}
+
+func (e *Editor) replaceWord(s *lineState, start int, word string) {
+	rest := append([]rune(word), s.buf[s.pos:]...)
+	s.buf = append(s.buf[:start], rest...)
+	s.pos = start + len([]rune(word))
+}
+
+func longestCommonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_/!?*<>=+", r)
+}
+
+func (e *Editor) refresh(s *lineState) {
+	e.render(s, matchParen(s.buf, s.pos))
+}
+
+func (e *Editor) refreshPlain(s *lineState) {
+	e.render(s, -1)
+}
+
+func (e *Editor) render(s *lineState, highlight int) {
+	var b strings.Builder
+	b.WriteString("\r")
+	b.WriteString(s.prompt)
+	for i, r := range s.buf {
+		if i == highlight {
+			b.WriteString("\x1b[7m" + string(r) + "\x1b[0m")
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	b.WriteString("\x1b[K\r")
+	if col := len([]rune(s.prompt)) + s.pos; col > 0 {
+		fmt.Fprintf(&b, "\x1b[%dC", col)
+	}
+	io.WriteString(e.out, b.String())
+}
+
+// matchParen finds the parenthesis matching the one just before the cursor,
+// or under it, and returns its index or -1.
+func matchParen(buf []rune, pos int) int {
+	if pos > 0 && buf[pos-1] == ')' {
+		depth := 0
+		for i := pos - 1; i >= 0; i-- {
+			switch buf[i] {
+			case ')':
+				depth++
+			case '(':
+				depth--
+				if depth == 0 {
+					return i
+				}
+			}
+		}
+	}
+	if pos < len(buf) && buf[pos] == '(' {
+		depth := 0
+		for i := pos; i < len(buf); i++ {
+			switch buf[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func (e *Editor) readKey() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if r != keyEscape {
+		return r, nil
+	}
+	// terminals send escape sequences in one write, so an escape with
+	// nothing after it is the Esc key on its own
+	if e.in.Buffered() == 0 {
+		return keyEscape, nil
+	}
+	next, _, err := e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch next {
+	case '[':
+	case 'O':
+		code, _, err := e.in.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		switch code {
+		case 'H':
+			return keyHome, nil
+		case 'F':
+			return keyEnd, nil
+		}
+		return keyUnknown, nil
+	default:
+		return keyUnknown, nil
+	}
+	code, _, err := e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch code {
+	case 'A':
+		return keyUp, nil
+	case 'B':
+		return keyDown, nil
+	case 'C':
+		return keyRight, nil
+	case 'D':
+		return keyLeft, nil
+	case 'H':
+		return keyHome, nil
+	case 'F':
+		return keyEnd, nil
+	}
+	if code < '0' || code > '9' {
+		return keyUnknown, nil
+	}
+	seq := string(code)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		if r == '~' {
+			break
+		}
+		if !('0' <= r && r <= '9') && r != ';' {
+			return keyUnknown, nil
+		}
+		seq += string(r)
+	}
+	switch seq {
+	case "1", "7":
+		return keyHome, nil
+	case "4", "8":
+		return keyEnd, nil
+	case "3":
+		return keyDelete, nil
+	}
+	return keyUnknown, nil
+}
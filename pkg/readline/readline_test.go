@@ -0,0 +1,236 @@
+package readline
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEditor(input string, history ...string) (*Editor, *bytes.Buffer) {
+	var out bytes.Buffer
+	e := &Editor{in: bufio.NewReader(strings.NewReader(input)), out: &out, fd: -1}
+	e.history.entries = history
+	return e, &out
+}
+
+func TestReadKey(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []rune
+	}{
+		{"ab", []rune{'a', 'b'}},
+		{"λ", []rune{'λ'}},
+		{"\x1b[A\x1b[B\x1b[C\x1b[D", []rune{keyUp, keyDown, keyRight, keyLeft}},
+		{"\x1b[H\x1b[F\x1bOH\x1bOF", []rune{keyHome, keyEnd, keyHome, keyEnd}},
+		{"\x1b[1~\x1b[4~\x1b[7~\x1b[8~\x1b[3~", []rune{keyHome, keyEnd, keyHome, keyEnd, keyDelete}},
+		{"\x1b[5~\x1b[1;5Cx", []rune{keyUnknown, keyUnknown, 'x'}},
+		{"\x1bx", []rune{keyUnknown}},
+		{"\x1b", []rune{keyEscape}},
+	}
+	for _, tt := range tests {
+		e, _ := newEditor(tt.input)
+		got := make([]rune, 0)
+		for {
+			key, err := e.readKey()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, key)
+		}
+		if string(got) != string(tt.want) {
+			t.Errorf("%q: got keys %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestEdit(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"typing", "(+ 1 2)\r", "(+ 1 2)"},
+		{"ctrl-j", "abc\n", "abc"},
+		{"backspace", "abd\x7fc\r", "abc"},
+		{"home and end", "bc\x01a\x05d\r", "abcd"},
+		{"arrows", "ac\x1b[Db\x1b[Cd\r", "abcd"},
+		{"delete", "abc\x01\x1b[3~\r", "bc"},
+		{"ctrl-d deletes", "ab\x01\x04\r", "b"},
+		{"ctrl-k", "abcd\x02\x02\x0b\r", "ab"},
+		{"ctrl-u", "abcd\x02\x02\x15\r", "cd"},
+		{"ctrl-w", "(define foo  \x17bar\r", "(define bar"},
+		{"history", "\x10\x10\r", "first"},
+		{"history down", "draft\x10\x10\x0e\x0e\r", "draft"},
+		{"reverse search", "\x12fir\r", "first"},
+		{"reverse search again", "\x12i\x12\r", "first"},
+		{"reverse search edit", "\x12sec\x05!\r", "second!"},
+		{"reverse search cancel", "x\x12sec\x07\r", "x"},
+		{"complete", "(dis\t1)\r", "(display 1)"},
+		{"complete common prefix", "(de\t\r", "(def"},
+	}
+	for _, tt := range tests {
+		e, _ := newEditor(tt.input, "first", "second")
+		e.Completer = func(prefix string) []string {
+			return []string{"display", "define", "defun"}
+		}
+		got, err := e.edit("> ")
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoneEscape(t *testing.T) {
+	r, w := io.Pipe()
+	e := New(r, io.Discard)
+	keys := make(chan rune)
+	go func() {
+		for {
+			key, err := e.readKey()
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- key
+		}
+	}()
+	w.Write([]byte("\x1b"))
+	select {
+	case key := <-keys:
+		if key != keyEscape {
+			t.Errorf("got key %v, want escape", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a lone escape waits for more input")
+	}
+	w.Write([]byte("\x1b[A"))
+	if key := <-keys; key != keyUp {
+		t.Errorf("got key %v after the escape, want up", key)
+	}
+	w.Close()
+}
+
+func TestEditInterrupt(t *testing.T) {
+	e, _ := newEditor("abc\x03")
+	if _, err := e.edit("> "); err != ErrInterrupt {
+		t.Errorf("ctrl-c gives %v", err)
+	}
+	e, _ = newEditor("\x04")
+	if _, err := e.edit("> "); err != io.EOF {
+		t.Errorf("ctrl-d on an empty line gives %v", err)
+	}
+}
+
+func TestCompleteList(t *testing.T) {
+	e, out := newEditor("(d\t\t\r")
+	e.Completer = func(prefix string) []string {
+		return []string{"display", "define", "other"}
+	}
+	if _, err := e.edit("> "); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\r\ndefine  display\r\n") {
+		t.Errorf("a second tab doesn't list the candidates: %q", out.String())
+	}
+}
+
+func TestMatchParen(t *testing.T) {
+	tests := []struct {
+		buf  string
+		pos  int
+		want int
+	}{
+		{"(a (b) c)", 9, 0},
+		{"(a (b) c)", 6, 3},
+		{"(a (b) c)", 3, 5},
+		{"(a (b) c)", 0, 8},
+		{"(a (b", 5, -1},
+		{"a)", 2, -1},
+	}
+	for _, tt := range tests {
+		if got := matchParen([]rune(tt.buf), tt.pos); got != tt.want {
+			t.Errorf("matchParen(%q, %d) = %d, want %d", tt.buf, tt.pos, got, tt.want)
+		}
+	}
+}
+
+func TestReadPlain(t *testing.T) {
+	e := New(strings.NewReader("one\r\ntwo"), io.Discard)
+	for _, want := range []string{"one", "two"} {
+		if got, err := e.ReadLine("> "); err != nil || got != want {
+			t.Errorf("got %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := e.ReadLine("> "); err != io.EOF {
+		t.Errorf("got %v at the end of input", err)
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history")
+	var h history
+	if err := h.load(file); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"(f)", "(f)", "  ", `(display "a\nb")`, "(g\n  1)"} {
+		if err := h.add(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var loaded history
+	if err := loaded.load(file); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"(f)", `(display "a\nb")`, "(g\n  1)"}
+	if strings.Join(loaded.entries, "|") != strings.Join(want, "|") {
+		t.Errorf("got entries %q, want %q", loaded.entries, want)
+	}
+	if i := loaded.search("display", 2); i != 1 {
+		t.Errorf("search found %d", i)
+	}
+	data, _ := os.ReadFile(file)
+	if strings.Count(string(data), "\n") != 3 {
+		t.Errorf("history file holds %q", data)
+	}
+}
+
+func TestHistoryFileTrimmed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history")
+	var b strings.Builder
+	for i := 0; i < maxHistory+5; i++ {
+		fmt.Fprintf(&b, "(f %d)\n", i)
+	}
+	if err := os.WriteFile(file, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var h history
+	if err := h.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.entries) != maxHistory || h.entries[0] != "(f 5)" {
+		t.Fatalf("loaded %d entries starting with %q", len(h.entries), h.entries[0])
+	}
+	if err := h.add("(g)"); err != nil {
+		t.Fatal(err)
+	}
+	var loaded history
+	if err := loaded.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.entries) != maxHistory || loaded.entries[0] != "(f 6)" || loaded.entries[maxHistory-1] != "(g)" {
+		t.Errorf("reloaded %d entries from %q to %q", len(loaded.entries), loaded.entries[0], loaded.entries[len(loaded.entries)-1])
+	}
+	data, _ := os.ReadFile(file)
+	if n := strings.Count(string(data), "\n"); n != maxHistory {
+		t.Errorf("history file holds %d entries", n)
+	}
+}
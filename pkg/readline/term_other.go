@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package readline
+
+import "errors"
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func() error, error) {
+	return nil, errors.New("raw mode is not supported on this platform")
+}
@@ -0,0 +1,188 @@
+package unittest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Summary counts the results of a run by status.
+func Summary(results []Result) (passed, failed, errored int) {
+	for _, r := range results {
+		switch r.Status {
+		case Pass:
+			passed++
+		case Fail:
+			failed++
+		default:
+			errored++
+		}
+	}
+	return passed, failed, errored
+}
+
+// WriteText reports the results of one file like go test does: the failures
+// and, when verbose is set, the tests that passed, then a line for the file.
+func WriteText(w io.Writer, file string, results []Result, verbose bool) {
+	for _, r := range results {
+		if r.Status == Pass && !verbose {
+			continue
+		}
+		name := r.Name
+		if name == "" {
+			name = file
+		}
+		fmt.Fprintf(w, "--- %s: %s (%.2fs)\n", r.Status, name, r.Elapsed.Seconds())
+		if r.Status == Pass {
+			continue
+		}
+		fmt.Fprintf(w, "    %s: %s\n", r.Pos(), indent(r.Message, "    "))
+		if r.Diff != "" {
+			fmt.Fprint(w, indent(r.Diff, "        "))
+		}
+		if r.Output != "" {
+			fmt.Fprintf(w, "    output:\n%s", indent(r.Output, "        "))
+		}
+	}
+	passed, failed, errored := Summary(results)
+	switch {
+	case len(results) == 0:
+		fmt.Fprintf(w, "?   \t%s\t[no tests]\n", file)
+	case failed+errored == 0:
+		fmt.Fprintf(w, "ok  \t%s\t%d passed\n", file, passed)
+	default:
+		fmt.Fprintf(w, "FAIL\t%s\t%d passed, %d failed, %d errors\n", file, passed, failed, errored)
+	}
+}
+
+// indent prefixes every line of s but the first with prefix, or every line
+// when s ends with a newline.
+func indent(s, prefix string) string {
+	if strings.HasSuffix(s, "\n") {
+		return prefix + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n"+prefix) + "\n"
+	}
+	return strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
+
+// WriteTAP reports results in the Test Anything Protocol, version 13, with
+// the details of each failure in a YAML block.
+func WriteTAP(w io.Writer, results []Result) {
+	fmt.Fprintf(w, "TAP version 13\n1..%d\n", len(results))
+	for i, r := range results {
+		name := r.File
+		if r.Name != "" {
+			name += ": " + r.Name
+		}
+		if r.Status == Pass {
+			fmt.Fprintf(w, "ok %d - %s\n", i+1, name)
+			continue
+		}
+		fmt.Fprintf(w, "not ok %d - %s\n  ---\n", i+1, name)
+		fmt.Fprintf(w, "  severity: %s\n", strings.ToLower(r.Status.String()))
+		fmt.Fprintf(w, "  at: %q\n", r.Pos())
+		fmt.Fprintf(w, "  message: %q\n", r.Message)
+		for _, field := range [][2]string{{"diff", r.Diff}, {"output", r.Output}} {
+			if field[1] != "" {
+				fmt.Fprintf(w, "  %s: |\n%s", field[0], indent(strings.TrimSuffix(field[1], "\n")+"\n", "    "))
+			}
+		}
+		fmt.Fprintf(w, "  ...\n")
+	}
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	Output    *junitText    `xml:"system-out,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",cdata"`
+}
+
+type junitText struct {
+	Text string `xml:",cdata"`
+}
+
+// WriteJUnit reports results as JUnit XML with a test suite per file, in
+// the order the files first appear in results.
+func WriteJUnit(w io.Writer, results []Result) error {
+	suites := junitSuites{}
+	index := make(map[string]int)
+	for _, r := range results {
+		i, ok := index[r.File]
+		if !ok {
+			i = len(suites.Suites)
+			index[r.File] = i
+			suites.Suites = append(suites.Suites, junitSuite{Name: r.File})
+		}
+		suite := &suites.Suites[i]
+		name := r.Name
+		if name == "" {
+			name = r.File
+		}
+		c := junitCase{Name: name, Classname: r.File, Time: seconds(r.Elapsed.Seconds())}
+		if r.Output != "" {
+			c.Output = &junitText{Text: r.Output}
+		}
+		problem := &junitProblem{Message: r.Message, Body: strings.TrimSpace(r.Pos() + ": " + r.Message + "\n" + r.Diff)}
+		switch r.Status {
+		case Fail:
+			c.Failure = problem
+			suite.Failures++
+			suites.Failures++
+		case Error:
+			c.Error = problem
+			suite.Errors++
+			suites.Errors++
+		}
+		suite.Tests++
+		suites.Tests++
+		suite.Cases = append(suite.Cases, c)
+	}
+	for i := range suites.Suites {
+		total := 0.0
+		for _, r := range results {
+			if r.File == suites.Suites[i].Name {
+				total += r.Elapsed.Seconds()
+			}
+		}
+		suites.Suites[i].Time = seconds(total)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(s float64) string {
+	return fmt.Sprintf("%.3f", s)
+}
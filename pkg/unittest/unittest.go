@@ -0,0 +1,220 @@
+// Package unittest runs the tests doma files define with deftest. Every test
+// gets an interpreter of its own that has evaluated the whole file, so tests
+// can't affect each other, and its result records where and why it failed.
+package unittest
+
+import (
+	"bytes"
+	"context"
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type Status int
+
+const (
+	Pass Status = iota
+	// Fail is a failed assertion.
+	Fail
+	// Error is any other error, in the test or in the file defining it.
+	Error
+)
+
+func (s Status) String() string {
+	switch s {
+	case Fail:
+		return "FAIL"
+	case Error:
+		return "ERROR"
+	}
+	return "PASS"
+}
+
+// Result is the outcome of running a test. A file that can't be parsed or
+// evaluated has a result with an empty Name.
+type Result struct {
+	File string
+	Name string
+	// Line and Col are the position of the failed assertion, or else of the
+	// deftest form.
+	Line    int
+	Col     int
+	Status  Status
+	Message string
+	// Diff compares the values of a failed assert-equal.
+	Diff    string
+	Output  string
+	Elapsed time.Duration
+}
+
+// Pos returns file:line:col for the result.
+func (r *Result) Pos() string {
+	if r.Line == 0 {
+		return r.File
+	}
+	return fmt.Sprintf("%s:%d:%d", r.File, r.Line, r.Col)
+}
+
+type Options struct {
+	// Run selects the tests whose name it matches. Nil runs every test.
+	Run *regexp.Regexp
+	// Timeout bounds each test. Zero means no limit.
+	Timeout time.Duration
+	// Interpreter returns extra options for the interpreters that run the
+	// tests of file.
+	Interpreter func(file string) []eval.Option
+}
+
+// RunFile runs the tests defined in the source of file.
+func RunFile(file string, src []byte, opts Options) []Result {
+	p := parser.New(lexer.New(string(src)))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return []Result{{File: file, Status: Error, Message: strings.Join(errs, "\n")}}
+	}
+	eval.Resolve(program)
+	ctx, cancel := opts.context()
+	env, out, errObj := load(ctx, file, program, opts)
+	cancel()
+	if errObj != nil {
+		return []Result{{File: file, Status: Error, Message: errObj.Message, Output: out.String()}}
+	}
+	results := make([]Result, 0)
+	for i, t := range env.Tests() {
+		if opts.Run != nil && !opts.Run.MatchString(t.Name) {
+			continue
+		}
+		results = append(results, run(file, program, i, opts))
+	}
+	return results
+}
+
+func (opts Options) context() (context.Context, context.CancelFunc) {
+	if opts.Timeout > 0 {
+		return context.WithTimeout(context.Background(), opts.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// load evaluates a test file in a new interpreter, which defines its tests.
+func load(ctx context.Context, file string, program *parser.Program, opts Options) (*eval.Env, *bytes.Buffer, *eval.Error) {
+	out := &bytes.Buffer{}
+	options := []eval.Option{eval.WithOutput(out), eval.WithScriptPath(file)}
+	if opts.Interpreter != nil {
+		options = append(options, opts.Interpreter(file)...)
+	}
+	env := eval.NewInterpreter(options...).Env()
+	if errObj, ok := eval.EvalContext(ctx, program, env).(*eval.Error); ok {
+		return nil, out, errObj
+	}
+	return env, out, nil
+}
+
+// run runs test i of the file.
+func run(file string, program *parser.Program, i int, opts Options) Result {
+	start := time.Now()
+	ctx, cancel := opts.context()
+	defer cancel()
+	env, out, errObj := load(ctx, file, program, opts)
+	if errObj != nil {
+		return Result{File: file, Status: Error, Message: errObj.Message, Output: out.String(), Elapsed: time.Since(start)}
+	}
+	t := env.Tests()[i]
+	obj := t.Run(ctx)
+	r := Result{File: file, Name: t.Name, Line: t.Line, Col: t.Col, Output: out.String(), Elapsed: time.Since(start)}
+	errObj, ok := obj.(*eval.Error)
+	if !ok {
+		return r
+	}
+	r.Status, r.Message = Error, errObj.Message
+	var assertion *eval.AssertionError
+	if errors.As(errObj.Err, &assertion) {
+		r.Status, r.Line, r.Col = Fail, assertion.Line, assertion.Col
+		r.Message = fmt.Sprintf("%s: %s", assertion.Assertion, assertion.Message)
+		if assertion.Expected != "" || assertion.Actual != "" {
+			r.Diff = Diff(assertion.Expected, assertion.Actual)
+		}
+	}
+	return r
+}
+
+// Find returns the *_test.doma files in paths, which are files or
+// directories searched recursively, skipping vendor and hidden directories.
+func Find(paths []string) ([]string, error) {
+	files := make([]string, 0)
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != root && (d.Name() == "vendor" || strings.HasPrefix(d.Name(), ".")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if path == root || strings.HasSuffix(path, "_test.doma") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Diff shows the lines that differ between the expected and actual output,
+// prefixed with - and + respectively. When both are a single line a caret
+// marks the first difference.
+func Diff(expected, actual string) string {
+	a, b := strings.Split(expected, "\n"), strings.Split(actual, "\n")
+	var out strings.Builder
+	if len(a) == 1 && len(b) == 1 {
+		col := 0
+		for col < len(expected) && col < len(actual) && expected[col] == actual[col] {
+			col++
+		}
+		fmt.Fprintf(&out, "- %s\n+ %s\n  %s^\n", expected, actual, strings.Repeat(" ", col))
+		return out.String()
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&out, "  %s\n", a[i])
+			i, j = i+1, j+1
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&out, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return out.String()
+}
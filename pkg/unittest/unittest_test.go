@@ -0,0 +1,121 @@
+package unittest
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const src = `(define data '(1 2))
+(define square (lambda '(x) (* x x)))
+
+(deftest passes
+  (assert-equal 9 (square 3))
+  (assert-true (> (square 2) 3)))
+
+(deftest mutates
+  (cons 0 data)
+  (assert-equal '(0 1 2) data))
+
+(deftest isolated
+  (assert-equal '(1 2) data))
+
+(deftest "fails"
+  (display "out")
+  (assert-equal '(1 2 3) (cons 1 '(2 4)) "lists"))
+
+(deftest errors
+  (assert-error (+ 1 "a") "type mismatch")
+  (undefined))
+
+(deftest forever
+  (define loop (lambda '() (loop)))
+  (loop))
+
+(deftest slow
+  (define spin (lambda '(n) (if (> n 0) (begin (spin (- n 1)) (spin (- n 1))))))
+  (spin 60))
+
+(deftest caught
+  (assert-error (assert-true #f)))
+`
+
+func TestRunFile(t *testing.T) {
+	results := RunFile("a_test.doma", []byte(src), Options{Timeout: 200 * time.Millisecond})
+	want := []struct {
+		name    string
+		status  Status
+		pos     string
+		message string
+	}{
+		{"passes", Pass, "a_test.doma:4:1", ""},
+		{"mutates", Pass, "a_test.doma:8:1", ""},
+		{"isolated", Pass, "a_test.doma:12:1", ""},
+		{"fails", Fail, "a_test.doma:17:3", "assert-equal: expected '(1 2 3), got '(1 2 4): lists"},
+		{"errors", Error, "a_test.doma:19:1", "identifier not found: undefined"},
+		{"forever", Error, "a_test.doma:23:1", "recursion depth limit exceeded (10000 calls)"},
+		{"slow", Error, "a_test.doma:27:1", "evaluation canceled: context deadline exceeded"},
+		{"caught", Fail, "a_test.doma:32:17", "assert-true: #f is #f"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Name != w.name || r.Status != w.status || r.Pos() != w.pos || r.Message != w.message {
+			t.Errorf("result %d = %s %s %s %q, want %s %s %s %q", i, r.Name, r.Status, r.Pos(), r.Message, w.name, w.status, w.pos, w.message)
+		}
+	}
+	if got := results[3]; got.Output != "out\n" || got.Diff != "- '(1 2 3)\n+ '(1 2 4)\n        ^\n" {
+		t.Errorf("fails has output %q and diff %q", got.Output, got.Diff)
+	}
+}
+
+func TestRunFilter(t *testing.T) {
+	results := RunFile("a_test.doma", []byte(src), Options{Run: regexp.MustCompile("^(passes|isolated)$")})
+	if len(results) != 2 || results[0].Name != "passes" || results[1].Name != "isolated" {
+		t.Errorf("got %+v", results)
+	}
+}
+
+func TestRunFileErrors(t *testing.T) {
+	for _, src := range []string{"(deftest a", "(deftest a) (deftest a)", "(+ 1 \"a\") (deftest a)"} {
+		results := RunFile("b_test.doma", []byte(src), Options{})
+		if len(results) != 1 || results[0].Name != "" || results[0].Status != Error {
+			t.Errorf("%s: got %+v", src, results)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	got := Diff("a\nb\nc", "a\nc\nd")
+	if want := "  a\n- b\n  c\n+ d\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReports(t *testing.T) {
+	results := []Result{
+		{File: "a_test.doma", Name: "ok"},
+		{File: "a_test.doma", Name: "bad", Line: 3, Col: 5, Status: Fail, Message: "assert-true: x is #f"},
+		{File: "b_test.doma", Status: Error, Message: "parse error"},
+	}
+	var tap bytes.Buffer
+	WriteTAP(&tap, results)
+	for _, want := range []string{"1..3\n", "ok 1 - a_test.doma: ok\n", "not ok 2 - a_test.doma: bad\n", "  at: \"a_test.doma:3:5\"\n", "not ok 3 - b_test.doma\n"} {
+		if !strings.Contains(tap.String(), want) {
+			t.Errorf("TAP output lacks %q:\n%s", want, tap.String())
+		}
+	}
+	var junit bytes.Buffer
+	if err := WriteJUnit(&junit, results); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<testsuites tests="3" failures="1" errors="1">`, `<testsuite name="b_test.doma" tests="1" failures="0" errors="1"`, `<failure message="assert-true: x is #f">`} {
+		if !strings.Contains(junit.String(), want) {
+			t.Errorf("JUnit output lacks %q:\n%s", want, junit.String())
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package vm
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The primitives below mirror the builtins of eval, including their error
+// messages, so both produce the same results.
+
+func newError(format string, a ...any) *eval.Error {
+	return &eval.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func isError(obj eval.Object) bool {
+	_, ok := obj.(*eval.Error)
+	return ok
+}
+
+func isTruthy(obj eval.Object) bool {
+	if obj == nil || obj.Type() == eval.NIL_OBJ {
+		return false
+	}
+	if b, ok := obj.(*eval.Boolean); ok {
+		return b.Value
+	}
+	return true
+}
+
+func inspect(obj eval.Object) string {
+	if obj == nil {
+		return ""
+	}
+	return obj.Inspect()
+}
+
+func mismatch(obj eval.Object) *eval.Error {
+	return newError("type mismatch - expected number, got %s", typeOf(obj))
+}
+
+func arithmetic(op Opcode, left *eval.Number, right *eval.Number) eval.Object {
+	switch op {
+	case OpAdd:
+		return &eval.Number{Value: left.Value + right.Value}
+	case OpSub:
+		return &eval.Number{Value: left.Value - right.Value}
+	case OpMul:
+		return &eval.Number{Value: left.Value * right.Value}
+	case OpDiv:
+		if right.Value == 0 {
+			return newError("division by zero")
+		}
+		return &eval.Number{Value: left.Value / right.Value}
+	}
+	return newError("unknown operator: %s", op)
+}
+
+func compare(op Opcode, left eval.Object, right eval.Object) eval.Object {
+	if typeOf(left) != typeOf(right) {
+		return newError("type mismatch - %s and %s", typeOf(left), typeOf(right))
+	}
+	if op == OpEq {
+		switch left := left.(type) {
+		case *eval.Number:
+			return &eval.Boolean{Value: left.Value == right.(*eval.Number).Value}
+		case *eval.String:
+			return &eval.Boolean{Value: left.Value == right.(*eval.String).Value}
+		case *eval.Boolean:
+			return &eval.Boolean{Value: left.Value == right.(*eval.Boolean).Value}
+		}
+		return newError("eq on invalid type %s", typeOf(left))
+	}
+	var cmp int
+	switch left := left.(type) {
+	case *eval.Number:
+		cmp = compareOrdered(left.Value, right.(*eval.Number).Value)
+	case *eval.String:
+		cmp = compareOrdered(left.Value, right.(*eval.String).Value)
+	default:
+		return newError("unsupported type %s", typeOf(left))
+	}
+	switch op {
+	case OpLt:
+		return &eval.Boolean{Value: cmp < 0}
+	case OpLte:
+		return &eval.Boolean{Value: cmp <= 0}
+	case OpGt:
+		return &eval.Boolean{Value: cmp > 0}
+	case OpGte:
+		return &eval.Boolean{Value: cmp >= 0}
+	}
+	return newError("unknown operator: %s", op)
+}
+
+func compareOrdered[T int64 | string](a T, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func first(obj eval.Object) eval.Object {
+	lst, ok := obj.(*eval.List)
+	if !ok {
+		return newError("first expects a list, received %s", typeOf(obj))
+	}
+	if len(lst.Args) == 0 {
+		return lst
+	}
+	return lst.Args[0]
+}
+
+func rest(obj eval.Object) eval.Object {
+	lst, ok := obj.(*eval.List)
+	if !ok {
+		return newError("first expects a list, received %s", typeOf(obj))
+	}
+	if len(lst.Args) <= 1 {
+		return &eval.List{Args: make([]eval.Object, 0)}
+	}
+	return &eval.List{Args: lst.Args[1:]}
+}
+
+func length(obj eval.Object) eval.Object {
+	lst, ok := obj.(*eval.List)
+	if !ok {
+		return newError("len expects a list, received %s", typeOf(obj))
+	}
+	return &eval.Number{Value: int64(len(lst.Args))}
+}
+
+func cons(obj eval.Object, lstObj eval.Object) eval.Object {
+	lst, ok := lstObj.(*eval.List)
+	if !ok {
+		return newError("cons expects LIST, got %s", typeOf(lstObj))
+	}
+	// like eval, cons prepends to the list it was given
+	lst.Args = append([]eval.Object{obj}, lst.Args...)
+	return lst
+}
+
+// cons is cons counting the list it makes against the limits of the VM.
+func (vm *VM) cons(obj eval.Object, lstObj eval.Object) eval.Object {
+	if lst, ok := lstObj.(*eval.List); ok {
+		if err := vm.env.AllocList(len(lst.Args) + 1); err != nil {
+			return err
+		}
+	}
+	return cons(obj, lstObj)
+}
+
+func listRef(lstObj eval.Object, idxObj eval.Object) eval.Object {
+	lst, ok := lstObj.(*eval.List)
+	if !ok {
+		return newError("list-ref expects LIST as first arg, got %s", typeOf(lstObj))
+	}
+	idx, ok := idxObj.(*eval.Number)
+	if !ok {
+		return newError("list-ref expects NUMBER as second arg, got %s", typeOf(idxObj))
+	}
+	if idx.Value < 0 || idx.Value >= int64(len(lst.Args)) {
+		return newError("list-ref index %d out of range for list of length %d", idx.Value, len(lst.Args))
+	}
+	return lst.Args[idx.Value]
+}
+
+func unquote(args []eval.Object) (string, *eval.Error) {
+	str := make([]string, 0, len(args))
+	for _, arg := range args {
+		str = append(str, inspect(arg))
+	}
+	s, err := strconv.Unquote("\"" + strings.Join(str, " ") + "\"")
+	if err != nil {
+		return "", newError("error from unquote: %v", err.Error())
+	}
+	return s, nil
+}
+
+// applyBuiltin calls a builtin that was passed around as a value, which only
+// works for the ones that evaluate all of their arguments.
+func (vm *VM) applyBuiltin(b *eval.Builtin, args []eval.Object) eval.Object {
+	n := len(args)
+	switch b.Value {
+	case lexer.PLUS, lexer.MINUS, lexer.ASTERISK, lexer.SLASH:
+		if n == 0 {
+			return newError("no arguments")
+		}
+		acc, ok := args[0].(*eval.Number)
+		if !ok {
+			return mismatch(args[0])
+		}
+		var result eval.Object = acc
+		for _, arg := range args[1:] {
+			num, ok := arg.(*eval.Number)
+			if !ok {
+				return mismatch(arg)
+			}
+			if result = arithmetic(arithmeticOps[b.Value], result.(*eval.Number), num); isError(result) {
+				return result
+			}
+		}
+		return result
+	case lexer.EQ, lexer.LT, lexer.LTE, lexer.GT, lexer.GTE:
+		if n != 2 {
+			name := "eq"
+			if b.Value != lexer.EQ {
+				name = string(b.Value)
+			}
+			return newError("%s expects 2 arguments, got %d", name, n)
+		}
+		return compare(comparisonOps[b.Value], args[0], args[1])
+	case lexer.FIRST, lexer.REST, lexer.LENGTH:
+		if n != 1 {
+			if b.Value == lexer.LENGTH {
+				return newError("len expects 1 argument, got %d", n)
+			}
+			return newError("first expects 1 argument, got %d", n)
+		}
+		switch b.Value {
+		case lexer.FIRST:
+			return first(args[0])
+		case lexer.REST:
+			return rest(args[0])
+		}
+		return length(args[0])
+	case lexer.CONS:
+		if n != 2 {
+			return newError("cons expects 2 arguments, got %d", n)
+		}
+		return vm.cons(args[0], args[1])
+	case lexer.LIST_REF:
+		if n != 2 {
+			return newError("list-ref expects 2 arguments, got %d", n)
+		}
+		return listRef(args[0], args[1])
+	case lexer.DISPLAY:
+		return vm.display(args)
+	case lexer.PRINTF:
+		return vm.printf(args)
+	case lexer.BEGIN:
+		if n == 0 {
+			return nil
+		}
+		return args[n-1]
+	}
+	return newError("%s can't be called indirectly", strings.ToLower(string(b.Value)))
+}
+
+func typeOf(obj eval.Object) eval.ObjectType {
+	if obj == nil {
+		return eval.NIL_OBJ
+	}
+	return obj.Type()
+}
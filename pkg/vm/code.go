@@ -0,0 +1,222 @@
+// Package vm compiles doma programs to bytecode and runs them on a stack
+// based virtual machine. It produces the same values as eval.Eval, which it
+// shares its object types with, but resolves local variables to frame slots
+// at compile time instead of looking names up at run time.
+package vm
+
+import (
+	"doma/pkg/eval"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+type Opcode byte
+
+const (
+	// OpConstant pushes constant a.
+	OpConstant Opcode = iota
+	// OpNil pushes nil, the value of an if without an else branch.
+	OpNil
+	// OpVoid pushes the empty result of display and printf.
+	OpVoid
+	OpPop
+	// OpGetGlobal pushes the global named by constant a.
+	OpGetGlobal
+	// OpDefineGlobal binds the value on top of the stack to the global
+	// named by constant a, leaving the bound value on the stack.
+	OpDefineGlobal
+	// OpGetLocal pushes slot b of the frame a levels up.
+	OpGetLocal
+	// OpDefineLocal binds the value on top of the stack to slot a of the
+	// current frame, leaving the bound value on the stack.
+	OpDefineLocal
+	// OpClosure pushes a procedure for the function in constant a that
+	// captures the current frame.
+	OpClosure
+	// OpCallable fails with an unknown procedure error, naming constant a,
+	// unless the value on top of the stack can be called.
+	OpCallable
+	// OpCall calls the value below the top a values with them as arguments.
+	OpCall
+	OpReturn
+	// OpJump continues at offset a.
+	OpJump
+	// OpJumpIfFalse pops a value and continues at offset a if it is falsy.
+	OpJumpIfFalse
+	// OpError fails with the error in constant a.
+	OpError
+	// OpNumber fails unless the value on top of the stack is a number.
+	OpNumber
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpEq
+	OpLt
+	OpLte
+	OpGt
+	OpGte
+	OpFirst
+	OpRest
+	OpLength
+	OpCons
+	OpListRef
+	// OpDisplay prints the top a values.
+	OpDisplay
+	// OpPrintf prints the top a values, interpreting escapes.
+	OpPrintf
+	// OpList replaces the top a values with a list of them.
+	OpList
+)
+
+// operands holds the number of two byte operands each opcode takes.
+var operands = [...]int{
+	OpConstant:     1,
+	OpGetGlobal:    1,
+	OpDefineGlobal: 1,
+	OpGetLocal:     2,
+	OpDefineLocal:  1,
+	OpClosure:      1,
+	OpCallable:     1,
+	OpCall:         1,
+	OpJump:         1,
+	OpJumpIfFalse:  1,
+	OpError:        1,
+	OpDisplay:      1,
+	OpPrintf:       1,
+	OpList:         1,
+}
+
+var opNames = [...]string{
+	OpConstant:     "CONSTANT",
+	OpNil:          "NIL",
+	OpVoid:         "VOID",
+	OpPop:          "POP",
+	OpGetGlobal:    "GET_GLOBAL",
+	OpDefineGlobal: "DEFINE_GLOBAL",
+	OpGetLocal:     "GET_LOCAL",
+	OpDefineLocal:  "DEFINE_LOCAL",
+	OpClosure:      "CLOSURE",
+	OpCallable:     "CALLABLE",
+	OpCall:         "CALL",
+	OpReturn:       "RETURN",
+	OpJump:         "JUMP",
+	OpJumpIfFalse:  "JUMP_IF_FALSE",
+	OpError:        "ERROR",
+	OpNumber:       "NUMBER",
+	OpAdd:          "ADD",
+	OpSub:          "SUB",
+	OpMul:          "MUL",
+	OpDiv:          "DIV",
+	OpEq:           "EQ",
+	OpLt:           "LT",
+	OpLte:          "LTE",
+	OpGt:           "GT",
+	OpGte:          "GTE",
+	OpFirst:        "FIRST",
+	OpRest:         "REST",
+	OpLength:       "LENGTH",
+	OpCons:         "CONS",
+	OpListRef:      "LIST_REF",
+	OpDisplay:      "DISPLAY",
+	OpPrintf:       "PRINTF",
+	OpList:         "LIST",
+}
+
+func (op Opcode) String() string {
+	if int(op) < len(opNames) && opNames[op] != "" {
+		return opNames[op]
+	}
+	return fmt.Sprintf("OP_%d", op)
+}
+
+// Operands returns the number of operands op takes.
+func (op Opcode) Operands() int {
+	if int(op) < len(operands) {
+		return operands[op]
+	}
+	return 0
+}
+
+// Function is a compiled lambda, or the top level of a program.
+type Function struct {
+	Name string
+	// Params is the number of parameters, which take the first slots.
+	Params int
+	// Slots names the variables of a call frame: the parameters followed
+	// by the names defined in the body.
+	Slots     []string
+	Code      []byte
+	Constants []eval.Object
+	// Positions maps code offsets to source positions.
+	Positions []Position
+}
+
+// Position records that the instructions from Offset on were compiled from
+// the source at Line and Col.
+type Position struct {
+	Offset int
+	Line   int
+	Col    int
+}
+
+func (f *Function) Type() eval.ObjectType { return "FUNCTION" }
+func (f *Function) Inspect() string {
+	return fmt.Sprintf("#<function:%s>", f.Name)
+}
+
+// PositionAt returns the source position of the instruction at offset.
+func (f *Function) PositionAt(offset int) (Position, bool) {
+	var found Position
+	ok := false
+	for _, pos := range f.Positions {
+		if pos.Offset > offset {
+			break
+		}
+		found, ok = pos, true
+	}
+	return found, ok
+}
+
+func operand(code []byte, ip int) int {
+	return int(binary.BigEndian.Uint16(code[ip:]))
+}
+
+// Disassemble renders the code of fn and the functions nested in it.
+func Disassemble(fn *Function) string {
+	var out strings.Builder
+	disassemble(&out, fn)
+	return out.String()
+}
+
+func disassemble(out *strings.Builder, fn *Function) {
+	fmt.Fprintf(out, "%s (%d params, slots %v):\n", fn.Name, fn.Params, fn.Slots)
+	for ip := 0; ip < len(fn.Code); {
+		op := Opcode(fn.Code[ip])
+		fmt.Fprintf(out, "  %04d %s", ip, op)
+		ip++
+		for i := 0; i < op.Operands(); i++ {
+			arg := operand(fn.Code, ip)
+			fmt.Fprintf(out, " %d", arg)
+			if i == 0 && hasConstant(op) && arg < len(fn.Constants) {
+				fmt.Fprintf(out, " (%s)", fn.Constants[arg].Inspect())
+			}
+			ip += 2
+		}
+		out.WriteString("\n")
+	}
+	for _, c := range fn.Constants {
+		if nested, ok := c.(*Function); ok {
+			disassemble(out, nested)
+		}
+	}
+}
+
+func hasConstant(op Opcode) bool {
+	switch op {
+	case OpConstant, OpGetGlobal, OpDefineGlobal, OpClosure, OpCallable, OpError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,388 @@
+package vm
+
+import (
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Compile translates program into the function that runs its top level.
+// Mistakes such as malformed special forms don't stop compilation; like in
+// eval.Eval they are reported when the faulty code runs.
+func Compile(program *parser.Program) (*Function, error) {
+	c := &compiler{fn: &Function{Name: "main", Slots: make([]string, 0)}, constIndex: make(map[string]int)}
+	if len(program.Args) == 0 {
+		c.emit(OpVoid)
+	}
+	for i, expr := range program.Args {
+		if i > 0 {
+			c.emit(OpPop)
+		}
+		c.expr(expr)
+	}
+	c.emit(OpReturn)
+	return c.fn, c.err
+}
+
+type compiler struct {
+	fn         *Function
+	constIndex map[string]int
+	// slots maps the names of the frame being compiled to their slots, and
+	// is nil at the top level where every name is global.
+	slots map[string]int
+	outer *compiler
+	err   error
+}
+
+func (c *compiler) emit(op Opcode, args ...int) int {
+	pos := len(c.fn.Code)
+	c.fn.Code = append(c.fn.Code, byte(op))
+	for _, arg := range args {
+		if arg < 0 || arg > math.MaxUint16 {
+			c.fail("operand %d of %s out of range", arg, op)
+			arg = 0
+		}
+		c.fn.Code = binary.BigEndian.AppendUint16(c.fn.Code, uint16(arg))
+	}
+	return pos
+}
+
+func (c *compiler) fail(format string, a ...any) {
+	if c.err == nil {
+		c.err = fmt.Errorf(format, a...)
+	}
+	if c.outer != nil {
+		c.outer.fail(format, a...)
+	}
+}
+
+// mark records that the code emitted next comes from tok.
+func (c *compiler) mark(tok lexer.Token) {
+	if tok.Line == 0 {
+		return
+	}
+	n := len(c.fn.Positions)
+	if n > 0 {
+		last := c.fn.Positions[n-1]
+		if last.Line == tok.Line && last.Col == tok.Col {
+			return
+		}
+		if last.Offset == len(c.fn.Code) {
+			c.fn.Positions = c.fn.Positions[:n-1]
+		}
+	}
+	c.fn.Positions = append(c.fn.Positions, Position{Offset: len(c.fn.Code), Line: tok.Line, Col: tok.Col})
+}
+
+// patch points the jump at pos to the end of the code.
+func (c *compiler) patch(pos int) {
+	target := len(c.fn.Code)
+	if target > math.MaxUint16 {
+		c.fail("jump target %d out of range", target)
+		return
+	}
+	binary.BigEndian.PutUint16(c.fn.Code[pos+1:], uint16(target))
+}
+
+func (c *compiler) constant(obj eval.Object) int {
+	var key string
+	switch obj := obj.(type) {
+	case *eval.Number:
+		key = fmt.Sprintf("n%d", obj.Value)
+	case *eval.String:
+		key = "s" + obj.Value
+	case *eval.Symbol:
+		key = "y" + obj.Value
+	case *eval.Boolean:
+		key = fmt.Sprintf("b%t", obj.Value)
+	}
+	if key != "" {
+		if idx, ok := c.constIndex[key]; ok {
+			return idx
+		}
+		c.constIndex[key] = len(c.fn.Constants)
+	}
+	c.fn.Constants = append(c.fn.Constants, obj)
+	return len(c.fn.Constants) - 1
+}
+
+func (c *compiler) name(name string) int {
+	return c.constant(&eval.String{Value: name})
+}
+
+func (c *compiler) error(format string, a ...any) {
+	c.emit(OpError, c.constant(&eval.Error{Message: fmt.Sprintf(format, a...)}))
+}
+
+func (c *compiler) expr(expr parser.Expression) {
+	switch expr := expr.(type) {
+	case *parser.Number:
+		c.emit(OpConstant, c.constant(&eval.Number{Value: expr.Value}))
+	case *parser.String:
+		c.emit(OpConstant, c.constant(&eval.String{Value: expr.Value}))
+	case *parser.Boolean:
+		c.emit(OpConstant, c.constant(&eval.Boolean{Value: expr.Value}))
+	case *parser.Symbol:
+		c.emit(OpConstant, c.constant(&eval.Symbol{Value: expr.Value}))
+	case *parser.BuiltinIdentifier:
+		c.emit(OpConstant, c.constant(&eval.Builtin{Value: expr.Token.Type}))
+	case *parser.Identifier:
+		c.mark(expr.Token)
+		c.identifier(expr.Value)
+	case *parser.List:
+		for _, arg := range expr.Args {
+			switch arg := arg.(type) {
+			case *parser.Identifier:
+				c.emit(OpConstant, c.constant(&eval.Symbol{Value: arg.Value}))
+			case *parser.BuiltinIdentifier:
+				c.emit(OpConstant, c.constant(&eval.Symbol{Value: arg.Value}))
+			default:
+				c.expr(arg)
+			}
+		}
+		c.emit(OpList, len(expr.Args))
+	case *parser.Form:
+		c.mark(expr.Token)
+		c.form(expr)
+	default:
+		// eval.Eval returns nothing for expressions it doesn't know
+		c.emit(OpVoid)
+	}
+}
+
+func (c *compiler) identifier(name string) {
+	depth := 0
+	for scope := c; scope != nil && scope.slots != nil; scope = scope.outer {
+		if slot, ok := scope.slots[name]; ok {
+			c.emit(OpGetLocal, depth, slot)
+			return
+		}
+		depth++
+	}
+	c.emit(OpGetGlobal, c.name(name))
+}
+
+func (c *compiler) form(form *parser.Form) {
+	if head, ok := form.First.(*parser.BuiltinIdentifier); ok {
+		c.builtin(head.Token.Type, form)
+		return
+	}
+	c.expr(form.First)
+	c.emit(OpCallable, c.constant(&eval.Error{Message: fmt.Sprintf("unknown procedure: %s", form.First)}))
+	for _, arg := range form.Rest {
+		c.expr(arg)
+	}
+	c.mark(form.Token)
+	c.emit(OpCall, len(form.Rest))
+}
+
+func (c *compiler) args(form *parser.Form) {
+	for _, arg := range form.Rest {
+		c.expr(arg)
+	}
+	c.mark(form.Token)
+}
+
+func (c *compiler) builtin(op lexer.TokenType, form *parser.Form) {
+	n := len(form.Rest)
+	switch op {
+	case lexer.PLUS, lexer.MINUS, lexer.ASTERISK, lexer.SLASH:
+		if n == 0 {
+			c.error("no arguments")
+			return
+		}
+		c.expr(form.Rest[0])
+		c.emit(OpNumber)
+		for _, arg := range form.Rest[1:] {
+			c.expr(arg)
+			c.mark(form.Token)
+			c.emit(arithmeticOps[op])
+		}
+	case lexer.EQ, lexer.LT, lexer.LTE, lexer.GT, lexer.GTE:
+		if n != 2 {
+			name := "eq"
+			if op != lexer.EQ {
+				name = string(op)
+			}
+			c.error("%s expects 2 arguments, got %d", name, n)
+			return
+		}
+		c.args(form)
+		c.emit(comparisonOps[op])
+	case lexer.FIRST, lexer.REST, lexer.LENGTH:
+		if n != 1 {
+			name := "first"
+			if op == lexer.LENGTH {
+				name = "len"
+			}
+			c.error("%s expects 1 argument, got %d", name, n)
+			return
+		}
+		c.args(form)
+		c.emit(map[lexer.TokenType]Opcode{lexer.FIRST: OpFirst, lexer.REST: OpRest, lexer.LENGTH: OpLength}[op])
+	case lexer.CONS, lexer.LIST_REF:
+		if n != 2 {
+			name := "cons"
+			if op == lexer.LIST_REF {
+				name = "list-ref"
+			}
+			c.error("%s expects 2 arguments, got %d", name, n)
+			return
+		}
+		c.args(form)
+		if op == lexer.CONS {
+			c.emit(OpCons)
+		} else {
+			c.emit(OpListRef)
+		}
+	case lexer.DISPLAY:
+		c.args(form)
+		c.emit(OpDisplay, n)
+	case lexer.PRINTF:
+		c.args(form)
+		c.emit(OpPrintf, n)
+	case lexer.BEGIN:
+		if n == 0 {
+			c.emit(OpVoid)
+		}
+		for i, arg := range form.Rest {
+			if i > 0 {
+				c.emit(OpPop)
+			}
+			c.expr(arg)
+		}
+	case lexer.IF:
+		c.ifForm(form)
+	case lexer.DEFINE:
+		c.define(form)
+	case lexer.LAMBDA:
+		c.lambda(form)
+	case lexer.MODULE, lexer.EXPORT, lexer.IMPORT, lexer.REQUIRE, lexer.DEFTEST:
+		c.error("%s is not supported in compiled code", strings.ToLower(string(op)))
+	default:
+		c.error("unknown identifier: %s", op)
+	}
+}
+
+var arithmeticOps = map[lexer.TokenType]Opcode{
+	lexer.PLUS:     OpAdd,
+	lexer.MINUS:    OpSub,
+	lexer.ASTERISK: OpMul,
+	lexer.SLASH:    OpDiv,
+}
+
+var comparisonOps = map[lexer.TokenType]Opcode{
+	lexer.EQ:  OpEq,
+	lexer.LT:  OpLt,
+	lexer.LTE: OpLte,
+	lexer.GT:  OpGt,
+	lexer.GTE: OpGte,
+}
+
+func (c *compiler) ifForm(form *parser.Form) {
+	if len(form.Rest) < 2 {
+		c.error("if expects 2 arguments, got %d", len(form.Rest))
+		return
+	}
+	c.expr(form.Rest[0])
+	jumpElse := c.emit(OpJumpIfFalse, 0)
+	c.expr(form.Rest[1])
+	jumpEnd := c.emit(OpJump, 0)
+	c.patch(jumpElse)
+	if len(form.Rest) >= 3 {
+		c.expr(form.Rest[2])
+	} else {
+		c.emit(OpNil)
+	}
+	c.patch(jumpEnd)
+}
+
+func (c *compiler) define(form *parser.Form) {
+	if len(form.Rest) != 2 {
+		c.error("define expects 2 arguments, got %d", len(form.Rest))
+		return
+	}
+	name, ok := form.Rest[0].(*parser.Identifier)
+	if !ok {
+		c.error("define expects first argument to be identifier, got %s", form.Rest[0].TokenLiteral())
+		return
+	}
+	c.expr(form.Rest[1])
+	c.mark(form.Token)
+	if c.slots == nil {
+		c.emit(OpDefineGlobal, c.name(name.Value))
+	} else {
+		c.emit(OpDefineLocal, c.slots[name.Value])
+	}
+}
+
+func (c *compiler) lambda(form *parser.Form) {
+	if len(form.Rest) < 2 {
+		c.error("lambda expects at least 2 arguments, got %d", len(form.Rest))
+		return
+	}
+	lst, ok := form.Rest[0].(*parser.List)
+	if !ok {
+		c.error("lambda expects first argument to be a list, got %s", form.First.TokenLiteral())
+		return
+	}
+	fn := &Function{Name: "lambda", Params: len(lst.Args), Slots: make([]string, 0)}
+	inner := &compiler{fn: fn, constIndex: make(map[string]int), slots: make(map[string]int), outer: c}
+	for _, arg := range lst.Args {
+		ident, ok := arg.(*parser.Identifier)
+		if !ok {
+			c.error("lambda args expect to be all parameters to be identifiers, got %s", arg.TokenLiteral())
+			return
+		}
+		// a repeated parameter is bound to the last argument given for it
+		inner.slots[ident.Value] = len(fn.Slots)
+		fn.Slots = append(fn.Slots, ident.Value)
+	}
+	for _, expr := range form.Rest[1:] {
+		inner.hoist(expr)
+	}
+	for i, expr := range form.Rest[1:] {
+		if i > 0 {
+			inner.emit(OpPop)
+		}
+		inner.expr(expr)
+	}
+	inner.emit(OpReturn)
+	c.emit(OpClosure, c.constant(fn))
+}
+
+// hoist gives every name defined in the body of the function being compiled
+// a slot, since define binds in the environment of the call wherever in the
+// body it appears.
+func (c *compiler) hoist(expr parser.Expression) {
+	switch expr := expr.(type) {
+	case *parser.Form:
+		if head, ok := expr.First.(*parser.BuiltinIdentifier); ok {
+			switch head.Token.Type {
+			case lexer.LAMBDA:
+				return
+			case lexer.DEFINE:
+				if len(expr.Rest) == 2 {
+					if name, ok := expr.Rest[0].(*parser.Identifier); ok {
+						if _, ok := c.slots[name.Value]; !ok {
+							c.slots[name.Value] = len(c.fn.Slots)
+							c.fn.Slots = append(c.fn.Slots, name.Value)
+						}
+					}
+				}
+			}
+		}
+		c.hoist(expr.First)
+		for _, arg := range expr.Rest {
+			c.hoist(arg)
+		}
+	case *parser.List:
+		for _, arg := range expr.Args {
+			c.hoist(arg)
+		}
+	}
+}
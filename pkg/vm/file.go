@@ -0,0 +1,383 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version is the version of the compiled file format. Files written with
+// another version are rejected and have to be rebuilt.
+const Version = 1
+
+const magic = "DOMAC"
+
+// ErrFormat is returned when decoding data that isn't a compiled program.
+var ErrFormat = errors.New("not a compiled doma file")
+
+// Module is a compiled program as stored in a .domac file.
+type Module struct {
+	// Source is the path of the file the program was compiled from,
+	// relative to the directory of the compiled file.
+	Source string
+	// Hash is the SHA-256 of the source, used to notice that the compiled
+	// file is out of date.
+	Hash [sha256.Size]byte
+	Main *Function
+}
+
+// NewModule returns the module for main, compiled from source.
+func NewModule(main *Function, path string, source []byte) *Module {
+	return &Module{Source: path, Hash: sha256.Sum256(source), Main: main}
+}
+
+// Stale reports whether source differs from what the module was compiled from.
+func (m *Module) Stale(source []byte) bool {
+	return sha256.Sum256(source) != m.Hash
+}
+
+// MarshalBinary encodes the module: a header with the format version, the
+// source path and hash, followed by the main function. A function is stored
+// as its name, parameter count, slot names, code, constant pool and position
+// table, with nested functions stored inline in the constant pool.
+func (m *Module) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	e.buf.WriteString(magic)
+	e.uint(Version)
+	e.string(m.Source)
+	e.buf.Write(m.Hash[:])
+	e.function(m.Main)
+	return e.buf.Bytes(), e.err
+}
+
+// UnmarshalBinary decodes a module written by MarshalBinary.
+func (m *Module) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return ErrFormat
+	}
+	d := &decoder{data: data[len(magic):]}
+	if version := d.uint(); d.err == nil && version != Version {
+		return fmt.Errorf("compiled with format version %d, want %d", version, Version)
+	}
+	m.Source = d.string()
+	copy(m.Hash[:], d.bytes(sha256.Size))
+	m.Main = d.function()
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf("%w: %d trailing bytes", ErrFormat, len(d.data))
+	}
+	if d.err == nil {
+		d.validate(m.Main, nil)
+	}
+	return d.err
+}
+
+// constant tags
+const (
+	tagNumber byte = iota + 1
+	tagString
+	tagSymbol
+	tagBoolean
+	tagBuiltin
+	tagError
+	tagFunction
+)
+
+type encoder struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (e *encoder) uint(n int) {
+	e.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (e *encoder) string(s string) {
+	e.uint(len(s))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) function(fn *Function) {
+	e.string(fn.Name)
+	e.uint(fn.Params)
+	e.uint(len(fn.Slots))
+	for _, slot := range fn.Slots {
+		e.string(slot)
+	}
+	e.uint(len(fn.Code))
+	e.buf.Write(fn.Code)
+	e.uint(len(fn.Constants))
+	for _, c := range fn.Constants {
+		e.constant(c)
+	}
+	e.uint(len(fn.Positions))
+	for _, pos := range fn.Positions {
+		e.uint(pos.Offset)
+		e.uint(pos.Line)
+		e.uint(pos.Col)
+	}
+}
+
+func (e *encoder) constant(obj eval.Object) {
+	switch obj := obj.(type) {
+	case *eval.Number:
+		e.buf.WriteByte(tagNumber)
+		e.buf.Write(binary.AppendVarint(nil, obj.Value))
+	case *eval.String:
+		e.buf.WriteByte(tagString)
+		e.string(obj.Value)
+	case *eval.Symbol:
+		e.buf.WriteByte(tagSymbol)
+		e.string(obj.Value)
+	case *eval.Boolean:
+		e.buf.WriteByte(tagBoolean)
+		if obj.Value {
+			e.buf.WriteByte(1)
+		} else {
+			e.buf.WriteByte(0)
+		}
+	case *eval.Builtin:
+		e.buf.WriteByte(tagBuiltin)
+		e.string(string(obj.Value))
+	case *eval.Error:
+		e.buf.WriteByte(tagError)
+		e.string(obj.Message)
+	case *Function:
+		e.buf.WriteByte(tagFunction)
+		e.function(obj)
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("cannot encode constant of type %s", obj.Type())
+		}
+	}
+}
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: truncated or corrupt", ErrFormat)
+	}
+	d.data = nil
+}
+
+func (d *decoder) uint() int {
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 || n > 1<<31 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[size:]
+	return int(n)
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n > len(d.data) {
+		d.fail()
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.bytes(1); len(b) == 1 {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.uint()))
+}
+
+// count reads the length of a sequence, each element of which takes at
+// least one byte, so that corrupt lengths can't cause huge allocations.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > len(d.data) {
+		d.fail()
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) function() *Function {
+	fn := &Function{Name: d.string(), Params: d.uint()}
+	fn.Slots = make([]string, d.count())
+	for i := range fn.Slots {
+		fn.Slots[i] = d.string()
+	}
+	fn.Code = d.bytes(d.uint())
+	fn.Constants = make([]eval.Object, d.count())
+	for i := range fn.Constants {
+		fn.Constants[i] = d.constant()
+	}
+	fn.Positions = make([]Position, d.count())
+	for i := range fn.Positions {
+		fn.Positions[i] = Position{Offset: d.uint(), Line: d.uint(), Col: d.uint()}
+	}
+	return fn
+}
+
+func (d *decoder) constant() eval.Object {
+	switch d.byte() {
+	case tagNumber:
+		n, size := binary.Varint(d.data)
+		if size <= 0 {
+			d.fail()
+			return nil
+		}
+		d.data = d.data[size:]
+		return &eval.Number{Value: n}
+	case tagString:
+		return &eval.String{Value: d.string()}
+	case tagSymbol:
+		return &eval.Symbol{Value: d.string()}
+	case tagBoolean:
+		return &eval.Boolean{Value: d.byte() != 0}
+	case tagBuiltin:
+		return &eval.Builtin{Value: lexer.TokenType(d.string())}
+	case tagError:
+		return &eval.Error{Message: d.string()}
+	case tagFunction:
+		return d.function()
+	}
+	d.fail()
+	return nil
+}
+
+// validate checks that the code of fn and of the functions nested in it
+// only refers to constants, frames and slots that exist, never pops more
+// than it pushed and ends every path in a return, so that running a corrupt
+// file fails to load instead of crashing the VM. frames holds the functions
+// whose frames fn can see, innermost first, which is none at the top level.
+func (d *decoder) validate(fn *Function, frames []*Function) {
+	if fn.Params > len(fn.Slots) || !verify(fn, frames) {
+		d.fail()
+		return
+	}
+	for _, c := range fn.Constants {
+		if inner, ok := c.(*Function); ok {
+			d.validate(inner, append([]*Function{inner}, frames...))
+			if d.err != nil {
+				return
+			}
+		}
+	}
+}
+
+func verify(fn *Function, frames []*Function) bool {
+	code := fn.Code
+	start := make([]bool, len(code))
+	for ip := 0; ip < len(code); ip += 1 + 2*Opcode(code[ip]).Operands() {
+		op := Opcode(code[ip])
+		if int(op) >= len(opNames) || ip+1+2*op.Operands() > len(code) {
+			return false
+		}
+		start[ip] = true
+	}
+	// height holds the stack height before each instruction, or -1 until
+	// a path through the code reaches it
+	height := make([]int, len(code))
+	for i := range height {
+		height[i] = -1
+	}
+	if len(code) == 0 {
+		return false
+	}
+	height[0] = 0
+	work := []int{0}
+	for len(work) > 0 {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		op := Opcode(code[ip])
+		arg := 0
+		if op.Operands() > 0 {
+			arg = operand(code, ip+1)
+		}
+		if !validOperands(fn, frames, op, code, ip) {
+			return false
+		}
+		pops, pushes := stackEffect(op, arg)
+		h := height[ip]
+		if h < pops || (op == OpReturn && h != 1) {
+			return false
+		}
+		h += pushes - pops
+		next := ip + 1 + 2*op.Operands()
+		var targets []int
+		switch op {
+		case OpReturn, OpError:
+		case OpJump:
+			targets = []int{arg}
+		case OpJumpIfFalse:
+			targets = []int{next, arg}
+		default:
+			targets = []int{next}
+		}
+		for _, target := range targets {
+			if target >= len(code) || !start[target] {
+				return false
+			}
+			if height[target] == -1 {
+				height[target] = h
+				work = append(work, target)
+			} else if height[target] != h {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func validOperands(fn *Function, frames []*Function, op Opcode, code []byte, ip int) bool {
+	if op.Operands() == 0 {
+		return true
+	}
+	arg := operand(code, ip+1)
+	var constant eval.Object
+	if hasConstant(op) && arg < len(fn.Constants) {
+		constant = fn.Constants[arg]
+	}
+	_, isName := constant.(*eval.String)
+	_, isFunction := constant.(*Function)
+	switch {
+	case hasConstant(op) && constant == nil,
+		(op == OpGetGlobal || op == OpDefineGlobal) && !isName,
+		op == OpClosure && !isFunction,
+		op == OpDefineLocal && (len(frames) == 0 || arg >= len(frames[0].Slots)):
+		return false
+	case op == OpGetLocal:
+		slot := operand(code, ip+3)
+		return arg < len(frames) && slot < len(frames[arg].Slots)
+	}
+	return true
+}
+
+// stackEffect returns how many values op pops and pushes.
+func stackEffect(op Opcode, arg int) (int, int) {
+	switch op {
+	case OpConstant, OpNil, OpVoid, OpGetGlobal, OpGetLocal, OpClosure:
+		return 0, 1
+	case OpPop, OpJumpIfFalse, OpReturn:
+		return 1, 0
+	case OpJump, OpError:
+		return 0, 0
+	case OpCall:
+		return arg + 1, 1
+	case OpDisplay, OpPrintf, OpList:
+		return arg, 1
+	case OpAdd, OpSub, OpMul, OpDiv, OpEq, OpLt, OpLte, OpGt, OpGte, OpCons, OpListRef:
+		return 2, 1
+	}
+	// the rest replace the value on top of the stack
+	return 1, 1
+}
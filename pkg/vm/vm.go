@@ -0,0 +1,375 @@
+package vm
+
+import (
+	"context"
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Closure is a compiled lambda together with the frame it was created in.
+// It behaves like eval.Lambda, or eval.Procedure once it has been defined
+// under a name.
+type Closure struct {
+	Fn   *Function
+	Name string
+	env  *frame
+}
+
+func (c *Closure) Type() eval.ObjectType {
+	if c.Name != "" {
+		return eval.PROCEDURE_OBJ
+	}
+	return eval.LAMBDA_OBJ
+}
+func (c *Closure) Inspect() string {
+	if c.Name != "" {
+		return fmt.Sprintf("#<procedure:%s>", c.Name)
+	}
+	return "#<procedure>"
+}
+
+// frame holds the variables of a call.
+type frame struct {
+	fn     *Function
+	slots  []eval.Object
+	parent *frame
+}
+
+type callFrame struct {
+	fn   *Function
+	ip   int
+	env  *frame
+	base int
+}
+
+type VM struct {
+	env     *eval.Env
+	globals map[string]eval.Object
+	stack   []eval.Object
+}
+
+// New returns a VM whose globals are the names bound in env, usually the
+// natives of an eval.Interpreter. It honors the capabilities, Limits and
+// output of env like the interpreter does. env may be nil.
+func New(env *eval.Env) *VM {
+	if env == nil {
+		env = eval.NewEnv()
+	}
+	vm := &VM{env: env, globals: make(map[string]eval.Object)}
+	for _, name := range env.Names() {
+		vm.globals[name], _ = env.Get(name)
+	}
+	return vm
+}
+
+// SetOutput redirects display and printf, like eval.Env.SetOutput does for
+// the environment the VM was created with.
+func (vm *VM) SetOutput(w io.Writer) {
+	vm.env.SetOutput(w)
+}
+
+// Get returns the value of a global.
+func (vm *VM) Get(name string) (eval.Object, bool) {
+	obj, ok := vm.globals[name]
+	return obj, ok
+}
+
+// Run executes the top level of a compiled program and returns the value of
+// its last expression or the *eval.Error that stopped it. Globals defined by
+// one run are visible to the next.
+func (vm *VM) Run(main *Function) eval.Object {
+	return vm.RunContext(nil, main)
+}
+
+// RunContext is like Run, but stops with an error once ctx is done.
+func (vm *VM) RunContext(ctx context.Context, main *Function) eval.Object {
+	return vm.env.Run(ctx, func() eval.Object { return vm.run(main) })
+}
+
+func (vm *VM) run(main *Function) eval.Object {
+	vm.stack = vm.stack[:0]
+	frames := []callFrame{{fn: main}}
+	fr := &frames[0]
+	defer func() {
+		// calls still open when an error stopped the run
+		for range frames[1:] {
+			vm.env.Leave()
+		}
+	}()
+	for {
+		if err := vm.env.Step(); err != nil {
+			return err
+		}
+		code := fr.fn.Code
+		op := Opcode(code[fr.ip])
+		fr.ip++
+		switch op {
+		case OpConstant:
+			vm.push(fr.fn.Constants[operand(code, fr.ip)])
+			fr.ip += 2
+		case OpNil:
+			vm.push(&eval.Nil{})
+		case OpVoid:
+			vm.push(nil)
+		case OpPop:
+			vm.pop()
+		case OpGetGlobal:
+			name := fr.fn.Constants[operand(code, fr.ip)].(*eval.String).Value
+			fr.ip += 2
+			obj, ok := vm.globals[name]
+			if !ok {
+				return newError("identifier not found: %s", name)
+			}
+			vm.push(obj)
+		case OpDefineGlobal:
+			name := fr.fn.Constants[operand(code, fr.ip)].(*eval.String).Value
+			fr.ip += 2
+			obj := named(vm.pop(), name)
+			vm.globals[name] = obj
+			vm.push(obj)
+		case OpGetLocal:
+			depth, slot := operand(code, fr.ip), operand(code, fr.ip+2)
+			fr.ip += 4
+			env := fr.env
+			for i := 0; i < depth; i++ {
+				env = env.parent
+			}
+			obj := env.slots[slot]
+			if obj == nil {
+				// not defined yet, so the name still refers to an outer one
+				var ok bool
+				if obj, ok = vm.lookup(env.parent, env.fn.Slots[slot]); !ok {
+					return newError("identifier not found: %s", env.fn.Slots[slot])
+				}
+			}
+			vm.push(obj)
+		case OpDefineLocal:
+			slot := operand(code, fr.ip)
+			fr.ip += 2
+			obj := named(vm.pop(), fr.env.fn.Slots[slot])
+			fr.env.slots[slot] = obj
+			vm.push(obj)
+		case OpClosure:
+			fn := fr.fn.Constants[operand(code, fr.ip)].(*Function)
+			fr.ip += 2
+			vm.push(&Closure{Fn: fn, env: fr.env})
+		case OpCallable:
+			idx := operand(code, fr.ip)
+			fr.ip += 2
+			switch vm.peek(0).(type) {
+			case *Closure, *eval.Native, *eval.Builtin:
+			default:
+				return fr.fn.Constants[idx]
+			}
+		case OpCall:
+			argc := operand(code, fr.ip)
+			fr.ip += 2
+			base := len(vm.stack) - argc - 1
+			switch callee := vm.stack[base].(type) {
+			case *Closure:
+				if err := vm.env.Enter(); err != nil {
+					return err
+				}
+				env := &frame{fn: callee.Fn, slots: make([]eval.Object, len(callee.Fn.Slots)), parent: callee.env}
+				for i := 0; i < callee.Fn.Params; i++ {
+					if i < argc {
+						env.slots[i] = vm.stack[base+1+i]
+					} else {
+						env.slots[i] = &eval.Nil{}
+					}
+				}
+				vm.stack = vm.stack[:base]
+				frames = append(frames, callFrame{fn: callee.Fn, env: env, base: base})
+				fr = &frames[len(frames)-1]
+			default:
+				result := vm.Apply(callee, vm.stack[base+1:])
+				if err, ok := result.(*eval.Error); ok {
+					return err
+				}
+				vm.stack = vm.stack[:base]
+				vm.push(result)
+			}
+		case OpReturn:
+			result := vm.pop()
+			if len(frames) == 1 {
+				return result
+			}
+			frames = frames[:len(frames)-1]
+			fr = &frames[len(frames)-1]
+			vm.env.Leave()
+			vm.push(result)
+		case OpJump:
+			fr.ip = operand(code, fr.ip)
+		case OpJumpIfFalse:
+			target := operand(code, fr.ip)
+			fr.ip += 2
+			if !isTruthy(vm.pop()) {
+				fr.ip = target
+			}
+		case OpError:
+			return fr.fn.Constants[operand(code, fr.ip)]
+		case OpNumber:
+			if _, ok := vm.peek(0).(*eval.Number); !ok {
+				return mismatch(vm.peek(0))
+			}
+		case OpAdd, OpSub, OpMul, OpDiv:
+			right := vm.pop()
+			r, ok := right.(*eval.Number)
+			if !ok {
+				return mismatch(right)
+			}
+			left := vm.pop()
+			// OpNumber has checked the left operand in compiled code
+			l, ok := left.(*eval.Number)
+			if !ok {
+				return mismatch(left)
+			}
+			result := arithmetic(op, l, r)
+			if isError(result) {
+				return result
+			}
+			vm.push(result)
+		default:
+			result := vm.primitive(op, code, fr)
+			if isError(result) {
+				return result
+			}
+		}
+	}
+}
+
+// primitive runs the opcodes for builtins that take their arguments from the
+// stack and push a single result.
+func (vm *VM) primitive(op Opcode, code []byte, fr *callFrame) eval.Object {
+	var result eval.Object
+	switch op {
+	case OpEq, OpLt, OpLte, OpGt, OpGte:
+		right := vm.pop()
+		result = compare(op, vm.pop(), right)
+	case OpFirst:
+		result = first(vm.pop())
+	case OpRest:
+		result = rest(vm.pop())
+	case OpLength:
+		result = length(vm.pop())
+	case OpCons:
+		lst := vm.pop()
+		result = vm.cons(vm.pop(), lst)
+	case OpListRef:
+		idx := vm.pop()
+		result = listRef(vm.pop(), idx)
+	case OpDisplay, OpPrintf, OpList:
+		n := operand(code, fr.ip)
+		fr.ip += 2
+		args := vm.stack[len(vm.stack)-n:]
+		switch op {
+		case OpDisplay:
+			result = vm.display(args)
+		case OpPrintf:
+			result = vm.printf(args)
+		default:
+			if err := vm.env.AllocList(n); err != nil {
+				return err
+			}
+			result = &eval.List{Args: append(make([]eval.Object, 0, n), args...)}
+		}
+		vm.stack = vm.stack[:len(vm.stack)-n]
+	default:
+		return newError("unknown opcode %s", op)
+	}
+	if !isError(result) {
+		vm.push(result)
+	}
+	return result
+}
+
+func (vm *VM) push(obj eval.Object) {
+	vm.stack = append(vm.stack, obj)
+}
+
+func (vm *VM) pop() eval.Object {
+	obj := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return obj
+}
+
+func (vm *VM) peek(n int) eval.Object {
+	return vm.stack[len(vm.stack)-1-n]
+}
+
+// lookup finds name by walking out from env, as eval.Env.Get would.
+func (vm *VM) lookup(env *frame, name string) (eval.Object, bool) {
+	for ; env != nil; env = env.parent {
+		for i, slot := range env.fn.Slots {
+			if slot == name && env.slots[i] != nil {
+				return env.slots[i], true
+			}
+		}
+	}
+	obj, ok := vm.globals[name]
+	return obj, ok
+}
+
+// named gives a lambda being defined its name, like eval does by wrapping it
+// in a Procedure.
+func named(obj eval.Object, name string) eval.Object {
+	if c, ok := obj.(*Closure); ok && c.Name == "" {
+		return &Closure{Fn: c.Fn, Name: name, env: c.env}
+	}
+	return obj
+}
+
+// Apply calls a native or a builtin with arguments that have already been
+// evaluated, as a call in compiled code would.
+func (vm *VM) Apply(callee eval.Object, args []eval.Object) eval.Object {
+	switch callee := callee.(type) {
+	case *eval.Native:
+		return vm.env.CallNative(callee, append(make([]eval.Object, 0, len(args)), args...))
+	case *eval.Builtin:
+		return vm.applyBuiltin(callee, args)
+	case nil:
+		return newError("unknown procedure: nil")
+	}
+	return newError("unknown procedure: %s", callee.Inspect())
+}
+
+func (vm *VM) display(args []eval.Object) eval.Object {
+	if err := vm.check(lexer.DISPLAY); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	str := make([]string, 0, len(args))
+	for _, arg := range args {
+		str = append(str, inspect(arg))
+	}
+	if err := vm.env.Write(strings.Join(str, " ") + "\n"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (vm *VM) printf(args []eval.Object) eval.Object {
+	if err := vm.check(lexer.PRINTF); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	s, err := unquote(args)
+	if err != nil {
+		return err
+	}
+	if err := vm.env.Write(s); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (vm *VM) check(tok lexer.TokenType) *eval.Error {
+	return vm.env.CheckBuiltin(tok)
+}
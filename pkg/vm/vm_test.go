@@ -0,0 +1,457 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"doma/pkg/eval"
+	"doma/pkg/lexer"
+	"doma/pkg/parser"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func parse(t testing.TB, src string) *parser.Program {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parse errors: %v", p.Errors())
+	}
+	return program
+}
+
+func newEnv(out *bytes.Buffer) *eval.Env {
+	env := eval.NewInterpreter(eval.WithOutput(out), eval.WithCapabilities(eval.CapIO)).Env()
+	env.DefineNative("twice", 1, func(args []eval.Object) (eval.Object, error) {
+		n := args[0].(*eval.Number)
+		return &eval.Number{Value: n.Value * 2}, nil
+	})
+	env.DefineNative("pair", 0, func(args []eval.Object) (eval.Object, error) {
+		return &eval.List{Args: []eval.Object{&eval.Number{Value: 1}, &eval.Number{Value: 2}}}, nil
+	})
+	return env
+}
+
+func show(obj eval.Object) string {
+	if obj == nil {
+		return "<none>"
+	}
+	return obj.Inspect()
+}
+
+// runBoth evaluates src with eval.Eval and with the VM and returns the
+// output and result of each.
+func runBoth(t *testing.T, src string) (string, string) {
+	t.Helper()
+	program := parse(t, src)
+
+	var evalOut bytes.Buffer
+	evalResult := eval.Eval(program, newEnv(&evalOut))
+
+	var vmOut bytes.Buffer
+	fn, err := Compile(program)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	machine := New(newEnv(&bytes.Buffer{}))
+	machine.SetOutput(&vmOut)
+	vmResult := machine.Run(fn)
+
+	return evalOut.String() + show(evalResult), vmOut.String() + show(vmResult)
+}
+
+func TestExamples(t *testing.T) {
+	files, err := filepath.Glob("../../examples/*.doma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no examples found")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, got := runBoth(t, string(src))
+			if got != want {
+				t.Errorf("vm output differs\neval:\n%s\nvm:\n%s", want, got)
+			}
+		})
+	}
+}
+
+var differential = []string{
+	`(+ 1 2 3)`,
+	`(- 10 1 2)`,
+	`(* 2 3 4)`,
+	`(/ 20 2 5)`,
+	`(- 5)`,
+	`(+)`,
+	`(+ 1 "a")`,
+	`(+ "a" 1)`,
+	`(= 1 1)`,
+	`(= "a" "b")`,
+	`(= #t #t)`,
+	`(= 1 "a")`,
+	`(= '(1) '(1))`,
+	`(< 1 2)`,
+	`(>= "b" "a")`,
+	`(<= 2 2)`,
+	`(> '() '())`,
+	`(< 1)`,
+	`"string"`,
+	`'sym`,
+	`#f`,
+	`true`,
+	`'(1 a "b" (+ 1 2) +)`,
+	`(list 1 2 (+ 1 2))`,
+	`(first '(1 2 3))`,
+	`(first '())`,
+	`(first 1)`,
+	`(rest '(1 2 3))`,
+	`(rest '(1))`,
+	`(rest 1 2)`,
+	`(length '(1 2 3))`,
+	`(length 1)`,
+	`(cons 1 '(2 3))`,
+	`(cons 1 2)`,
+	`(list-ref '(1 2 3) 1)`,
+	`(list-ref 1 1)`,
+	`(list-ref '(1) "a")`,
+	`(if #t 1 2)`,
+	`(if #f 1 2)`,
+	`(if #f 1)`,
+	`(if '() 1 2)`,
+	`(if 0 1 2)`,
+	`(if 1)`,
+	`(begin 1 2 3)`,
+	`(begin)`,
+	`(display 1 "two" 'three '(4))`,
+	`(display)`,
+	`(printf "a\tb\n" 1)`,
+	`(define x 5) x`,
+	`(define x 5)`,
+	`(define f (lambda '(a) a)) f`,
+	`(lambda '(a) a)`,
+	`(define f (lambda '(a) a)) (define g f) g`,
+	`(define x 1 2)`,
+	`(define 1 2)`,
+	`(lambda '(a))`,
+	`(lambda a a)`,
+	`(lambda '(1) 1)`,
+	`undefined`,
+	`(undefined 1)`,
+	`(1 2)`,
+	`("a")`,
+	`(define add (lambda '(a b) (+ a b))) (add 1 2)`,
+	`(define add (lambda '(a b) (+ a b))) (add 1)`,
+	`(define add (lambda '(a b) (+ a b))) (add 1 2 3)`,
+	`(define args (lambda '(a b) (list a b))) (args 1)`,
+	`(define dup (lambda '(a a) a)) (dup 1 2)`,
+	`(define fact (lambda '(n) (if (= n 0) 1 (* n (fact (- n 1)))))) (fact 10)`,
+	`(define adder (lambda '(n) (lambda '(m) (+ n m)))) ((adder 3) 4)`,
+	`(define adder (lambda '(n) (lambda '(m) (+ n m)))) (define add3 (adder 3)) (add3 10)`,
+	`(define f (lambda '(x) (define y (* x 2)) (+ x y))) (f 3)`,
+	`(define f (lambda '(x) (define g (lambda '() x)) g)) ((f 7))`,
+	`(define f (lambda '(x) (define g (lambda '() x)) g)) (f 7)`,
+	`(define y 100) (define f (lambda '() (define z y) (define y 1) (+ z y))) (f)`,
+	`(define y 100) (define f (lambda '() (begin (define y 2)) y)) (f) y`,
+	`(define x 1) (define f (lambda '(x) x)) (f 2) x`,
+	`(define f (lambda '(n) (if (= n 0) 'done (f (- n 1))))) (f 100)`,
+	`(define f +) (f 1 2 3)`,
+	`(define f +) (f)`,
+	`(define f first) (f '(9 8))`,
+	`(define f display) (f 1 2)`,
+	`(define apply (lambda '(fn a) (fn a))) (apply twice 21)`,
+	`(twice 4)`,
+	`(twice 4 5)`,
+	`(define d '(1 2)) (cons 0 d) d`,
+	`(define l (lambda '() '(1 2))) (cons 0 (l)) (l)`,
+	`(define map (lambda '(lst fn acc) (if (= 0 (length lst)) acc (map (rest lst) fn (cons (fn (first lst)) acc))))) (map '(1 2 3) twice '())`,
+	`(define counter (lambda '(n) (if (> n 0) (begin (display n) (counter (- n 1))) 'liftoff))) (counter 3)`,
+	`(display (+ 1 "x")) (display "never")`,
+	`(define x 1) (define x (+ x 1)) x`,
+	`((lambda '(a b) (* a b)) 6 7)`,
+	`(define outer (lambda '(a) (define inner (lambda '(b) (define c (+ a b)) (lambda '() c))) ((inner 2)))) (outer 1)`,
+}
+
+func TestDifferential(t *testing.T) {
+	for _, src := range differential {
+		t.Run(src, func(t *testing.T) {
+			want, got := runBoth(t, src)
+			if got != want {
+				t.Errorf("eval: %q\nvm:   %q", want, got)
+			}
+		})
+	}
+}
+
+func TestGlobalsPersistAcrossRuns(t *testing.T) {
+	machine := New(nil)
+	for _, src := range []string{`(define n 41)`, `(define inc (lambda '(x) (+ x 1)))`} {
+		fn, err := Compile(parse(t, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.Run(fn)
+	}
+	fn, err := Compile(parse(t, `(inc n)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := show(machine.Run(fn)); got != "42" {
+		t.Errorf("got %s, want 42", got)
+	}
+}
+
+func TestDeepRecursion(t *testing.T) {
+	src := `(define count (lambda '(n acc) (if (= n 0) acc (count (- n 1) (+ acc 1))))) (count 100000 0)`
+	fn, err := Compile(parse(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := eval.NewEnv()
+	env.SetLimits(eval.Limits{MaxDepth: -1})
+	if got := show(New(env).Run(fn)); got != "100000" {
+		t.Errorf("got %s, want 100000", got)
+	}
+	if got := show(New(nil).Run(fn)); got != "ERROR: recursion depth limit exceeded (10000 calls)" {
+		t.Errorf("got %s without a depth limit set", got)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	loop := `(define loop (lambda '(n) (loop (+ n 1)))) (loop 0)`
+	tests := []struct {
+		src    string
+		limits eval.Limits
+		want   string
+	}{
+		{loop, eval.Limits{MaxSteps: 100}, "ERROR: step limit exceeded (100 steps)"},
+		{loop, eval.Limits{MaxDepth: 50}, "ERROR: recursion depth limit exceeded (50 calls)"},
+		{`(cons 1 (list 2 3))`, eval.Limits{MaxAllocs: 5}, "ERROR: allocation limit exceeded (5 objects)"},
+		{`(list 1 2 3)`, eval.Limits{MaxListLen: 2}, "ERROR: list size limit exceeded (2 elements)"},
+		{`(display "abc") (display "def")`, eval.Limits{MaxOutput: 6}, "abc\nERROR: output limit exceeded (6 bytes)"},
+		{`(pair)`, eval.Limits{MaxListLen: 1}, "ERROR: list size limit exceeded (1 elements)"},
+		{`(pair) (pair)`, eval.Limits{MaxAllocs: 5}, "ERROR: allocation limit exceeded (5 objects)"},
+	}
+	for _, tt := range tests {
+		fn, err := Compile(parse(t, tt.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		env := newEnv(&out)
+		env.SetLimits(tt.limits)
+		machine := New(env)
+		// the counts start over and the calls left open are closed, so a
+		// second run fails the same way
+		for i := 0; i < 2; i++ {
+			out.Reset()
+			result := show(machine.Run(fn))
+			if got := out.String() + result; got != tt.want {
+				t.Errorf("%s with %+v, run %d: got %q, want %q", tt.src, tt.limits, i+1, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	src := `(define loop (lambda '(n) (loop (+ n 1)))) (loop 0)`
+	fn, err := Compile(parse(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := eval.NewEnv()
+	env.SetLimits(eval.Limits{MaxDepth: -1})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	obj := New(env).RunContext(ctx, fn)
+	if err, ok := obj.(*eval.Error); !ok || !errors.Is(err.Err, eval.ErrCanceled) {
+		t.Errorf("got %s, want a cancellation", show(obj))
+	}
+}
+
+func TestOutputFromEnv(t *testing.T) {
+	fn, err := Compile(parse(t, `(display "hi") (printf "x\ty")`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	New(newEnv(&out)).Run(fn)
+	if got := out.String(); got != "hi\nx\ty" {
+		t.Errorf("got output %q", got)
+	}
+}
+
+const fib = `
+(define fib
+  (lambda '(n)
+    (if (< n 2)
+        n
+        (+ (fib (- n 1)) (fib (- n 2))))))
+(fib 20)`
+
+const sum = `
+(define sum
+  (lambda '(n acc)
+    (if (= n 0)
+        acc
+        (sum (- n 1) (+ acc n)))))
+(sum 5000 0)`
+
+func benchmarkEval(b *testing.B, src string) {
+	program := parse(b, src)
+	for i := 0; i < b.N; i++ {
+		eval.Eval(program, eval.NewEnv())
+	}
+}
+
+func benchmarkVM(b *testing.B, src string) {
+	fn, err := Compile(parse(b, src))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		New(nil).Run(fn)
+	}
+}
+
+func BenchmarkFibEval(b *testing.B) { benchmarkEval(b, fib) }
+func BenchmarkFibVM(b *testing.B)   { benchmarkVM(b, fib) }
+func BenchmarkSumEval(b *testing.B) { benchmarkEval(b, sum) }
+func BenchmarkSumVM(b *testing.B)   { benchmarkVM(b, sum) }
+
+func TestModuleRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("../../examples/*.doma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fn, err := Compile(parse(t, string(src)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := NewModule(fn, filepath.Base(file), src).MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			module := &Module{}
+			if err := module.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if module.Source != filepath.Base(file) || module.Stale(src) || !module.Stale(append(src, ' ')) {
+				t.Errorf("header not preserved: %q", module.Source)
+			}
+			if got, want := Disassemble(module.Main), Disassemble(fn); got != want {
+				t.Errorf("decoded code differs\nwant:\n%s\ngot:\n%s", want, got)
+			}
+			for i := range data {
+				if err := (&Module{}).UnmarshalBinary(data[:i]); err == nil {
+					t.Fatalf("decoding %d of %d bytes succeeded", i, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestCompiledCodeValidates(t *testing.T) {
+	for _, src := range differential {
+		fn, err := Compile(parse(t, src))
+		if err != nil {
+			continue
+		}
+		data, err := NewModule(fn, "a.doma", []byte(src)).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Module{}).UnmarshalBinary(data); err != nil {
+			t.Errorf("%s: %v\n%s", src, err, Disassemble(fn))
+		}
+	}
+}
+
+func TestCorruptModules(t *testing.T) {
+	op := func(op Opcode, args ...int) []byte {
+		code := []byte{byte(op)}
+		for _, arg := range args {
+			code = append(code, byte(arg>>8), byte(arg))
+		}
+		return code
+	}
+	code := func(ops ...[]byte) []byte {
+		return bytes.Join(ops, nil)
+	}
+	inner := func(c []byte) *Function {
+		return &Function{Name: "f", Params: 1, Slots: []string{"x"}, Code: c}
+	}
+	closure := func(fn *Function) *Function {
+		return &Function{Name: "main", Code: code(op(OpClosure, 0), op(OpReturn)), Constants: []eval.Object{fn}}
+	}
+	tests := []struct {
+		name string
+		main *Function
+	}{
+		{"empty code", &Function{Name: "main"}},
+		{"lone pop", &Function{Name: "main", Code: op(OpPop)}},
+		{"no return", &Function{Name: "main", Code: op(OpNil)}},
+		{"return with an empty stack", &Function{Name: "main", Code: op(OpReturn)}},
+		{"values left on the stack", &Function{Name: "main", Code: code(op(OpNil), op(OpNil), op(OpReturn))}},
+		{"unknown opcode", &Function{Name: "main", Code: []byte{200}}},
+		{"truncated operand", &Function{Name: "main", Code: []byte{byte(OpConstant), 0}}},
+		{"missing constant", &Function{Name: "main", Code: code(op(OpConstant, 3), op(OpReturn))}},
+		{"local at the top level", &Function{Name: "main", Code: code(op(OpGetLocal, 0, 0), op(OpReturn))}},
+		{"local depth out of range", closure(inner(code(op(OpGetLocal, 1, 0), op(OpReturn))))},
+		{"local slot out of range", closure(inner(code(op(OpGetLocal, 0, 1), op(OpReturn))))},
+		{"too few arguments for call", &Function{Name: "main", Code: code(op(OpNil), op(OpCall, 2), op(OpReturn))}},
+		{"jump into an operand", &Function{Name: "main", Code: code(op(OpJump, 1), op(OpNil), op(OpReturn))}},
+		{"jump past the end", &Function{Name: "main", Code: code(op(OpJump, 9), op(OpReturn))}},
+		{"unbalanced branches", &Function{Name: "main", Code: code(
+			op(OpNil), op(OpJumpIfFalse, 7), op(OpNil), op(OpNil), op(OpNil), op(OpReturn),
+		)}},
+	}
+	for _, tt := range tests {
+		data, err := NewModule(tt.main, "a.doma", nil).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Module{}).UnmarshalBinary(data); !errors.Is(err, ErrFormat) {
+			t.Errorf("%s: got %v, want a format error", tt.name, err)
+		}
+	}
+	// code that only goes wrong at run time fails with an error
+	runs := []struct {
+		main *Function
+		want string
+	}{
+		{closure(inner(code(op(OpGetLocal, 0, 0), op(OpReturn)))), "#<procedure>"},
+		{&Function{Name: "main", Code: code(op(OpConstant, 0), op(OpConstant, 1), op(OpAdd), op(OpReturn)), Constants: []eval.Object{&eval.String{Value: "a"}, &eval.Number{Value: 1}}},
+			"ERROR: type mismatch - expected number, got STRING"},
+		{&Function{Name: "main", Code: code(op(OpVoid), op(OpCall, 0), op(OpReturn))}, "ERROR: unknown procedure: nil"},
+	}
+	for _, tt := range runs {
+		data, err := NewModule(tt.main, "a.doma", nil).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		module := &Module{}
+		if err := module.UnmarshalBinary(data); err != nil {
+			t.Errorf("%s: %v", Disassemble(tt.main), err)
+			continue
+		}
+		if got := show(New(nil).Run(module.Main)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", Disassemble(tt.main), got, tt.want)
+		}
+	}
+}